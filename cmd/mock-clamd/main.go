@@ -0,0 +1,111 @@
+// Command mock-clamd is a minimal stand-in for the ClamAV daemon, for local
+// development of upload scanning. It answers PING, VERSION and INSTREAM on a
+// TCP socket, and reports streams containing the EICAR test string (or the
+// -marker given) as infected. It detects nothing else.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// eicar is the standard antivirus test string, split so that scanners do
+// not flag this file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+type server struct {
+	marker    []byte
+	maxLength int64 // Like clamd's StreamMaxLength
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:3310", "listen address")
+	marker := flag.String("marker", eicar, "content reported as infected")
+	maxLength := flag.Int64("max-length", 25*1024*1024, "largest stream accepted, in bytes")
+	flag.Parse()
+
+	s := &server{marker: []byte(*marker), maxLength: *maxLength}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Mock clamd listening on %s", *addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves one command. Commands prefixed with z end with a null byte,
+// others with a newline, and so does the reply.
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	reader := bufio.NewReader(conn)
+	delim := byte('\n')
+	if prefix, err := reader.Peek(1); err == nil && prefix[0] == 'z' {
+		delim = 0
+	}
+
+	command, err := reader.ReadString(delim)
+	if err != nil {
+		return
+	}
+	command = strings.TrimRight(strings.TrimLeft(command, "zn"), "\x00\n")
+
+	var reply string
+	switch command {
+	case "PING":
+		reply = "PONG"
+	case "VERSION":
+		reply = "ClamAV 1.0.0/mock"
+	case "INSTREAM":
+		reply = s.scanStream(reader)
+	default:
+		reply = "UNKNOWN COMMAND"
+	}
+
+	conn.Write(append([]byte(reply), delim))
+}
+
+// scanStream reads the chunks of an INSTREAM command, each prefixed with its
+// length, until an empty one
+func (s *server) scanStream(r io.Reader) string {
+	var data bytes.Buffer
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return "INSTREAM: Can't read chunk size. ERROR"
+		}
+		if length == 0 {
+			break
+		}
+		if int64(data.Len())+int64(length) > s.maxLength {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		if _, err := io.CopyN(&data, r, int64(length)); err != nil {
+			return "INSTREAM: Can't read chunk. ERROR"
+		}
+	}
+
+	if bytes.Contains(data.Bytes(), s.marker) {
+		log.Printf("Stream of %d bytes infected", data.Len())
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+
+	log.Printf("Stream of %d bytes clean", data.Len())
+	return "stream: OK"
+}
@@ -0,0 +1,135 @@
+// Command mock-s3 is a minimal in-memory stand-in for S3-compatible object
+// storage, for local development of the s3 storage driver. It serves
+// path-style object requests (PUT, GET, HEAD and DELETE) for any bucket and
+// only checks the access key of the signature, so it must never be exposed
+// outside a development machine.
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data        []byte
+	contentType string
+	metadata    http.Header // x-amz-meta-* headers
+	modTime     time.Time
+}
+
+type server struct {
+	accessKeyID string
+
+	mu      sync.RWMutex
+	objects map[string]object // Keyed by bucket/key
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9100", "listen address")
+	accessKeyID := flag.String("access-key", "mock-access-key", "accepted access key ID")
+	flag.Parse()
+
+	s := &server{
+		accessKeyID: *accessKeyID,
+		objects:     make(map[string]object),
+	}
+
+	http.HandleFunc("/", s.handle)
+
+	log.Printf("Mock S3 listening on %s, accepting access key %s", *addr, *accessKeyID)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (s *server) handle(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, key, _ := strings.Cut(name, "/"); bucket == "" || key == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Only path-style object requests are supported")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+
+		metadata := make(http.Header)
+		for header, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(header), "x-amz-meta-") {
+				metadata[header] = values
+			}
+		}
+
+		s.mu.Lock()
+		s.objects[name] = object{data: data, contentType: r.Header.Get("Content-Type"), metadata: metadata, modTime: time.Now()}
+		s.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		s.mu.RLock()
+		obj, exists := s.objects[name]
+		s.mu.RUnlock()
+
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+
+		if obj.contentType != "" {
+			w.Header().Set("Content-Type", obj.contentType)
+		}
+		for header, values := range obj.metadata {
+			w.Header()[header] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, name)
+		s.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed")
+	}
+}
+
+// authorized checks the access key in the Signature Version 4 credential
+func (s *server) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	_, credential, found := strings.Cut(header, "Credential=")
+	if !strings.HasPrefix(header, "AWS4-HMAC-SHA256 ") || !found {
+		return false
+	}
+
+	accessKeyID, _, _ := strings.Cut(credential, "/")
+	return accessKeyID == s.accessKeyID
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
@@ -4,13 +4,18 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/api"
 	"github.com/aelhady03/twerlo-chat-app/internal/auth"
 	"github.com/aelhady03/twerlo-chat-app/internal/config"
 	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/mail"
+	"github.com/aelhady03/twerlo-chat-app/internal/media"
 	"github.com/aelhady03/twerlo-chat-app/internal/repository"
+	"github.com/aelhady03/twerlo-chat-app/internal/scan"
 	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
 	"github.com/aelhady03/twerlo-chat-app/internal/websocket"
 )
 
@@ -33,23 +38,105 @@ func main() {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	// Initialize JWT manager
-	jwtManager := auth.NewJWTManager(cfg.JWT.Secret, "twerlo-chat-app")
-
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(db)
 	messageRepo := repository.NewMessageRepository(db)
+	identityRepo := repository.NewIdentityRepository(db)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(db)
+	twoFactorRepo := repository.NewTwoFactorRepository(db)
+	revocationRepo := repository.NewRevocationRepository(db)
+	apiTokenRepo := repository.NewAPITokenRepository(db)
+	attachmentRepo := repository.NewAttachmentRepository(db)
+	blobRepo := repository.NewBlobRepository(db)
+
+	// Load JWT keys, asymmetric when a signing key is configured
+	keys := auth.NewHMACKeySet(cfg.JWT.Secret)
+	if cfg.JWT.SigningKeyFile != "" {
+		keys, err = auth.LoadKeySet(cfg.JWT.SigningKeyFile, cfg.JWT.VerificationKeyFiles)
+		if err != nil {
+			log.Fatalf("Failed to load JWT keys: %v", err)
+		}
+	}
+
+	// Initialize JWT manager
+	jwtManager := auth.NewJWTManager(keys, "twerlo-chat-app", cfg.JWT.AccessTokenTTL, revocationRepo)
+
+	// Initialize single sign-on if an identity provider is configured
+	var oidcProvider *auth.OIDCProvider
+	if cfg.OIDC.Enabled() {
+		oidcProvider = auth.NewOIDCProvider(cfg.OIDC.IssuerURL, cfg.OIDC.ClientID, cfg.OIDC.ClientSecret, cfg.OIDC.RedirectURL, cfg.OIDC.Scopes)
+		log.Printf("OIDC single sign-on enabled for %s", cfg.OIDC.IssuerURL)
+	}
+
+	// Initialize login throttling, shared between instances when stored in PostgreSQL
+	var attemptStore auth.AttemptStore = auth.NewMemoryAttemptStore()
+	if cfg.Login.Store == "postgres" {
+		attemptStore = repository.NewLoginAttemptRepository(db)
+	}
+	loginThrottle := auth.NewLoginThrottle(attemptStore, &cfg.Login)
+
+	// Initialize mailer
+	mailer, err := mail.NewMailer(&cfg.Mail)
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Initialize password policy
+	passwordPolicy, err := service.NewPasswordPolicy(&cfg.Password)
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+
+	// Initialize media storage
+	blobStore, err := storage.NewBlobStore(&cfg.Upload)
+	if err != nil {
+		log.Fatalf("Failed to initialize media storage: %v", err)
+	}
+
+	partialStore, err := storage.NewPartialStore(cfg.Upload.ResumablePath, cfg.Upload.ResumableTTL, cfg.Upload.ResumableMaxPending)
+	if err != nil {
+		log.Fatalf("Failed to initialize resumable uploads: %v", err)
+	}
+	go partialStore.RunSweeper(time.Hour)
+
+	urlSigner := storage.NewURLSigner(cfg.Upload.URLSecret, cfg.Upload.URLTTL)
+
+	typeChecker, err := media.NewTypeChecker(cfg.Upload.AllowedTypes)
+	if err != nil {
+		log.Fatalf("Invalid UPLOAD_ALLOWED_TYPES: %v", err)
+	}
+
+	uploadScanner, err := scan.NewScanner(&cfg.Upload.Scan)
+	if err != nil {
+		log.Fatalf("Failed to initialize upload scanner: %v", err)
+	}
 
 	// Initialize services
-	userService := service.NewUserService(userRepo, jwtManager)
-	messageService := service.NewMessageService(messageRepo, userRepo)
+	userService := service.NewUserService(userRepo, identityRepo, refreshTokenRepo, twoFactorRepo, revocationRepo, jwtManager, mailer, passwordPolicy, cfg)
+	attachmentService := service.NewAttachmentService(attachmentRepo, blobRepo, userRepo, blobStore, urlSigner, typeChecker, uploadScanner, &cfg.Upload)
+	messageService := service.NewMessageService(messageRepo, userRepo, attachmentService, urlSigner)
+	tokenService := service.NewAPITokenService(apiTokenRepo, userRepo, &cfg.APITokens)
+
+	// Forget the rate limits of tokens no longer in use
+	go tokenService.RunBucketSweeper(time.Minute)
+
+	// Delete uploads that were never sent in a message
+	go attachmentService.RunOrphanSweeper(time.Hour)
+
+	// Scan uploads whose scan failed
+	go attachmentService.RunScanner(cfg.Upload.Scan.RetryInterval)
+
+	// Bootstrap administrators from the configuration
+	if err := userService.PromoteAdmins(cfg.Admin.Emails); err != nil {
+		log.Fatalf("Failed to promote administrators: %v", err)
+	}
 
 	// Initialize WebSocket hub
-	hub := websocket.NewHub(jwtManager, userService)
+	hub := websocket.NewHub(jwtManager, userService, cfg)
 	go hub.Run()
 
 	// Initialize router
-	router := api.NewRouter(userService, messageService, jwtManager, hub, cfg)
+	router := api.NewRouter(userService, messageService, attachmentService, tokenService, jwtManager, oidcProvider, loginThrottle, hub, blobStore, partialStore, urlSigner, typeChecker, cfg)
 	routes := router.SetupRoutes()
 
 	// Start server
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/websocket"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type AdminHandler struct {
+	userService       *service.UserService
+	attachmentService *service.AttachmentService
+	hub               *websocket.Hub
+	throttle          *auth.LoginThrottle
+}
+
+func NewAdminHandler(userService *service.UserService, attachmentService *service.AttachmentService, hub *websocket.Hub, throttle *auth.LoginThrottle) *AdminHandler {
+	return &AdminHandler{
+		userService:       userService,
+		attachmentService: attachmentService,
+		hub:               hub,
+		throttle:          throttle,
+	}
+}
+
+// GetHubStats reports the clients connected to the hub and recent disconnects
+func (h *AdminHandler) GetHubStats(w http.ResponseWriter, r *http.Request) {
+	writeSuccessResponse(w, http.StatusOK, "Hub stats retrieved successfully", h.hub.Stats())
+}
+
+// DisconnectUser closes every hub connection of a user
+func (h *AdminHandler) DisconnectUser(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	closed := h.hub.DisconnectUser(userID, "disconnected by administrator")
+
+	writeSuccessResponse(w, http.StatusOK, "User disconnected successfully", map[string]int{
+		"connections_closed": closed,
+	})
+}
+
+// ListUsers returns every user with their email address and role
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.userService.GetAllUsers()
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "USERS_FAILED", "Failed to retrieve users")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Users retrieved successfully", users)
+}
+
+// GetUser returns a user with their email address and role
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	user, err := h.userService.GetUserByID(userID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusNotFound, "USER_NOT_FOUND", "User not found")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "User retrieved successfully", user)
+}
+
+// UpdateUserRole changes the role of a user
+func (h *AdminHandler) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	var req models.UpdateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	user, err := h.userService.UpdateUserRole(claims.UserID, userID, req.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidRole):
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_ROLE", "Role must be user, moderator or admin")
+		case errors.Is(err, service.ErrOwnRole):
+			writeErrorResponse(w, http.StatusForbidden, "OWN_ROLE", err.Error())
+		default:
+			writeErrorResponse(w, http.StatusNotFound, "USER_NOT_FOUND", "User not found")
+		}
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Role updated successfully", user)
+}
+
+// ResetTwoFactor removes a user's two-factor enrollment, for users who lost
+// their authenticator and recovery codes
+func (h *AdminHandler) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	if err := h.userService.ResetTwoFactor(userID); err != nil {
+		writeErrorResponse(w, http.StatusNotFound, "USER_NOT_FOUND", "User not found")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Two-factor authentication reset successfully", nil)
+}
+
+// GetFailedLogins lists the latest failed login and registration attempts
+func (h *AdminHandler) GetFailedLogins(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
+			limit = parsed
+		}
+	}
+
+	attempts, err := h.throttle.RecentFailures(limit)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "FETCH_FAILED", "Failed to get failed login attempts")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Failed login attempts retrieved successfully", attempts)
+}
+
+// GetStorageReport sums up the storage taken by uploads, with the users
+// storing the most
+func (h *AdminHandler) GetStorageReport(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+
+	report, err := h.attachmentService.StorageReport(limit)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "FETCH_FAILED", "Failed to get storage report")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Storage report retrieved successfully", report)
+}
+
+// GetUserStorage reports the storage usage and quota of a user
+func (h *AdminHandler) GetUserStorage(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	usage, err := h.attachmentService.Usage(userID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusNotFound, "USER_NOT_FOUND", "User not found")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Storage usage retrieved successfully", usage)
+}
+
+// UpdateUserStorageQuota gives a user their own storage quota, or puts them
+// back on the quota of their role
+func (h *AdminHandler) UpdateUserStorageQuota(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	// Get user ID from URL
+	vars := mux.Vars(r)
+	userID, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USER_ID", "Invalid user ID format")
+		return
+	}
+
+	var req models.UpdateStorageQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	usage, err := h.attachmentService.SetQuota(claims.UserID, userID, req.QuotaBytes)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidQuota) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_QUOTA", "Quota must be a non-negative number of bytes")
+			return
+		}
+		writeErrorResponse(w, http.StatusNotFound, "USER_NOT_FOUND", "User not found")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Storage quota updated successfully", usage)
+}
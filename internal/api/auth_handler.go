@@ -2,19 +2,35 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
 	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/websocket"
 )
 
+// Cookie binding an OIDC login to the browser that started it
+const oidcStateCookie = "oidc_state"
+
 type AuthHandler struct {
 	userService *service.UserService
+	hub         *websocket.Hub
+	oidc        *auth.OIDCProvider // nil when single sign-on is disabled
+	throttle    *auth.LoginThrottle
+	trustProxy  bool
 }
 
-func NewAuthHandler(userService *service.UserService) *AuthHandler {
+func NewAuthHandler(userService *service.UserService, hub *websocket.Hub, oidc *auth.OIDCProvider, throttle *auth.LoginThrottle, trustProxy bool) *AuthHandler {
 	return &AuthHandler{
 		userService: userService,
+		hub:         hub,
+		oidc:        oidc,
+		throttle:    throttle,
+		trustProxy:  trustProxy,
 	}
 }
 
@@ -32,22 +48,48 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Password) < 6 {
-		writeErrorResponse(w, http.StatusBadRequest, "WEAK_PASSWORD", "Password must be at least 6 characters long")
+	// Registering taken emails is a way to find accounts, so conflicts
+	// count as failures of the IP address
+	ip := clientIP(r, h.trustProxy)
+	attempt, wait := h.throttle.Begin(ip, "")
+	if wait > 0 {
+		writeThrottledResponse(w, wait)
 		return
 	}
 
 	// Register user
-	authResponse, err := h.userService.Register(&req)
+	authResponse, pendingUser, err := h.userService.Register(&req)
 	if err != nil {
+		var weak *service.WeakPasswordError
+		if errors.As(err, &weak) {
+			attempt.Cancel()
+			writeErrorResponse(w, http.StatusBadRequest, "WEAK_PASSWORD", "Password "+weak.Reason)
+			return
+		}
 		if err.Error() == "email already exists" || err.Error() == "username already exists" {
+			attempt.Failure(&models.FailedLoginAttempt{
+				Action:     "register",
+				Identifier: req.Email,
+				IPAddress:  ip,
+				UserAgent:  r.UserAgent(),
+				Reason:     err.Error(),
+			})
 			writeErrorResponse(w, http.StatusConflict, "USER_EXISTS", err.Error())
 			return
 		}
+		attempt.Cancel()
 		writeErrorResponse(w, http.StatusInternalServerError, "REGISTRATION_FAILED", "Failed to register user")
 		return
 	}
 
+	attempt.Success()
+
+	// No tokens until the email address is verified
+	if pendingUser != nil {
+		writeSuccessResponse(w, http.StatusCreated, "User registered successfully, check your email to verify your address", pendingUser)
+		return
+	}
+
 	writeSuccessResponse(w, http.StatusCreated, "User registered successfully", authResponse)
 }
 
@@ -65,17 +107,354 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r, h.trustProxy)
+	attempt, wait := h.throttle.Begin(ip, req.Email)
+	if wait > 0 {
+		writeThrottledResponse(w, wait)
+		return
+	}
+
 	// Authenticate user
-	authResponse, err := h.userService.Login(&req)
+	authResponse, challenge, err := h.userService.Login(&req)
 	if err != nil {
+		if errors.Is(err, service.ErrEmailNotVerified) {
+			// The password was right
+			attempt.Success()
+			writeErrorResponse(w, http.StatusForbidden, "EMAIL_NOT_VERIFIED", "Please verify your email address before logging in")
+			return
+		}
+		attempt.Failure(&models.FailedLoginAttempt{
+			Action:     "login",
+			Identifier: req.Email,
+			IPAddress:  ip,
+			UserAgent:  r.UserAgent(),
+			Reason:     "invalid credentials",
+		})
 		writeErrorResponse(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid email or password")
 		return
 	}
 
+	attempt.Success()
+
+	// The password was right, but a second factor is needed for the tokens
+	if challenge != nil {
+		writeSuccessResponse(w, http.StatusOK, "Two-factor authentication required", challenge)
+		return
+	}
+
 	writeSuccessResponse(w, http.StatusOK, "Login successful", authResponse)
 }
 
-// Logout handles user logout
+// VerifyTwoFactor completes a login with a TOTP or recovery code
+func (h *AuthHandler) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req models.TwoFactorVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Challenge token and a code or recovery code are required")
+		return
+	}
+
+	authResponse, err := h.userService.VerifyTwoFactor(&req)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Login successful", authResponse)
+}
+
+// OIDCLogin starts a single sign-on login and returns the identity
+// provider URL to send the user to
+func (h *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		writeErrorResponse(w, http.StatusNotFound, "OIDC_DISABLED", "Single sign-on is not configured")
+		return
+	}
+
+	state, authURL, err := h.oidc.AuthCodeURL(r.Context())
+	if err != nil {
+		log.Printf("Failed to start OIDC login: %v", err)
+		writeErrorResponse(w, http.StatusBadGateway, "OIDC_UNAVAILABLE", "Identity provider is unavailable")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeSuccessResponse(w, http.StatusOK, "OIDC login started", models.OIDCLoginResponse{
+		AuthorizationURL: authURL,
+	})
+}
+
+// OIDCCallback completes a single sign-on login with the code and state the
+// identity provider redirected back with
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		writeErrorResponse(w, http.StatusNotFound, "OIDC_DISABLED", "Single sign-on is not configured")
+		return
+	}
+
+	var req models.OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Code == "" || req.State == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Code and state are required")
+		return
+	}
+
+	// The state must come back to the browser that started the login
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value != req.State {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_STATE", "Login state does not match, please try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc", MaxAge: -1})
+
+	identity, err := h.oidc.Exchange(r.Context(), req.Code, req.State)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidOIDCState) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_STATE", "Login state is invalid or expired, please try again")
+			return
+		}
+		log.Printf("OIDC code exchange failed: %v", err)
+		writeErrorResponse(w, http.StatusUnauthorized, "OIDC_FAILED", "Single sign-on failed")
+		return
+	}
+
+	authResponse, challenge, err := h.userService.LoginWithOIDC(identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrOIDCEmailRequired):
+			writeErrorResponse(w, http.StatusForbidden, "OIDC_EMAIL_REQUIRED", err.Error())
+		case errors.Is(err, service.ErrEmailNotVerified):
+			writeErrorResponse(w, http.StatusForbidden, "EMAIL_NOT_VERIFIED", "Please verify your email address before logging in")
+		case errors.Is(err, service.ErrOIDCEmailNotVerified):
+			writeErrorResponse(w, http.StatusForbidden, "OIDC_EMAIL_NOT_VERIFIED", "An account with this email exists, but the identity provider has not verified the email address")
+		default:
+			log.Printf("OIDC login failed: %v", err)
+			writeErrorResponse(w, http.StatusInternalServerError, "LOGIN_FAILED", "Failed to log in")
+		}
+		return
+	}
+
+	// The identity provider vouched for the user, but a second factor is
+	// needed for the tokens
+	if challenge != nil {
+		writeSuccessResponse(w, http.StatusOK, "Two-factor authentication required", challenge)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Login successful", authResponse)
+}
+
+// VerifyEmail verifies an email address with the token from the
+// verification link
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Token == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Token is required")
+		return
+	}
+
+	user, err := h.userService.VerifyEmail(req.Token)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidEmailToken) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_TOKEN", "Verification link is invalid or expired")
+			return
+		}
+		writeErrorResponse(w, http.StatusInternalServerError, "VERIFICATION_FAILED", "Failed to verify email address")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Email address verified successfully", user)
+}
+
+// ResendVerification sends a new verification link. The response is the
+// same whether or not the address belongs to an account.
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Email == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Email is required")
+		return
+	}
+
+	h.userService.RequestEmailVerification(req.Email)
+
+	writeSuccessResponse(w, http.StatusAccepted, "If the address belongs to an unverified account, a verification link has been sent", nil)
+}
+
+// ForgotPassword sends a password reset link. The response is the same
+// whether or not the address belongs to an account.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Email == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Email is required")
+		return
+	}
+
+	h.userService.RequestPasswordReset(req.Email)
+
+	writeSuccessResponse(w, http.StatusAccepted, "If the address belongs to an account, a password reset link has been sent", nil)
+}
+
+// ResetPassword sets a new password with the token from the reset link
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Token and password are required")
+		return
+	}
+
+	userID, err := h.userService.ResetPassword(req.Token, req.Password)
+	if err != nil {
+		var weak *service.WeakPasswordError
+		if errors.As(err, &weak) {
+			writeErrorResponse(w, http.StatusBadRequest, "WEAK_PASSWORD", "Password "+weak.Reason)
+			return
+		}
+		if errors.Is(err, service.ErrInvalidEmailToken) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_TOKEN", "Password reset link is invalid or expired")
+			return
+		}
+		writeErrorResponse(w, http.StatusInternalServerError, "RESET_FAILED", "Failed to reset password")
+		return
+	}
+
+	// Every session was revoked, close their real-time connections too
+	h.hub.DisconnectUserSessions(userID, "password reset")
+
+	writeSuccessResponse(w, http.StatusOK, "Password reset successfully, please log in", nil)
+}
+
+// ChangePassword sets a new password for the current user and ends their
+// other sessions
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.NewPassword == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "New password is required")
+		return
+	}
+
+	// Guessing the current password is throttled like logins
+	ip := clientIP(r, h.trustProxy)
+	attempt, wait := h.throttle.Begin(ip, claims.Email)
+	if wait > 0 {
+		writeThrottledResponse(w, wait)
+		return
+	}
+
+	sessionIDs, err := h.userService.ChangePassword(claims.UserID, claims.SessionID, req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		var weak *service.WeakPasswordError
+		switch {
+		case errors.Is(err, service.ErrWrongPassword):
+			attempt.Failure(&models.FailedLoginAttempt{
+				Action:     "change_password",
+				Identifier: claims.Email,
+				IPAddress:  ip,
+				UserAgent:  r.UserAgent(),
+				Reason:     "invalid credentials",
+			})
+			writeErrorResponse(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Current password is incorrect")
+		case errors.As(err, &weak):
+			// The current password was right
+			attempt.Success()
+			writeErrorResponse(w, http.StatusBadRequest, "WEAK_PASSWORD", "Password "+weak.Reason)
+		default:
+			attempt.Cancel()
+			writeErrorResponse(w, http.StatusInternalServerError, "PASSWORD_CHANGE_FAILED", "Failed to change password")
+		}
+		return
+	}
+
+	attempt.Success()
+
+	// The other sessions were revoked, close their real-time connections too
+	for _, sessionID := range sessionIDs {
+		h.hub.DisconnectSession(sessionID, "password changed")
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Password changed successfully", nil)
+}
+
+// Refresh exchanges a refresh token for a new token pair
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.RefreshToken == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Refresh token is required")
+		return
+	}
+
+	authResponse, err := h.userService.Refresh(req.RefreshToken)
+	if err != nil {
+		var reused *service.RefreshTokenReusedError
+		switch {
+		case errors.As(err, &reused):
+			// Close real-time connections opened with the revoked session
+			h.hub.DisconnectSession(reused.SessionID, "refresh token reused")
+			writeErrorResponse(w, http.StatusUnauthorized, "REFRESH_TOKEN_REUSED", "Refresh token has already been used, please log in again")
+		case errors.Is(err, service.ErrInvalidRefreshToken):
+			writeErrorResponse(w, http.StatusUnauthorized, "INVALID_REFRESH_TOKEN", "Invalid or expired refresh token")
+		default:
+			writeErrorResponse(w, http.StatusInternalServerError, "REFRESH_FAILED", "Failed to refresh token")
+		}
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Token refreshed successfully", authResponse)
+}
+
+// Logout handles user logout by revoking the current session
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	// Get user from context (set by auth middleware)
 	claims, err := getUserFromContext(r.Context())
@@ -84,12 +463,34 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update user online status
-	err = h.userService.Logout(claims.UserID)
+	// Revoke the session's tokens and update user online status
+	err = h.userService.Logout(claims)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "LOGOUT_FAILED", "Failed to logout user")
 		return
 	}
 
+	// Close real-time connections opened with this session
+	h.hub.DisconnectSession(claims.SessionID, "logged out")
+
 	writeSuccessResponse(w, http.StatusOK, "Logout successful", nil)
 }
+
+// LogoutEverywhere revokes every session of the authenticated user
+func (h *AuthHandler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	err = h.userService.LogoutEverywhere(claims.UserID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "LOGOUT_FAILED", "Failed to logout user")
+		return
+	}
+
+	h.hub.DisconnectUserSessions(claims.UserID, "logged out everywhere")
+
+	writeSuccessResponse(w, http.StatusOK, "Logged out of all sessions", nil)
+}
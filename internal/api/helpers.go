@@ -4,10 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/auth"
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/gorilla/mux"
 )
 
 // writeSuccessResponse writes a successful JSON response
@@ -28,6 +36,32 @@ func writeErrorResponse(w http.ResponseWriter, statusCode int, code, message str
 	json.NewEncoder(w).Encode(response)
 }
 
+// writeThrottledResponse rejects a request that has to wait before trying
+// again, telling the client how long in the Retry-After header
+func writeThrottledResponse(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorResponse(w, http.StatusTooManyRequests, "TOO_MANY_ATTEMPTS",
+		fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds))
+}
+
+// clientIP returns the IP address of the client. The first X-Forwarded-For
+// entry is only used when trustProxy is set, clients can send any value.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // getUserFromContext extracts user claims from request context
 func getUserFromContext(ctx context.Context) (*auth.Claims, error) {
 	claims, ok := auth.GetUserFromContext(ctx)
@@ -40,22 +74,31 @@ func getUserFromContext(ctx context.Context) (*auth.Claims, error) {
 // enableCORS sets CORS headers for the response
 func enableCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+tusRequestHeaders)
+	w.Header().Set("Access-Control-Expose-Headers", tusResponseHeaders)
 }
 
 // corsMiddleware is a middleware that handles CORS
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		enableCORS(w, r)
-		if r.Method == "OPTIONS" {
+		if r.Method == "OPTIONS" && !handlesOptions(r) {
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// handlesOptions reports whether the route of a request answers OPTIONS
+// requests itself instead of leaving them to the CORS middleware
+func handlesOptions(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	methods, err := route.GetMethods()
+	return err == nil && slices.Contains(methods, http.MethodOptions)
+}
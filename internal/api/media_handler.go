@@ -1,25 +1,43 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/media"
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 type MediaHandler struct {
-	config *config.Config
+	attachmentService *service.AttachmentService
+	store             storage.BlobStore
+	partials          *storage.PartialStore
+	urlSigner         *storage.URLSigner
+	typeChecker       *media.TypeChecker
+	config            *config.Config
 }
 
-func NewMediaHandler(config *config.Config) *MediaHandler {
+func NewMediaHandler(attachmentService *service.AttachmentService, store storage.BlobStore, partials *storage.PartialStore, urlSigner *storage.URLSigner, typeChecker *media.TypeChecker, config *config.Config) *MediaHandler {
 	return &MediaHandler{
-		config: config,
+		attachmentService: attachmentService,
+		store:             store,
+		partials:          partials,
+		urlSigner:         urlSigner,
+		typeChecker:       typeChecker,
+		config:            config,
 	}
 }
 
@@ -54,95 +72,180 @@ func (h *MediaHandler) UploadMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate file type
-	allowedTypes := map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
-		".pdf":  true,
-		".doc":  true,
-		".docx": true,
-		".txt":  true,
-		".mp4":  true,
-		".avi":  true,
-		".mov":  true,
+	attachment, err := h.attachmentService.Upload(r.Context(), claims.UserID, header.Filename, file)
+	if err != nil {
+		h.writeUploadError(w, err)
+		return
 	}
 
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if !allowedTypes[ext] {
-		writeErrorResponse(w, http.StatusBadRequest, "INVALID_FILE_TYPE",
-			"File type not allowed. Allowed types: jpg, jpeg, png, gif, pdf, doc, docx, txt, mp4, avi, mov")
+	// Files that could not be scanned yet are accepted, but not usable
+	if attachment.Status == models.AttachmentPending {
+		writeSuccessResponse(w, http.StatusAccepted, "File uploaded, scan pending", h.attachmentService.UploadResponse(attachment))
 		return
 	}
 
-	// Generate unique filename
-	filename := fmt.Sprintf("%s_%s_%s",
-		claims.UserID.String(),
-		time.Now().Format("20060102_150405"),
-		header.Filename)
+	writeSuccessResponse(w, http.StatusOK, "File uploaded successfully", h.attachmentService.UploadResponse(attachment))
+}
 
-	// Create upload directory if it doesn't exist
-	uploadDir := h.config.Upload.Path
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to create upload directory")
+// GetAttachment describes an upload of the current user, so clients can
+// wait for a pending upload to be scanned
+func (h *MediaHandler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
 		return
 	}
 
-	// Create destination file
-	filePath := filepath.Join(uploadDir, filename)
-	dst, err := os.Create(filePath)
+	// Get attachment ID from URL
+	vars := mux.Vars(r)
+	attachmentID, err := uuid.Parse(vars["attachmentId"])
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to create destination file")
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_ATTACHMENT_ID", "Invalid attachment ID format")
 		return
 	}
-	defer dst.Close()
 
-	// Copy file content
-	_, err = io.Copy(dst, file)
+	attachment, err := h.attachmentService.Get(claims.UserID, attachmentID)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to save file")
+		writeErrorResponse(w, http.StatusNotFound, "ATTACHMENT_NOT_FOUND", "Attachment not found")
+		return
+	}
+	if attachment.Status == models.AttachmentInfected {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, "MALWARE_DETECTED", "File was rejected by the virus scanner")
 		return
 	}
 
-	// Determine file type
-	fileType := "file"
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".gif":
-		fileType = "image"
-	case ".mp4", ".avi", ".mov":
-		fileType = "video"
+	writeSuccessResponse(w, http.StatusOK, "Attachment retrieved successfully", h.attachmentService.UploadResponse(attachment))
+}
+
+// writeUploadError writes the response for an upload that could not be stored
+func (h *MediaHandler) writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrUploadUnreadable):
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_FORM", "Failed to read file")
+	case errors.Is(err, media.ErrTypeMismatch):
+		writeErrorResponse(w, http.StatusBadRequest, "FILE_TYPE_MISMATCH", "File content does not match its extension")
+	case errors.Is(err, media.ErrTypeNotAllowed):
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_FILE_TYPE",
+			"File type not allowed. Allowed types: "+strings.Join(h.typeChecker.Extensions(), ", "))
+	case errors.Is(err, media.ErrInvalidImage):
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_IMAGE", "Image could not be decoded")
+	case errors.Is(err, media.ErrImageTooLarge):
+		writeErrorResponse(w, http.StatusBadRequest, "IMAGE_TOO_LARGE", "Image dimensions are too large")
+	case errors.Is(err, service.ErrMalwareDetected):
+		writeErrorResponse(w, http.StatusUnprocessableEntity, "MALWARE_DETECTED", "File was rejected by the virus scanner")
+	case errors.Is(err, service.ErrQuotaExceeded):
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, "QUOTA_EXCEEDED", "File does not fit in your storage quota")
+	default:
+		log.Print(err)
+		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to save file")
+	}
+}
+
+// uploadRejected reports whether an upload failed because of its content,
+// rather than because it could not be stored
+func uploadRejected(err error) bool {
+	for _, rejection := range []error{
+		service.ErrUploadUnreadable,
+		media.ErrTypeMismatch,
+		media.ErrTypeNotAllowed,
+		media.ErrInvalidImage,
+		media.ErrImageTooLarge,
+		service.ErrMalwareDetected,
+		service.ErrQuotaExceeded,
+	} {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStorageUsage reports how much storage the uploads of the current user
+// take, and their quota
+func (h *MediaHandler) GetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
 	}
 
-	// Create response
-	response := models.UploadResponse{
-		Filename: filename,
-		URL:      fmt.Sprintf("/uploads/%s", filename),
-		Size:     header.Size,
-		Type:     fileType,
+	usage, err := h.attachmentService.Usage(claims.UserID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "STORAGE_USAGE_FAILED", "Failed to get storage usage")
+		return
 	}
 
-	writeSuccessResponse(w, http.StatusOK, "File uploaded successfully", response)
+	writeSuccessResponse(w, http.StatusOK, "Storage usage retrieved successfully", usage)
 }
 
-// ServeMedia serves uploaded media files
+// ServeMedia serves uploaded media files from the blob store. Only signed
+// URLs are served, which are handed out to the uploader and to the sender
+// and recipients of messages with the file.
 func (h *MediaHandler) ServeMedia(w http.ResponseWriter, r *http.Request) {
 	// Get filename from URL
-	filename := r.URL.Path[len("/uploads/"):]
+	filename := strings.TrimPrefix(r.URL.Path, storage.URLPrefix)
 	if filename == "" {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Construct file path
-	filePath := filepath.Join(h.config.Upload.Path, filename)
+	remaining, err := h.urlSigner.Verify(filename, r.URL.Query())
+	if err != nil {
+		if errors.Is(err, storage.ErrURLExpired) {
+			writeErrorResponse(w, http.StatusForbidden, "URL_EXPIRED", "Media URL has expired")
+			return
+		}
+		writeErrorResponse(w, http.StatusForbidden, "INVALID_SIGNATURE", "Media URL is not signed")
+		return
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	body, info, err := h.store.Get(r.Context(), filename)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrInvalidKey) {
+			log.Printf("Failed to open upload %s: %v", filename, err)
+			writeErrorResponse(w, http.StatusBadGateway, "STORAGE_UNAVAILABLE", "Failed to read file")
+			return
+		}
 		http.NotFound(w, r)
 		return
 	}
+	defer body.Close()
+
+	// Only media is displayed by browsers, anything else is downloaded
+	disposition := "attachment"
+	if fileType, ok := media.TypeOf(filename); ok {
+		w.Header().Set("Content-Type", fileType.ContentType)
+		if fileType.Inline() {
+			disposition = "inline"
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	name := r.URL.Query().Get("name") // Covered by the signature
+	if name == "" {
+		name = info.Filename
+	}
+	if name == "" {
+		name = path.Base(filename)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Browsers may reuse the file while the URL is valid, shared caches not
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(remaining.Seconds())))
+
+	// Seekable blobs support range requests and conditional requests
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, filename, info.ModTime, seeker)
+		return
+	}
 
-	// Serve file
-	http.ServeFile(w, r, filePath)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.Copy(w, body)
+	}
 }
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -54,6 +55,22 @@ func (h *MessageHandler) SendMessage(w http.ResponseWriter, r *http.Request) {
 	// Send message
 	message, err := h.messageService.SendMessage(claims.UserID, &req)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidMediaURL) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_MEDIA_URL", "Media URL must point at a file you uploaded")
+			return
+		}
+		if errors.Is(err, service.ErrAttachmentNotFound) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_ATTACHMENT", "Attachment not found")
+			return
+		}
+		if errors.Is(err, service.ErrAttachmentPending) {
+			writeErrorResponse(w, http.StatusConflict, "ATTACHMENT_PENDING", "Attachment is still being scanned")
+			return
+		}
+		if errors.Is(err, service.ErrMalwareDetected) {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, "MALWARE_DETECTED", "Attachment was rejected by the virus scanner")
+			return
+		}
 		writeErrorResponse(w, http.StatusInternalServerError, "SEND_FAILED", "Failed to send message")
 		return
 	}
@@ -95,6 +112,22 @@ func (h *MessageHandler) BroadcastMessage(w http.ResponseWriter, r *http.Request
 	// Send broadcast message
 	message, err := h.messageService.BroadcastMessage(claims.UserID, &req)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidMediaURL) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_MEDIA_URL", "Media URL must point at a file you uploaded")
+			return
+		}
+		if errors.Is(err, service.ErrAttachmentNotFound) {
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_ATTACHMENT", "Attachment not found")
+			return
+		}
+		if errors.Is(err, service.ErrAttachmentPending) {
+			writeErrorResponse(w, http.StatusConflict, "ATTACHMENT_PENDING", "Attachment is still being scanned")
+			return
+		}
+		if errors.Is(err, service.ErrMalwareDetected) {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, "MALWARE_DETECTED", "Attachment was rejected by the virus scanner")
+			return
+		}
 		writeErrorResponse(w, http.StatusInternalServerError, "BROADCAST_FAILED", "Failed to broadcast message")
 		return
 	}
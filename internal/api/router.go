@@ -1,41 +1,61 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/auth"
 	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/media"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
 	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
 	"github.com/aelhady03/twerlo-chat-app/internal/websocket"
 
 	"github.com/gorilla/mux"
 )
 
 type Router struct {
-	authHandler    *AuthHandler
-	messageHandler *MessageHandler
-	mediaHandler   *MediaHandler
-	userService    *service.UserService
-	jwtManager     *auth.JWTManager
-	hub            *websocket.Hub
-	config         *config.Config
+	authHandler      *AuthHandler
+	messageHandler   *MessageHandler
+	mediaHandler     *MediaHandler
+	adminHandler     *AdminHandler
+	twoFactorHandler *TwoFactorHandler
+	tokenHandler     *TokenHandler
+	userService      *service.UserService
+	tokenService     *service.APITokenService
+	jwtManager       *auth.JWTManager
+	hub              *websocket.Hub
+	config           *config.Config
 }
 
 func NewRouter(
 	userService *service.UserService,
 	messageService *service.MessageService,
+	attachmentService *service.AttachmentService,
+	tokenService *service.APITokenService,
 	jwtManager *auth.JWTManager,
+	oidcProvider *auth.OIDCProvider,
+	loginThrottle *auth.LoginThrottle,
 	hub *websocket.Hub,
+	blobStore storage.BlobStore,
+	partialStore *storage.PartialStore,
+	urlSigner *storage.URLSigner,
+	typeChecker *media.TypeChecker,
 	config *config.Config,
 ) *Router {
 	return &Router{
-		authHandler:    NewAuthHandler(userService),
-		messageHandler: NewMessageHandler(messageService, hub),
-		mediaHandler:   NewMediaHandler(config),
-		userService:    userService,
-		jwtManager:     jwtManager,
-		hub:            hub,
-		config:         config,
+		authHandler:      NewAuthHandler(userService, hub, oidcProvider, loginThrottle, config.Server.TrustProxyHeaders),
+		messageHandler:   NewMessageHandler(messageService, hub),
+		mediaHandler:     NewMediaHandler(attachmentService, blobStore, partialStore, urlSigner, typeChecker, config),
+		adminHandler:     NewAdminHandler(userService, attachmentService, hub, loginThrottle),
+		twoFactorHandler: NewTwoFactorHandler(userService),
+		tokenHandler:     NewTokenHandler(tokenService),
+		userService:      userService,
+		tokenService:     tokenService,
+		jwtManager:       jwtManager,
+		hub:              hub,
+		config:           config,
 	}
 }
 
@@ -45,34 +65,109 @@ func (r *Router) SetupRoutes() *mux.Router {
 	// Apply CORS middleware to all routes
 	router.Use(corsMiddleware)
 
+	// Public keys for verifying our tokens
+	router.HandleFunc("/.well-known/jwks.json", r.GetJWKS).Methods("GET")
+
 	// API routes
 	api := router.PathPrefix("/api").Subrouter()
 
 	// Public routes (no authentication required)
 	api.HandleFunc("/auth/register", r.authHandler.Register).Methods("POST")
 	api.HandleFunc("/auth/login", r.authHandler.Login).Methods("POST")
-
-	// Protected routes (authentication required)
+	api.HandleFunc("/auth/refresh", r.authHandler.Refresh).Methods("POST")
+	api.HandleFunc("/auth/2fa/verify", r.authHandler.VerifyTwoFactor).Methods("POST")
+	api.HandleFunc("/auth/verify-email", r.authHandler.VerifyEmail).Methods("POST")
+	api.HandleFunc("/auth/verify-email/resend", r.authHandler.ResendVerification).Methods("POST")
+	api.HandleFunc("/auth/password/forgot", r.authHandler.ForgotPassword).Methods("POST")
+	api.HandleFunc("/auth/password/reset", r.authHandler.ResetPassword).Methods("POST")
+	api.HandleFunc("/auth/oidc/login", r.authHandler.OIDCLogin).Methods("GET")
+	api.HandleFunc("/auth/oidc/callback", r.authHandler.OIDCCallback).Methods("POST")
+	api.HandleFunc("/media/uploads", r.mediaHandler.TusOptions).Methods("OPTIONS")
+	api.HandleFunc("/media/uploads/{uploadId}", r.mediaHandler.TusOptions).Methods("OPTIONS")
+
+	// Protected routes (authentication required), open to sessions and to
+	// personal access tokens with the required scope
 	protected := api.PathPrefix("").Subrouter()
-	protected.Use(auth.AuthMiddleware(r.jwtManager))
+	protected.Use(auth.AuthMiddleware(r.jwtManager, r.tokenService))
 
-	// Auth routes
-	protected.HandleFunc("/auth/logout", r.authHandler.Logout).Methods("POST")
+	// When two-factor authentication is required, sessions without it can
+	// only enroll, look up their account and log out
+	protected.Use(auth.RequireTwoFactor(r.config.TwoFactor.Required, "/api/users/me", "/api/auth/logout"))
 
 	// Message routes
-	protected.HandleFunc("/messages/send", r.messageHandler.SendMessage).Methods("POST")
-	protected.HandleFunc("/messages/broadcast", r.messageHandler.BroadcastMessage).Methods("POST")
-	protected.HandleFunc("/messages/history", r.messageHandler.GetChatHistory).Methods("GET")
-	protected.HandleFunc("/messages", r.messageHandler.GetUserMessages).Methods("GET")
-	protected.HandleFunc("/messages/{messageId}/status", r.messageHandler.UpdateDeliveryStatus).Methods("PUT")
+	protected.Handle("/messages/send", scoped(models.ScopeMessagesSend, r.messageHandler.SendMessage)).Methods("POST")
+	protected.Handle("/messages/broadcast", scoped(models.ScopeMessagesSend, r.messageHandler.BroadcastMessage)).Methods("POST")
+	protected.Handle("/messages/history", scoped(models.ScopeMessagesRead, r.messageHandler.GetChatHistory)).Methods("GET")
+	protected.Handle("/messages", scoped(models.ScopeMessagesRead, r.messageHandler.GetUserMessages)).Methods("GET")
+	protected.Handle("/messages/{messageId}/status", scoped(models.ScopeMessagesRead, r.messageHandler.UpdateDeliveryStatus)).Methods("PUT")
 
 	// Media routes
-	protected.HandleFunc("/media/upload", r.mediaHandler.UploadMedia).Methods("POST")
+	protected.Handle("/media/upload", scoped(models.ScopeMessagesSend, r.mediaHandler.UploadMedia)).Methods("POST")
+	protected.Handle("/media/attachments/{attachmentId}", scoped(models.ScopeMessagesSend, r.mediaHandler.GetAttachment)).Methods("GET")
+
+	// Resumable uploads (tus protocol)
+	protected.Handle("/media/uploads", scoped(models.ScopeMessagesSend, r.mediaHandler.CreateUpload)).Methods("POST")
+	protected.Handle("/media/uploads/{uploadId}", scoped(models.ScopeMessagesSend, r.mediaHandler.GetUploadOffset)).Methods("HEAD")
+	protected.Handle("/media/uploads/{uploadId}", scoped(models.ScopeMessagesSend, r.mediaHandler.GetUpload)).Methods("GET")
+	protected.Handle("/media/uploads/{uploadId}", scoped(models.ScopeMessagesSend, r.mediaHandler.PatchUpload)).Methods("PATCH")
+	protected.Handle("/media/uploads/{uploadId}", scoped(models.ScopeMessagesSend, r.mediaHandler.DeleteUpload)).Methods("DELETE")
 
 	// User routes
-	protected.HandleFunc("/users", r.GetUsers).Methods("GET")
+	protected.Handle("/users", scoped(models.ScopeUsersRead, r.GetUsers)).Methods("GET")
 	protected.HandleFunc("/users/me", r.GetCurrentUser).Methods("GET")
-	protected.HandleFunc("/users/online", r.GetOnlineUsers).Methods("GET")
+	protected.HandleFunc("/users/me/storage", r.mediaHandler.GetStorageUsage).Methods("GET")
+	protected.Handle("/users/online", scoped(models.ScopeUsersRead, r.GetOnlineUsers)).Methods("GET")
+
+	// Session routes, not open to personal access tokens
+	session := protected.PathPrefix("").Subrouter()
+	session.Use(auth.RejectAPITokens())
+
+	// Auth routes
+	session.HandleFunc("/auth/logout", r.authHandler.Logout).Methods("POST")
+	session.HandleFunc("/auth/logout/all", r.authHandler.LogoutEverywhere).Methods("POST")
+	session.HandleFunc("/users/me/password", r.authHandler.ChangePassword).Methods("PUT")
+
+	// Two-factor authentication routes
+	session.HandleFunc("/users/me/2fa", r.twoFactorHandler.GetStatus).Methods("GET")
+	session.HandleFunc("/users/me/2fa/setup", r.twoFactorHandler.Setup).Methods("POST")
+	session.HandleFunc("/users/me/2fa/confirm", r.twoFactorHandler.Confirm).Methods("POST")
+	session.HandleFunc("/users/me/2fa/recovery-codes", r.twoFactorHandler.RegenerateRecoveryCodes).Methods("POST")
+	session.HandleFunc("/users/me/2fa", r.twoFactorHandler.Disable).Methods("DELETE")
+
+	// Personal access token and bot routes
+	session.HandleFunc("/tokens", r.tokenHandler.ListTokens).Methods("GET")
+	session.HandleFunc("/tokens", r.tokenHandler.CreateToken).Methods("POST")
+	session.HandleFunc("/tokens/{tokenId}", r.tokenHandler.RevokeToken).Methods("DELETE")
+	session.HandleFunc("/bots", r.tokenHandler.ListBots).Methods("GET")
+	session.HandleFunc("/bots", r.tokenHandler.CreateBot).Methods("POST")
+
+	// WebSocket routes
+	session.HandleFunc("/ws/ticket", func(w http.ResponseWriter, req *http.Request) {
+		websocket.IssueTicket(r.hub, w, req)
+	}).Methods("POST")
+
+	// Fallback event transports for clients that cannot use WebSockets
+	session.HandleFunc("/events", func(w http.ResponseWriter, req *http.Request) {
+		websocket.ServeSSE(r.hub, w, req)
+	}).Methods("GET")
+	session.HandleFunc("/events/poll", func(w http.ResponseWriter, req *http.Request) {
+		websocket.ServeLongPoll(r.hub, w, req)
+	}).Methods("GET")
+
+	// Admin routes
+	admin := session.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.RequireRole(models.RoleAdmin))
+	admin.HandleFunc("/hub", r.adminHandler.GetHubStats).Methods("GET")
+	admin.HandleFunc("/hub/disconnect/{userId}", r.adminHandler.DisconnectUser).Methods("POST")
+	admin.HandleFunc("/ws/metrics", r.GetWebSocketMetrics).Methods("GET")
+	admin.HandleFunc("/users", r.adminHandler.ListUsers).Methods("GET")
+	admin.HandleFunc("/users/{userId}", r.adminHandler.GetUser).Methods("GET")
+	admin.HandleFunc("/users/{userId}/role", r.adminHandler.UpdateUserRole).Methods("PUT")
+	admin.HandleFunc("/users/{userId}/2fa", r.adminHandler.ResetTwoFactor).Methods("DELETE")
+	admin.HandleFunc("/users/{userId}/storage", r.adminHandler.GetUserStorage).Methods("GET")
+	admin.HandleFunc("/users/{userId}/storage", r.adminHandler.UpdateUserStorageQuota).Methods("PUT")
+	admin.HandleFunc("/storage", r.adminHandler.GetStorageReport).Methods("GET")
+	admin.HandleFunc("/login-attempts", r.adminHandler.GetFailedLogins).Methods("GET")
 
 	// WebSocket route
 	router.HandleFunc("/ws", func(w http.ResponseWriter, req *http.Request) {
@@ -81,7 +176,9 @@ func (r *Router) SetupRoutes() *mux.Router {
 
 	// Static files
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads/"))))
+
+	// Uploaded media, read from the blob store
+	router.PathPrefix("/uploads/").HandlerFunc(r.mediaHandler.ServeMedia).Methods("GET", "HEAD")
 
 	// Serve index.html for the root path
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -91,9 +188,15 @@ func (r *Router) SetupRoutes() *mux.Router {
 	return router
 }
 
-// GetUsers returns all users
+// scoped wraps a handler that personal access tokens can call with the
+// given scope
+func scoped(scope string, handler http.HandlerFunc) http.Handler {
+	return auth.RequireScope(scope)(handler)
+}
+
+// GetUsers returns all users, without their email addresses
 func (r *Router) GetUsers(w http.ResponseWriter, req *http.Request) {
-	users, err := r.userService.GetAllUsers()
+	users, err := r.userService.GetPublicUsers()
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "USERS_FAILED", "Failed to retrieve users")
 		return
@@ -124,3 +227,15 @@ func (r *Router) GetOnlineUsers(w http.ResponseWriter, req *http.Request) {
 	onlineUsers := r.hub.GetConnectedUsers()
 	writeSuccessResponse(w, http.StatusOK, "Online users retrieved successfully", onlineUsers)
 }
+
+// GetWebSocketMetrics returns outbound WebSocket traffic and compression metrics
+func (r *Router) GetWebSocketMetrics(w http.ResponseWriter, req *http.Request) {
+	writeSuccessResponse(w, http.StatusOK, "WebSocket metrics retrieved successfully", r.hub.Metrics())
+}
+
+// GetJWKS returns the JSON Web Key Set used to verify access tokens
+func (r *Router) GetJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(r.jwtManager.JWKS())
+}
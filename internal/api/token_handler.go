@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/service"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type TokenHandler struct {
+	tokenService *service.APITokenService
+}
+
+func NewTokenHandler(tokenService *service.APITokenService) *TokenHandler {
+	return &TokenHandler{
+		tokenService: tokenService,
+	}
+}
+
+// ListTokens returns the personal access tokens the current user created
+func (h *TokenHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	tokens, err := h.tokenService.GetTokens(claims.UserID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "FETCH_FAILED", "Failed to retrieve API tokens")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "API tokens retrieved successfully", tokens)
+}
+
+// CreateToken creates a personal access token for the current user or one
+// of their bots
+func (h *TokenHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || len(req.Scopes) == 0 {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Name and scopes are required")
+		return
+	}
+
+	if len(req.Name) > 100 || req.ExpiresInDays < 0 {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Name must be at most 100 characters and expiry cannot be negative")
+		return
+	}
+
+	created, err := h.tokenService.CreateToken(claims.UserID, &req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidScope):
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_SCOPE", "Scopes must be messages:send, messages:read or users:read")
+		case errors.Is(err, service.ErrInvalidRateLimit):
+			writeErrorResponse(w, http.StatusBadRequest, "INVALID_RATE_LIMIT", "Rate limit is out of the allowed range")
+		case errors.Is(err, service.ErrBotNotFound):
+			writeErrorResponse(w, http.StatusNotFound, "BOT_NOT_FOUND", "Bot not found")
+		default:
+			writeErrorResponse(w, http.StatusInternalServerError, "TOKEN_CREATION_FAILED", "Failed to create API token")
+		}
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusCreated, "API token created, store it safely as it will not be shown again", created)
+}
+
+// RevokeToken revokes a personal access token the current user created
+func (h *TokenHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	// Get token ID from URL
+	vars := mux.Vars(r)
+	tokenID, err := uuid.Parse(vars["tokenId"])
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_TOKEN_ID", "Invalid token ID format")
+		return
+	}
+
+	if err := h.tokenService.RevokeToken(claims.UserID, tokenID); err != nil {
+		if errors.Is(err, service.ErrAPITokenNotFound) {
+			writeErrorResponse(w, http.StatusNotFound, "TOKEN_NOT_FOUND", "API token not found or already revoked")
+			return
+		}
+		writeErrorResponse(w, http.StatusInternalServerError, "REVOKE_FAILED", "Failed to revoke API token")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "API token revoked successfully", nil)
+}
+
+// ListBots returns the bots the current user owns
+func (h *TokenHandler) ListBots(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	bots, err := h.tokenService.GetBots(claims.UserID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "FETCH_FAILED", "Failed to retrieve bots")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Bots retrieved successfully", bots)
+}
+
+// CreateBot creates a bot owned by the current user
+func (h *TokenHandler) CreateBot(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if len(req.Username) < 3 || len(req.Username) > 50 {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_USERNAME", "Username must be between 3 and 50 characters long")
+		return
+	}
+
+	bot, err := h.tokenService.CreateBot(claims.UserID, req.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrBotLimitReached):
+			writeErrorResponse(w, http.StatusConflict, "BOT_LIMIT_REACHED", "You already own the maximum number of bots")
+		case err.Error() == "username already exists":
+			writeErrorResponse(w, http.StatusConflict, "USER_EXISTS", err.Error())
+		default:
+			writeErrorResponse(w, http.StatusInternalServerError, "BOT_CREATION_FAILED", "Failed to create bot")
+		}
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusCreated, "Bot created successfully", bot)
+}
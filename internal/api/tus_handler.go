@@ -0,0 +1,413 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/service"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload),
+// with its creation, expiration and termination extensions
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	tusContentType = "application/offset+octet-stream"
+
+	// Headers that browsers must be allowed to send and read
+	tusRequestHeaders  = "Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset"
+	tusResponseHeaders = "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Length, Upload-Offset, Upload-Expires"
+)
+
+// uploadPath is where a resumable upload is sent
+func uploadPath(id string) string {
+	return "/api/media/uploads/" + id
+}
+
+// TusOptions describes the supported tus protocol
+func (h *MediaHandler) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.config.Upload.MaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload. The file name comes from the
+// filename (or name) entry of Upload-Metadata.
+func (h *MediaHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_UPLOAD_LENGTH", "Upload-Length must be a non-negative integer")
+		return
+	}
+	if length > h.config.Upload.MaxSize {
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE",
+			fmt.Sprintf("File size exceeds maximum allowed size of %d bytes", h.config.Upload.MaxSize))
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_UPLOAD_METADATA", "Upload-Metadata is malformed")
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FILE", "Upload-Metadata must include a filename")
+		return
+	}
+	if !h.typeChecker.Allows(filename) {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_FILE_TYPE",
+			"File type not allowed. Allowed types: "+strings.Join(h.typeChecker.Extensions(), ", "))
+		return
+	}
+
+	// The quota is checked again once the upload is complete. Until then,
+	// the uploads the user has in progress count against it as well.
+	upload, err := h.partials.Create(claims.UserID.String(), filename, length, func(pendingLength int64) error {
+		return h.attachmentService.CheckQuota(claims.UserID, pendingLength+length)
+	})
+	if errors.Is(err, service.ErrQuotaExceeded) {
+		h.writeUploadError(w, err)
+		return
+	}
+	if errors.Is(err, storage.ErrTooManyUploads) {
+		writeErrorResponse(w, http.StatusTooManyRequests, "TOO_MANY_UPLOADS",
+			fmt.Sprintf("At most %d uploads may be in progress at once", h.config.Upload.ResumableMaxPending))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create resumable upload: %v", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to create upload")
+		return
+	}
+
+	// Empty files are complete as soon as they are created
+	if length == 0 {
+		completed, err := h.partials.Complete(upload.ID, h.storeUpload(r, claims.UserID))
+		if err != nil {
+			h.writeAppendError(w, upload, err)
+			return
+		}
+		h.writeCompletedUpload(w, claims.UserID, completed)
+		return
+	}
+
+	w.Header().Set("Location", uploadPath(upload.ID))
+	setUploadHeaders(w, upload)
+	writeSuccessResponse(w, http.StatusCreated, "Upload created successfully", resumableUploadResponse(upload, nil))
+}
+
+// GetUploadOffset tells how much of a resumable upload was received, so the
+// client can resume from there
+func (h *MediaHandler) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetUpload describes a resumable upload, including the stored file once it
+// is complete. Uploads fully received but not stored, because storing them
+// failed or the server stopped meanwhile, are completed first.
+func (h *MediaHandler) GetUpload(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	upload, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if upload.Done() && upload.Result == "" {
+		completed, err := h.partials.Complete(upload.ID, h.storeUpload(r, claims.UserID))
+		if err != nil {
+			h.writeAppendError(w, upload, err)
+			return
+		}
+		upload = completed
+	}
+
+	stored, ok := h.storedUpload(w, claims.UserID, upload)
+	if !ok {
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	writeSuccessResponse(w, http.StatusOK, "Upload retrieved successfully", resumableUploadResponse(upload, stored))
+}
+
+// PatchUpload appends a chunk to a resumable upload. Once the last byte is
+// received, the file is checked and stored like any upload, and the response
+// carries the result. An empty chunk at the end of an upload that could not
+// be stored retries storing it.
+func (h *MediaHandler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		writeErrorResponse(w, http.StatusUnsupportedMediaType, "INVALID_CONTENT_TYPE", "Content-Type must be "+tusContentType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_UPLOAD_OFFSET", "Upload-Offset must be a non-negative integer")
+		return
+	}
+
+	upload, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE", "Chunk exceeds the length of the upload")
+		return
+	}
+
+	upload, err = h.partials.Append(upload.ID, offset, r.Body, h.storeUpload(r, claims.UserID))
+	if err != nil {
+		h.writeAppendError(w, upload, err)
+		return
+	}
+
+	if upload.Result != "" {
+		h.writeCompletedUpload(w, claims.UserID, upload)
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload abandons a resumable upload
+func (h *MediaHandler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.partials.Delete(upload.ID); err != nil {
+		if errors.Is(err, storage.ErrUploadLocked) {
+			writeErrorResponse(w, http.StatusLocked, "UPLOAD_LOCKED", "Upload is being written by another request")
+			return
+		}
+		log.Printf("Failed to delete resumable upload: %v", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "DELETE_FAILED", "Failed to delete upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeUpload returns the function storing a fully received upload as an
+// attachment of userID. The file is stored even if the client goes away
+// meanwhile, it can fetch the result later.
+func (h *MediaHandler) storeUpload(r *http.Request, userID uuid.UUID) storage.CompleteFunc {
+	ctx := context.WithoutCancel(r.Context())
+	return func(upload *storage.PartialUpload, data io.ReadSeeker) (string, error) {
+		attachment, err := h.attachmentService.Upload(ctx, userID, upload.Filename, data)
+		if err != nil {
+			return "", err
+		}
+		return attachment.ID.String(), nil
+	}
+}
+
+// writeCompletedUpload answers the request that completed an upload with
+// the stored file
+func (h *MediaHandler) writeCompletedUpload(w http.ResponseWriter, userID uuid.UUID, upload *storage.PartialUpload) {
+	stored, ok := h.storedUpload(w, userID, upload)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Location", uploadPath(upload.ID))
+	setUploadHeaders(w, upload)
+	writeSuccessResponse(w, http.StatusOK, "File uploaded successfully", resumableUploadResponse(upload, stored))
+}
+
+// storedUpload looks up the file a complete upload was stored as, nil for
+// uploads not complete. It reports false once it has written an error
+// response.
+func (h *MediaHandler) storedUpload(w http.ResponseWriter, userID uuid.UUID, upload *storage.PartialUpload) (*models.UploadResponse, bool) {
+	if upload.Result == "" {
+		return nil, true
+	}
+
+	attachmentID, err := uuid.Parse(upload.Result)
+	var attachment *models.Attachment
+	if err == nil {
+		attachment, err = h.attachmentService.Get(userID, attachmentID)
+	}
+	if err != nil {
+		writeErrorResponse(w, http.StatusNotFound, "UPLOAD_NOT_FOUND", "Uploaded file no longer exists")
+		return nil, false
+	}
+
+	if attachment.Status == models.AttachmentInfected {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, "MALWARE_DETECTED", "File was rejected by the virus scanner")
+		return nil, false
+	}
+
+	return h.attachmentService.UploadResponse(attachment), true
+}
+
+// writeAppendError answers a request that failed to write or complete an
+// upload. Files rejected when stored are discarded, as resending the same
+// data would fail again; otherwise what was received is kept, and the client
+// resumes from its offset, or retries storing it once all is received.
+func (h *MediaHandler) writeAppendError(w http.ResponseWriter, upload *storage.PartialUpload, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeErrorResponse(w, http.StatusNotFound, "UPLOAD_NOT_FOUND", "Upload not found")
+	case errors.Is(err, storage.ErrOffsetMismatch):
+		writeErrorResponse(w, http.StatusConflict, "OFFSET_MISMATCH", "Upload-Offset does not match the received data")
+	case errors.Is(err, storage.ErrUploadComplete):
+		writeErrorResponse(w, http.StatusConflict, "UPLOAD_COMPLETE", "Upload is already complete")
+	case errors.Is(err, storage.ErrUploadIncomplete):
+		writeErrorResponse(w, http.StatusConflict, "UPLOAD_INCOMPLETE", "Upload is not fully received")
+	case errors.Is(err, storage.ErrUploadLocked):
+		writeErrorResponse(w, http.StatusLocked, "UPLOAD_LOCKED", "Upload is being written by another request")
+	case errors.Is(err, storage.ErrNotStored) && uploadRejected(err):
+		h.partials.Delete(upload.ID)
+		h.writeUploadError(w, err)
+	case errors.Is(err, storage.ErrNotStored):
+		setUploadHeaders(w, upload)
+		h.writeUploadError(w, err)
+	default:
+		log.Printf("Failed to write resumable upload: %v", err)
+		if upload != nil {
+			setUploadHeaders(w, upload)
+		}
+		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to save upload")
+	}
+}
+
+// ownUpload looks up the resumable upload of the request, which must belong
+// to the current user. Uploads of others are reported as missing.
+func (h *MediaHandler) ownUpload(w http.ResponseWriter, r *http.Request) (*storage.PartialUpload, bool) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return nil, false
+	}
+
+	upload, err := h.partials.Get(mux.Vars(r)["uploadId"])
+	if err == nil && upload.Owner != claims.UserID.String() {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeErrorResponse(w, http.StatusNotFound, "UPLOAD_NOT_FOUND", "Upload not found")
+			return nil, false
+		}
+		log.Printf("Failed to read resumable upload: %v", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "UPLOAD_FAILED", "Failed to read upload")
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// checkTusVersion rejects requests of other tus protocol versions
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeErrorResponse(w, http.StatusPreconditionFailed, "UNSUPPORTED_VERSION", "Tus-Resumable must be "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// setUploadHeaders describes the state of an upload in tus headers
+func setUploadHeaders(w http.ResponseWriter, upload *storage.PartialUpload) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// keys, each followed by a space and its base64-encoded value, if any
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of metadata key %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+func resumableUploadResponse(upload *storage.PartialUpload, stored *models.UploadResponse) *models.ResumableUploadResponse {
+	return &models.ResumableUploadResponse{
+		ID:        upload.ID,
+		Length:    upload.Length,
+		Offset:    upload.Offset,
+		ExpiresAt: upload.ExpiresAt,
+		Upload:    stored,
+	}
+}
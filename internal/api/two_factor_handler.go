@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/service"
+)
+
+type TwoFactorHandler struct {
+	userService *service.UserService
+}
+
+func NewTwoFactorHandler(userService *service.UserService) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		userService: userService,
+	}
+}
+
+// GetStatus reports the current user's two-factor enrollment
+func (h *TwoFactorHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	status, err := h.userService.GetTwoFactorStatus(claims.UserID)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "TWO_FACTOR_FAILED", "Failed to get two-factor status")
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Two-factor status retrieved successfully", status)
+}
+
+// Setup generates a new TOTP secret for the current user
+func (h *TwoFactorHandler) Setup(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	setup, err := h.userService.SetupTwoFactor(claims.UserID)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Scan the provisioning URI with an authenticator app, then confirm with a code", setup)
+}
+
+// Confirm enables two-factor authentication with a code from the
+// authenticator app
+func (h *TwoFactorHandler) Confirm(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if !decodeCodeRequest(w, r, &req) {
+		return
+	}
+
+	confirmation, err := h.userService.ConfirmTwoFactor(claims.UserID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Two-factor authentication enabled, store the recovery codes safely", confirmation)
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if !decodeCodeRequest(w, r, &req) {
+		return
+	}
+
+	codes, err := h.userService.RegenerateRecoveryCodes(claims.UserID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Recovery codes regenerated successfully", models.RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+// Disable turns off two-factor authentication for the current user
+func (h *TwoFactorHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	claims, err := getUserFromContext(r.Context())
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if !decodeCodeRequest(w, r, &req) {
+		return
+	}
+
+	if err := h.userService.DisableTwoFactor(claims.UserID, req.Code); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	writeSuccessResponse(w, http.StatusOK, "Two-factor authentication disabled", nil)
+}
+
+// decodeCodeRequest decodes a request carrying a code and writes an error
+// response if it is missing
+func decodeCodeRequest(w http.ResponseWriter, r *http.Request, req *models.TwoFactorCodeRequest) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return false
+	}
+
+	if req.Code == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "MISSING_FIELDS", "Code is required")
+		return false
+	}
+
+	return true
+}
+
+// writeTwoFactorError maps two-factor service errors to responses
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidTwoFactorChallenge):
+		writeErrorResponse(w, http.StatusUnauthorized, "INVALID_CHALLENGE", "Login challenge is invalid or expired, please log in again")
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		writeErrorResponse(w, http.StatusUnauthorized, "INVALID_TWO_FACTOR_CODE", "Invalid two-factor code")
+	case errors.Is(err, service.ErrTwoFactorLocked):
+		writeErrorResponse(w, http.StatusTooManyRequests, "TWO_FACTOR_LOCKED", err.Error())
+	case errors.Is(err, service.ErrTwoFactorEnabled):
+		writeErrorResponse(w, http.StatusConflict, "TWO_FACTOR_ENABLED", err.Error())
+	case errors.Is(err, service.ErrTwoFactorNotEnabled):
+		writeErrorResponse(w, http.StatusConflict, "TWO_FACTOR_NOT_ENABLED", err.Error())
+	case errors.Is(err, service.ErrTwoFactorNotPending):
+		writeErrorResponse(w, http.StatusConflict, "TWO_FACTOR_NOT_PENDING", "Start the setup before confirming")
+	case errors.Is(err, service.ErrTwoFactorRequired):
+		writeErrorResponse(w, http.StatusForbidden, "TWO_FACTOR_REQUIRED", "Two-factor authentication is required and cannot be disabled")
+	default:
+		writeErrorResponse(w, http.StatusInternalServerError, "TWO_FACTOR_FAILED", "Two-factor operation failed")
+	}
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// APITokenPrefix starts every personal access token, which tells them apart
+// from JWTs and makes leaked tokens easy to scan for
+const APITokenPrefix = "twc_"
+
+// APITokenAuthenticator resolves personal access tokens
+type APITokenAuthenticator interface {
+	// AuthenticateAPIToken returns the claims of a valid personal access
+	// token, or a *RateLimitError when the token is used too often
+	AuthenticateAPIToken(token string) (*Claims, error)
+}
+
+// RateLimitError is returned when a client has to slow down
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// HasScope reports whether the claims grant a scope. Sessions are not
+// restricted; personal access tokens only have the scopes they were given.
+func (c *Claims) HasScope(scope string) bool {
+	return !c.APIToken || slices.Contains(c.Scopes, scope)
+}
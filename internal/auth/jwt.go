@@ -4,38 +4,90 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
 type Claims struct {
-	UserID   uuid.UUID `json:"user_id"`
-	Username string    `json:"username"`
-	Email    string    `json:"email"`
+	UserID    uuid.UUID   `json:"user_id"`
+	Username  string      `json:"username"`
+	Email     string      `json:"email"`
+	Role      models.Role `json:"role,omitempty"`
+	SessionID uuid.UUID   `json:"sid"`           // Shared by all tokens of one login
+	MFA       bool        `json:"mfa,omitempty"` // A second factor was verified at login
+
+	// Token generation of the user when issued. Tokens of older generations
+	// are revoked, which unlike issue times in whole seconds cannot catch
+	// tokens issued right after the revocation.
+	Generation int64 `json:"gen,omitempty"`
+
+	// Set for personal access tokens, which are not JWTs
+	APIToken bool     `json:"-"`
+	Scopes   []string `json:"-"`
+
+	jwt.RegisteredClaims
+}
+
+// Actions of single-purpose tokens, used as their audience. They are never
+// accepted as access tokens.
+const (
+	ActionTwoFactorChallenge = "2fa-challenge"
+	ActionVerifyEmail        = "verify-email"
+	ActionResetPassword      = "reset-password"
+)
+
+// ActionClaims are the claims of single-purpose tokens
+type ActionClaims struct {
+	Fingerprint string `json:"fp,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type JWTManager struct {
-	secretKey string
-	issuer    string
+	keys        *KeySet
+	issuer      string
+	tokenTTL    time.Duration
+	revocations RevocationStore
 }
 
-func NewJWTManager(secretKey, issuer string) *JWTManager {
+func NewJWTManager(keys *KeySet, issuer string, tokenTTL time.Duration, revocations RevocationStore) *JWTManager {
 	return &JWTManager{
-		secretKey: secretKey,
-		issuer:    issuer,
+		keys:        keys,
+		issuer:      issuer,
+		tokenTTL:    tokenTTL,
+		revocations: revocations,
 	}
 }
 
-// GenerateToken creates a new JWT token for a user
-func (j *JWTManager) GenerateToken(userID uuid.UUID, username, email string) (string, time.Time, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
+// TokenTTL returns the lifetime of the access tokens issued by the manager
+func (j *JWTManager) TokenTTL() time.Duration {
+	return j.tokenTTL
+}
+
+// GenerateToken creates a new short-lived JWT access token for a user session
+func (j *JWTManager) GenerateToken(userID uuid.UUID, username, email string, role models.Role, sessionID uuid.UUID, mfa bool) (string, time.Time, error) {
+	var generation int64
+	if j.revocations != nil {
+		var err error
+		generation, err = j.revocations.TokenGeneration(userID)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to get token generation: %w", err)
+		}
+	}
+
+	expirationTime := time.Now().Add(j.tokenTTL)
 
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
-		Email:    email,
+		UserID:     userID,
+		Username:   username,
+		Email:      email,
+		Role:       role,
+		SessionID:  sessionID,
+		MFA:        mfa,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -44,23 +96,88 @@ func (j *JWTManager) GenerateToken(userID uuid.UUID, username, email string) (st
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(j.secretKey))
+	tokenString, err := j.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return tokenString, expirationTime, nil
+}
+
+// GenerateActionToken creates a single-purpose token for the user. The
+// fingerprint binds it to the current state of the account, so that it stops
+// working once that state changes.
+func (j *JWTManager) GenerateActionToken(action string, userID uuid.UUID, fingerprint string, ttl time.Duration) (string, time.Time, error) {
+	expirationTime := time.Now().Add(ttl)
+
+	claims := &ActionClaims{
+		Fingerprint: fingerprint,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    j.issuer,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{action},
+		},
+	}
+
+	tokenString, err := j.sign(claims)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+		return "", time.Time{}, err
 	}
 
 	return tokenString, expirationTime, nil
 }
 
+// ValidateActionToken validates a single-purpose token for the given action
+// and returns the user and fingerprint it was issued for
+func (j *JWTManager) ValidateActionToken(tokenString, action string) (uuid.UUID, string, error) {
+	claims := &ActionClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		k, err := j.keys.keyFor(token)
+		if err != nil {
+			return nil, err
+		}
+		return k.verify, nil
+	}, jwt.WithAudience(action), jwt.WithIssuer(j.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid %s token: %w", action, err)
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid %s token subject: %w", action, err)
+	}
+
+	return userID, claims.Fingerprint, nil
+}
+
+// sign signs claims with the current signing key
+func (j *JWTManager) sign(claims jwt.Claims) (string, error) {
+	signing := j.keys.signing
+	token := jwt.NewWithClaims(signing.method, claims)
+	if signing.id != "" {
+		token.Header["kid"] = signing.id
+	}
+
+	tokenString, err := token.SignedString(signing.sign)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return tokenString, nil
+}
+
 // ValidateToken validates a JWT token and returns the claims
 func (j *JWTManager) ValidateToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		// Look up the key by ID and validate the signing method
+		k, err := j.keys.keyFor(token)
+		if err != nil {
+			return nil, err
 		}
-		return []byte(j.secretKey), nil
+		return k.verify, nil
 	})
 
 	if err != nil {
@@ -72,21 +189,41 @@ func (j *JWTManager) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	// Access tokens carry no audience, anything else is a different kind of token
+	if len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("invalid token")
+	}
+
 	// Check if token is expired
 	if claims.ExpiresAt != nil && claims.ExpiresAt.Time.Before(time.Now()) {
 		return nil, fmt.Errorf("token has expired")
 	}
 
+	if err := j.CheckRevoked(claims); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
-// RefreshToken generates a new token with extended expiration
-func (j *JWTManager) RefreshToken(tokenString string) (string, time.Time, error) {
-	claims, err := j.ValidateToken(tokenString)
+// JWKS returns the public keys tokens can be verified with
+func (j *JWTManager) JWKS() JWKS {
+	return j.keys.JWKS()
+}
+
+// CheckRevoked returns an error if the token described by claims has been revoked
+func (j *JWTManager) CheckRevoked(claims *Claims) error {
+	if j.revocations == nil {
+		return nil
+	}
+
+	revoked, err := j.revocations.IsRevoked(claims)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("invalid token for refresh: %w", err)
+		return fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	if revoked {
+		return fmt.Errorf("token has been revoked")
 	}
 
-	// Generate new token with same user info but extended expiration
-	return j.GenerateToken(claims.UserID, claims.Username, claims.Email)
+	return nil
 }
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// key is a JWT signing or verification key
+type key struct {
+	id     string
+	method jwt.SigningMethod
+	sign   interface{} // Private key or HMAC secret, nil for verification-only keys
+	verify interface{} // Public key or HMAC secret
+}
+
+// KeySet holds the key used to sign new tokens and every key that tokens
+// are still accepted from. Keeping the previous keys in the set lets tokens
+// signed before a rotation stay valid until they expire.
+type KeySet struct {
+	signing      *key
+	verification map[string]*key
+}
+
+// JWK represents a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS represents a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewHMACKeySet creates a key set that signs and verifies with a shared secret
+func NewHMACKeySet(secret string) *KeySet {
+	k := &key{
+		method: jwt.SigningMethodHS256,
+		sign:   []byte(secret),
+		verify: []byte(secret),
+	}
+
+	return &KeySet{
+		signing:      k,
+		verification: map[string]*key{"": k},
+	}
+}
+
+// LoadKeySet loads an asymmetric key set. signingKeyFile holds the PEM
+// private key used for new tokens; verificationKeyFiles hold PEM public (or
+// private) keys of previous rotations that are still accepted. RSA keys sign
+// with RS256, Ed25519 keys with EdDSA. Key IDs are the RFC 7638 thumbprints.
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	signing, err := loadPrivateKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &KeySet{
+		signing:      signing,
+		verification: map[string]*key{signing.id: signing},
+	}
+
+	for _, file := range verificationKeyFiles {
+		k, err := loadPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		set.verification[k.id] = k
+	}
+
+	return set, nil
+}
+
+// keyFor returns the verification key for a token
+func (s *KeySet) keyFor(token *jwt.Token) (*key, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k, exists := s.verification[kid]
+	if !exists {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	// Reject tokens whose algorithm does not match the key, which would
+	// otherwise allow algorithm confusion attacks
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return k, nil
+}
+
+// JWKS returns the public keys of the set. HMAC keys are never published.
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	// Signing key first, then the rest in no particular order
+	if jwk, ok := toJWK(s.signing); ok {
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	for _, k := range s.verification {
+		if k == s.signing {
+			continue
+		}
+		if jwk, ok := toJWK(k); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	return jwks
+}
+
+// toJWK converts a key to its public JWK representation
+func toJWK(k *key) (JWK, bool) {
+	switch pub := k.verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.id,
+			Use: "sig",
+			Alg: k.method.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: k.id,
+			Use: "sig",
+			Alg: k.method.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}, true
+	default:
+		return JWK{}, false
+	}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint used as the key ID
+func thumbprint(pub crypto.PublicKey) (string, error) {
+	var members interface{}
+
+	// The required members in lexicographic order
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		}
+	case ed25519.PublicKey:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{
+			Crv: "Ed25519",
+			Kty: "OKP",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// newAsymmetricKey builds a key from a public key and an optional private key
+func newAsymmetricKey(pub crypto.PublicKey, priv crypto.Signer) (*key, error) {
+	var method jwt.SigningMethod
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", pub)
+	}
+
+	id, err := thumbprint(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &key{id: id, method: method, verify: pub}
+	if priv != nil {
+		k.sign = priv
+	}
+	return k, nil
+}
+
+// loadPrivateKey reads a PKCS#8 or PKCS#1 PEM private key
+func loadPrivateKey(file string) (*key, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", file, err)
+	}
+
+	return newAsymmetricKey(priv.Public(), priv)
+}
+
+// loadPublicKey reads a PEM public key. Private keys are accepted too, only
+// their public half is kept.
+func loadPublicKey(file string) (*key, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		var priv crypto.Signer
+		priv, err = parsePrivateKey(block)
+		if err == nil {
+			pub = priv.Public()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", file, err)
+	}
+
+	return newAsymmetricKey(pub, nil)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", priv)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+
+	return block, nil
+}
@@ -3,8 +3,11 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
@@ -14,8 +17,9 @@ type contextKey string
 
 const UserContextKey contextKey = "user"
 
-// AuthMiddleware creates a middleware that validates JWT tokens
-func AuthMiddleware(jwtManager *JWTManager) func(http.Handler) http.Handler {
+// AuthMiddleware creates a middleware that validates JWT tokens and
+// personal access tokens
+func AuthMiddleware(jwtManager *JWTManager, apiTokens APITokenAuthenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Get token from Authorization header
@@ -38,9 +42,21 @@ func AuthMiddleware(jwtManager *JWTManager) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Validate token
-			claims, err := jwtManager.ValidateToken(tokenString)
+			// Personal access tokens are opaque, anything else must be a JWT
+			var claims *Claims
+			var err error
+			if strings.HasPrefix(tokenString, APITokenPrefix) {
+				claims, err = apiTokens.AuthenticateAPIToken(tokenString)
+			} else {
+				claims, err = jwtManager.ValidateToken(tokenString)
+			}
 			if err != nil {
+				var rateLimited *RateLimitError
+				if errors.As(err, &rateLimited) {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+					writeErrorResponse(w, http.StatusTooManyRequests, "RATE_LIMITED", err.Error())
+					return
+				}
 				writeErrorResponse(w, http.StatusUnauthorized, "INVALID_TOKEN", err.Error())
 				return
 			}
@@ -71,6 +87,105 @@ func OptionalAuthMiddleware(jwtManager *JWTManager) func(http.Handler) http.Hand
 	}
 }
 
+// RequireRole creates a middleware that only lets users with at least the
+// given role through. It must run after AuthMiddleware.
+func RequireRole(minimum models.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetUserFromContext(r.Context())
+			if !ok {
+				writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+				return
+			}
+
+			if !claims.Role.AtLeast(minimum) {
+				writeErrorResponse(w, http.StatusForbidden, "FORBIDDEN", fmt.Sprintf("The %s role is required", minimum))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope creates a middleware that only lets personal access tokens
+// with the given scope through. Sessions are not restricted.
+// It must run after AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetUserFromContext(r.Context())
+			if !ok {
+				writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+				return
+			}
+
+			if !claims.HasScope(scope) {
+				writeErrorResponse(w, http.StatusForbidden, "INSUFFICIENT_SCOPE", fmt.Sprintf("The %s scope is required", scope))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectAPITokens creates a middleware for routes that need a login
+// session, such as account management, and rejects personal access tokens.
+// It must run after AuthMiddleware.
+func RejectAPITokens() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetUserFromContext(r.Context())
+			if !ok {
+				writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+				return
+			}
+
+			if claims.APIToken {
+				writeErrorResponse(w, http.StatusForbidden, "API_TOKEN_NOT_ALLOWED", "This endpoint cannot be used with an API token")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireTwoFactor creates a middleware that, when two-factor authentication
+// is required, rejects sessions that did not pass a second factor. Requests
+// to the exempt path prefixes still go through so users can enroll.
+// It must run after AuthMiddleware.
+func RequireTwoFactor(required bool, exemptPrefixes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !required {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetUserFromContext(r.Context())
+			if !ok {
+				writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+				return
+			}
+
+			if !claims.MFA {
+				for _, prefix := range exemptPrefixes {
+					if strings.HasPrefix(r.URL.Path, prefix) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+
+				writeErrorResponse(w, http.StatusForbidden, "TWO_FACTOR_SETUP_REQUIRED", "Two-factor authentication must be enabled to continue")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // GetUserFromContext extracts user claims from request context
 func GetUserFromContext(ctx context.Context) (*Claims, bool) {
 	claims, ok := ctx.Value(UserContextKey).(*Claims)
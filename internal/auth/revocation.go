@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevocationStore records revoked access tokens so they stop being accepted
+// before they expire
+type RevocationStore interface {
+	// Revoke revokes a token or session ID until the given time
+	Revoke(userID uuid.UUID, id string, expiresAt time.Time) error
+
+	// RevokeAllForUser revokes every token issued to a user so far, by
+	// starting a new token generation
+	RevokeAllForUser(userID uuid.UUID) error
+
+	// TokenGeneration returns the current token generation of a user, which
+	// new tokens carry
+	TokenGeneration(userID uuid.UUID) (int64, error)
+
+	// IsRevoked reports whether the token described by claims has been revoked
+	IsRevoked(claims *Claims) (bool, error)
+}
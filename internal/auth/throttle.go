@@ -0,0 +1,388 @@
+package auth
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Number of failed attempts the in-memory store keeps for auditing
+const memoryAuditSize = 1000
+
+// AttemptTimeout is how long an attempt counts as in flight. Older ones are
+// taken as abandoned, as by a server that stopped while checking a password.
+const AttemptTimeout = time.Minute
+
+// AttemptState is the failure history of a throttled IP address or account
+type AttemptState struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	Pending     int       // Attempts in flight, whose outcome is not known yet
+	PendingAt   time.Time // When the latest of them started
+}
+
+// AttemptLimits is how the failures of a key are throttled
+type AttemptLimits struct {
+	MaxFailures int           // Failures that lock the key
+	Lockout     time.Duration // How long a key stays locked
+	BackoffBase time.Duration // Delay after the first failure, doubled after each one
+	BackoffMax  time.Duration
+	Window      time.Duration // Failures further apart start a new count
+}
+
+// Delay returns how long a key has to wait at the given time because of its
+// failures
+func (l *AttemptLimits) Delay(state AttemptState, now time.Time) time.Duration {
+	if now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now)
+	}
+	if l.failures(state, now) == 0 {
+		return 0
+	}
+
+	backoff := l.BackoffBase
+	for i := 1; i < state.Failures && backoff < l.BackoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, l.BackoffMax)
+
+	return max(0, state.LastFailure.Add(backoff).Sub(now))
+}
+
+// Wait returns how long a key has to wait before starting an attempt: its
+// delay, or a second while it has as many attempts in flight as failures
+// left before it is locked (one once the lock is over), so concurrent
+// attempts cannot get past MaxFailures
+func (l *AttemptLimits) Wait(state AttemptState, now time.Time) time.Duration {
+	if delay := l.Delay(state, now); delay > 0 {
+		return delay
+	}
+	if state.InFlight(now) >= max(l.MaxFailures-l.failures(state, now), 1) {
+		return time.Second
+	}
+	return 0
+}
+
+// failures returns the failures of a key that still count
+func (l *AttemptLimits) failures(state AttemptState, now time.Time) int {
+	if now.Sub(state.LastFailure) > l.Window {
+		return 0
+	}
+	return state.Failures
+}
+
+// InFlight returns the attempts still in flight at the given time
+func (s AttemptState) InFlight(now time.Time) int {
+	if now.Sub(s.PendingAt) > AttemptTimeout {
+		return 0
+	}
+	return s.Pending
+}
+
+// AttemptStore keeps failed login attempts for LoginThrottle
+type AttemptStore interface {
+	// Claim counts an attempt of a key as in flight, unless the key has to
+	// wait (see AttemptLimits.Wait). Checking and counting are a single
+	// operation, so concurrent attempts cannot all pass the check. It
+	// returns the state of the key and whether the attempt was counted.
+	Claim(key string, at time.Time, limits *AttemptLimits) (AttemptState, bool, error)
+
+	// RecordFailure ends an attempt counted by Claim as a failure. Failures
+	// further apart than the window start a new count, and reaching
+	// MaxFailures locks the key.
+	RecordFailure(key string, at time.Time, limits *AttemptLimits) (AttemptState, error)
+
+	// Refund ends an attempt counted by Claim that did not fail
+	Refund(key string) error
+
+	// Reset forgets the failures of a key
+	Reset(key string) error
+
+	// Audit records a failed attempt
+	Audit(attempt *models.FailedLoginAttempt) error
+
+	// RecentFailures returns the latest audited attempts, newest first
+	RecentFailures(limit int) ([]models.FailedLoginAttempt, error)
+}
+
+// LoginThrottle slows down password guessing. Every failure doubles the
+// delay before the next attempt from the same IP address or for the same
+// account, and too many failures lock them out for a while.
+type LoginThrottle struct {
+	store         AttemptStore
+	ipLimits      AttemptLimits
+	accountLimits AttemptLimits
+}
+
+func NewLoginThrottle(store AttemptStore, policy *config.LoginThrottleConfig) *LoginThrottle {
+	limits := func(maxFailures int) AttemptLimits {
+		return AttemptLimits{
+			MaxFailures: maxFailures,
+			Lockout:     policy.LockoutDuration,
+			BackoffBase: policy.BackoffBase,
+			BackoffMax:  policy.BackoffMax,
+			Window:      policy.FailureWindow,
+		}
+	}
+
+	return &LoginThrottle{
+		store:         store,
+		ipLimits:      limits(policy.MaxIPFailures),
+		accountLimits: limits(policy.MaxAccountFailures),
+	}
+}
+
+// throttleKey is a store key and how it is throttled
+type throttleKey struct {
+	key    string
+	limits *AttemptLimits
+}
+
+// LoginAttempt is an attempt let through by LoginThrottle. It counts as in
+// flight until Failure, Success or Cancel is called.
+type LoginAttempt struct {
+	throttle *LoginThrottle
+	account  string
+	claimed  []throttleKey
+}
+
+// Begin starts an attempt from an IP address and, unless it is empty, for
+// an account. When either has to wait, no attempt is started and Begin
+// returns how long the client has to wait before trying again.
+func (t *LoginThrottle) Begin(ip, account string) (*LoginAttempt, time.Duration) {
+	now := time.Now()
+	attempt := &LoginAttempt{throttle: t, account: account}
+
+	var wait time.Duration
+	for _, k := range t.keys(ip, account) {
+		state, claimed, err := t.store.Claim(k.key, now, k.limits)
+		if err != nil {
+			// Failing open keeps logins working while the store is down
+			log.Printf("Failed to check login attempts for %s: %v", k.key, err)
+			continue
+		}
+		if !claimed {
+			wait = max(wait, k.limits.Wait(state, now), time.Second)
+			continue
+		}
+		attempt.claimed = append(attempt.claimed, k)
+	}
+
+	if wait > 0 {
+		attempt.Cancel()
+		return nil, wait
+	}
+
+	return attempt, 0
+}
+
+// Failure counts the attempt as a failure and adds it to the audit log
+func (a *LoginAttempt) Failure(record *models.FailedLoginAttempt) {
+	now := time.Now()
+
+	for _, k := range a.claimed {
+		state, err := a.throttle.store.RecordFailure(k.key, now, k.limits)
+		if err != nil {
+			log.Printf("Failed to record login failure for %s: %v", k.key, err)
+			continue
+		}
+		if state.Failures >= k.limits.MaxFailures {
+			log.Printf("Locked %s for %s after %d failed attempts", k.key, k.limits.Lockout, state.Failures)
+		}
+	}
+	a.claimed = nil
+
+	record.ID = uuid.New()
+	record.CreatedAt = now
+	if err := a.throttle.store.Audit(record); err != nil {
+		log.Printf("Failed to audit %s attempt for %q: %v", record.Action, record.Identifier, err)
+	}
+}
+
+// Success forgets the failures of the account after a correct password.
+// The IP address only ends this attempt, an attacker could otherwise clear
+// its failures by logging into an account of their own.
+func (a *LoginAttempt) Success() {
+	if a.account == "" {
+		a.Cancel()
+		return
+	}
+
+	key := accountKey(a.account)
+	for _, k := range a.claimed {
+		if k.key != key {
+			a.throttle.refund(k)
+		}
+	}
+	a.claimed = nil
+
+	if err := a.throttle.store.Reset(key); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", key, err)
+	}
+}
+
+// Cancel ends an attempt that neither failed nor succeeded, such as one
+// that could not be processed
+func (a *LoginAttempt) Cancel() {
+	for _, k := range a.claimed {
+		a.throttle.refund(k)
+	}
+	a.claimed = nil
+}
+
+// refund ends an attempt of a key without a failure
+func (t *LoginThrottle) refund(k throttleKey) {
+	if err := t.store.Refund(k.key); err != nil {
+		log.Printf("Failed to end login attempt for %s: %v", k.key, err)
+	}
+}
+
+// RecentFailures returns the latest failed attempts, newest first
+func (t *LoginThrottle) RecentFailures(limit int) ([]models.FailedLoginAttempt, error) {
+	return t.store.RecentFailures(limit)
+}
+
+// keys returns the keys an attempt is throttled by
+func (t *LoginThrottle) keys(ip, account string) []throttleKey {
+	keys := []throttleKey{{key: "ip:" + ip, limits: &t.ipLimits}}
+	if account != "" {
+		keys = append(keys, throttleKey{key: accountKey(account), limits: &t.accountLimits})
+	}
+	return keys
+}
+
+// accountKey normalizes an email address into a store key
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// MemoryAttemptStore is an AttemptStore for a single server instance. Its
+// state is lost on restart.
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	states    map[string]AttemptState
+	audit     []models.FailedLoginAttempt // Ring buffer of the latest attempts
+	next      int
+	lastSweep time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		states: make(map[string]AttemptState),
+	}
+}
+
+var _ AttemptStore = (*MemoryAttemptStore)(nil)
+
+// Claim checks and counts an attempt of a key under the store's lock
+func (s *MemoryAttemptStore) Claim(key string, at time.Time, limits *AttemptLimits) (AttemptState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget keys whose failures are over, at most once per window
+	if at.Sub(s.lastSweep) > limits.Window {
+		for k, state := range s.states {
+			if at.Sub(state.LastFailure) > limits.Window && at.After(state.LockedUntil) && state.InFlight(at) == 0 {
+				delete(s.states, k)
+			}
+		}
+		s.lastSweep = at
+	}
+
+	state := s.states[key]
+	if limits.Wait(state, at) > 0 {
+		return state, false, nil
+	}
+
+	state.Pending = state.InFlight(at) + 1
+	state.PendingAt = at
+	s.states[key] = state
+
+	return state, true, nil
+}
+
+// RecordFailure ends an attempt of a key as a failure
+func (s *MemoryAttemptStore) RecordFailure(key string, at time.Time, limits *AttemptLimits) (AttemptState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.states[key]
+	if at.Sub(state.LastFailure) > limits.Window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailure = at
+	if state.Failures >= limits.MaxFailures {
+		state.LockedUntil = at.Add(limits.Lockout)
+	}
+	state.Pending = max(state.Pending-1, 0)
+	s.states[key] = state
+
+	return state, nil
+}
+
+// Refund ends an attempt of a key without a failure
+func (s *MemoryAttemptStore) Refund(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		return nil
+	}
+
+	state.Pending = max(state.Pending-1, 0)
+	if state.Pending == 0 && state.Failures == 0 {
+		delete(s.states, key)
+		return nil
+	}
+	s.states[key] = state
+
+	return nil
+}
+
+// Reset forgets the failures of a key
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, key)
+	return nil
+}
+
+// Audit keeps a failed attempt, replacing the oldest once full, and logs it
+func (s *MemoryAttemptStore) Audit(attempt *models.FailedLoginAttempt) error {
+	log.Printf("Failed %s for %q from %s: %s", attempt.Action, attempt.Identifier, attempt.IPAddress, attempt.Reason)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.audit) < memoryAuditSize {
+		s.audit = append(s.audit, *attempt)
+	} else {
+		s.audit[s.next] = *attempt
+	}
+	s.next = (s.next + 1) % memoryAuditSize
+
+	return nil
+}
+
+// RecentFailures returns the latest audited attempts, newest first
+func (s *MemoryAttemptStore) RecentFailures(limit int) ([]models.FailedLoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := make([]models.FailedLoginAttempt, 0, min(limit, len(s.audit)))
+	for i := 1; i <= len(s.audit) && len(attempts) < limit; i++ {
+		attempts = append(attempts, s.audit[(s.next-i+len(s.audit))%len(s.audit)])
+	}
+
+	return attempts, nil
+}
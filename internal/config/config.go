@@ -1,19 +1,30 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Database DatabaseConfig
-	Server   ServerConfig
-	JWT      JWTConfig
-	Upload   UploadConfig
-	CORS     CORSConfig
+	Database  DatabaseConfig
+	Server    ServerConfig
+	JWT       JWTConfig
+	OIDC      OIDCConfig
+	TwoFactor TwoFactorConfig
+	Mail      MailConfig
+	Account   AccountConfig
+	Password  PasswordConfig
+	Login     LoginThrottleConfig
+	APITokens APITokenConfig
+	Upload    UploadConfig
+	CORS      CORSConfig
+	WebSocket WebSocketConfig
+	Admin     AdminConfig
 }
 
 type DatabaseConfig struct {
@@ -26,23 +37,156 @@ type DatabaseConfig struct {
 }
 
 type ServerConfig struct {
-	Port string
-	Host string
+	Port        string
+	Host        string
+	Environment string
+	BaseURL     string // Public URL of the web interface, used in email links
+
+	// Take client IP addresses from X-Forwarded-For, only safe behind a
+	// reverse proxy that sets it
+	TrustProxyHeaders bool
 }
 
 type JWTConfig struct {
-	Secret string
+	Secret               string
+	SigningKeyFile       string   // PEM private key, enables RS256/EdDSA instead of HS256
+	VerificationKeyFiles []string // PEM public keys of previous rotations
+	AccessTokenTTL       time.Duration
+	RefreshTokenTTL      time.Duration
+}
+
+// Default JWT secret, only acceptable in development
+const defaultJWTSecret = "default-secret-change-in-production"
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type TwoFactorConfig struct {
+	Issuer       string        // Account issuer shown in authenticator apps
+	Required     bool          // Every user must enroll before using the API
+	ChallengeTTL time.Duration // Time to enter the code after the password
+}
+
+type MailConfig struct {
+	Driver       string // smtp, file or log
+	From         string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	Dir          string // Output directory of the file driver
+}
+
+type AccountConfig struct {
+	RequireEmailVerification bool
+	EmailVerificationTTL     time.Duration
+	PasswordResetTTL         time.Duration
+}
+
+type PasswordConfig struct {
+	MinLength         int
+	RequireUppercase  bool
+	RequireLowercase  bool
+	RequireDigit      bool
+	RequireSymbol     bool
+	BreachedListFile  string // One password or SHA-1 hash per line, empty disables the check
+	HashAlgorithm     string // bcrypt or argon2id
+	BcryptCost        int
+	Argon2Time        int // Iterations
+	Argon2Memory      int // KiB
+	Argon2Parallelism int
+}
+
+type LoginThrottleConfig struct {
+	Store              string        // memory or postgres
+	MaxAccountFailures int           // Failures before an account is locked
+	MaxIPFailures      int           // Failures before an IP address is locked
+	BackoffBase        time.Duration // Delay after the first failure, doubled after each one
+	BackoffMax         time.Duration
+	LockoutDuration    time.Duration
+	FailureWindow      time.Duration // Failures older than this are forgotten
+}
+
+type APITokenConfig struct {
+	DefaultRateLimit int // Requests per minute of tokens created without a limit
+	MaxRateLimit     int // Highest limit a token can be given
+	MaxBotsPerUser   int
 }
 
 type UploadConfig struct {
 	MaxSize int64
-	Path    string
+	Path    string // Directory of the local storage driver
+	Driver  string // local or s3
+	S3      S3Config
+	Scan    ScanConfig
+
+	AllowedTypes []string // Extensions accepted for upload
+
+	ResumablePath string        // Directory of resumable uploads in progress
+	ResumableTTL  time.Duration // Time to finish a resumable upload
+
+	ResumableMaxPending int // Resumable uploads each user may have in progress
+
+	OrphanGrace time.Duration // Uploads not sent in a message by then are deleted
+
+	// Bytes of uploads each user of a role may store, 0 for unlimited.
+	// Administrators can give single users another quota.
+	RoleQuotas map[string]int64
+
+	ThumbnailSize  int // Longest side of image thumbnails in pixels
+	MediumSize     int // Longest side of medium image variants in pixels
+	MaxImagePixels int // Larger images are rejected instead of decoded
+
+	KeepImageMetadata bool // Keep EXIF data such as GPS coordinates in uploaded images
+
+	URLSecret string        // Key of media URL signatures
+	URLTTL    time.Duration // Lifetime of signed media URLs
+}
+
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.eu-west-1.amazonaws.com or http://127.0.0.1:9100
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // Bucket in the path instead of the host name, as MinIO expects
+}
+
+type ScanConfig struct {
+	Driver        string        // clamd or none
+	ClamdAddress  string        // host:port of clamd's TCP socket
+	Timeout       time.Duration // Longest a single scan may take
+	RetryInterval time.Duration // How often uploads left pending are scanned again
 }
 
 type CORSConfig struct {
 	AllowedOrigins []string
 }
 
+type AdminConfig struct {
+	Emails []string // Existing accounts promoted to admin at startup
+}
+
+type WebSocketConfig struct {
+	EnableCompression    bool
+	CompressionLevel     int
+	CompressionThreshold int
+	MaxMessageSize       int64
+	WriteWait            time.Duration
+	PongWait             time.Duration
+	PingPeriod           time.Duration
+	MessageRateLimit     float64 // Inbound messages per second, 0 disables limiting
+	MessageBurst         int
+	MaxRateViolations    int
+	TicketTTL            time.Duration
+	AuthTimeout          time.Duration
+}
+
 func Load() (*Config, error) {
 	// Load .env file if it exists
 	_ = godotenv.Load()
@@ -57,24 +201,218 @@ func Load() (*Config, error) {
 			SSLMode:  getEnv("DB_SSLMODE", "disable"),
 		},
 		Server: ServerConfig{
-			Port: getEnv("PORT", "8080"),
-			Host: getEnv("HOST", "0.0.0.0"),
+			Port:        getEnv("PORT", "8080"),
+			Host:        getEnv("HOST", "0.0.0.0"),
+			Environment: getEnv("APP_ENV", "development"),
+			BaseURL:     getEnv("APP_BASE_URL", "http://localhost:8080"),
+
+			TrustProxyHeaders: getEnvAsBool("TRUST_PROXY_HEADERS", false),
 		},
 		JWT: JWTConfig{
-			Secret: getEnv("JWT_SECRET", "default-secret-change-in-production"),
+			Secret:               getEnv("JWT_SECRET", defaultJWTSecret),
+			SigningKeyFile:       getEnv("JWT_SIGNING_KEY_FILE", ""),
+			VerificationKeyFiles: getEnvAsSlice("JWT_VERIFICATION_KEY_FILES", []string{}),
+			AccessTokenTTL:       getEnvAsDuration("JWT_ACCESS_TTL", 15*time.Minute),
+			RefreshTokenTTL:      getEnvAsDuration("JWT_REFRESH_TTL", 30*24*time.Hour),
+		},
+		OIDC: OIDCConfig{
+			IssuerURL:    getEnv("OIDC_ISSUER_URL", ""),
+			ClientID:     getEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/"),
+			Scopes:       getEnvAsSlice("OIDC_SCOPES", []string{"openid", "email", "profile"}),
+		},
+		TwoFactor: TwoFactorConfig{
+			Issuer:       getEnv("TOTP_ISSUER", "Twerlo Chat"),
+			Required:     getEnvAsBool("TOTP_REQUIRED", false),
+			ChallengeTTL: getEnvAsDuration("TOTP_CHALLENGE_TTL", 5*time.Minute),
+		},
+		Mail: MailConfig{
+			Driver:       getEnv("MAIL_DRIVER", "log"),
+			From:         getEnv("MAIL_FROM", "Twerlo Chat <no-reply@localhost>"),
+			SMTPHost:     getEnv("SMTP_HOST", "localhost"),
+			SMTPPort:     getEnv("SMTP_PORT", "587"),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+			Dir:          getEnv("MAIL_DIR", "./mail"),
+		},
+		Account: AccountConfig{
+			RequireEmailVerification: getEnvAsBool("REQUIRE_EMAIL_VERIFICATION", false),
+			EmailVerificationTTL:     getEnvAsDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+			PasswordResetTTL:         getEnvAsDuration("PASSWORD_RESET_TTL", time.Hour),
+		},
+		Password: PasswordConfig{
+			MinLength:         getEnvAsInt("PASSWORD_MIN_LENGTH", 8),
+			RequireUppercase:  getEnvAsBool("PASSWORD_REQUIRE_UPPERCASE", false),
+			RequireLowercase:  getEnvAsBool("PASSWORD_REQUIRE_LOWERCASE", false),
+			RequireDigit:      getEnvAsBool("PASSWORD_REQUIRE_DIGIT", false),
+			RequireSymbol:     getEnvAsBool("PASSWORD_REQUIRE_SYMBOL", false),
+			BreachedListFile:  getEnv("PASSWORD_BREACHED_LIST_FILE", ""),
+			HashAlgorithm:     getEnv("PASSWORD_HASH_ALGORITHM", "argon2id"),
+			BcryptCost:        getEnvAsInt("PASSWORD_BCRYPT_COST", 10), // bcrypt.DefaultCost
+			Argon2Time:        getEnvAsInt("PASSWORD_ARGON2_TIME", 2),
+			Argon2Memory:      getEnvAsInt("PASSWORD_ARGON2_MEMORY", 19456), // 19 MiB
+			Argon2Parallelism: getEnvAsInt("PASSWORD_ARGON2_PARALLELISM", 1),
+		},
+		Login: LoginThrottleConfig{
+			Store:              getEnv("LOGIN_THROTTLE_STORE", "memory"),
+			MaxAccountFailures: getEnvAsInt("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+			MaxIPFailures:      getEnvAsInt("LOGIN_MAX_IP_FAILURES", 20),
+			BackoffBase:        getEnvAsDuration("LOGIN_BACKOFF_BASE", time.Second),
+			BackoffMax:         getEnvAsDuration("LOGIN_BACKOFF_MAX", time.Minute),
+			LockoutDuration:    getEnvAsDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+			FailureWindow:      getEnvAsDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		},
+		APITokens: APITokenConfig{
+			DefaultRateLimit: getEnvAsInt("API_TOKEN_RATE_LIMIT", 60),
+			MaxRateLimit:     getEnvAsInt("API_TOKEN_MAX_RATE_LIMIT", 600),
+			MaxBotsPerUser:   getEnvAsInt("MAX_BOTS_PER_USER", 5),
 		},
 		Upload: UploadConfig{
 			MaxSize: getEnvAsInt64("MAX_UPLOAD_SIZE", 10485760), // 10MB default
 			Path:    getEnv("UPLOAD_PATH", "./uploads"),
+			Driver:  getEnv("STORAGE_DRIVER", "local"),
+
+			AllowedTypes: getEnvAsSlice("UPLOAD_ALLOWED_TYPES", []string{"jpg", "jpeg", "png", "gif", "pdf", "doc", "docx", "txt", "mp4", "avi", "mov"}),
+
+			ResumablePath: getEnv("UPLOAD_RESUMABLE_PATH", "./uploads-partial"),
+			ResumableTTL:  getEnvAsDuration("UPLOAD_RESUMABLE_TTL", 24*time.Hour),
+
+			ResumableMaxPending: getEnvAsInt("UPLOAD_RESUMABLE_MAX_PENDING", 5),
+
+			OrphanGrace: getEnvAsDuration("UPLOAD_ORPHAN_GRACE", 24*time.Hour),
+
+			RoleQuotas: map[string]int64{
+				"user":      getEnvAsInt64("STORAGE_QUOTA_USER", 1073741824),      // 1GB default
+				"moderator": getEnvAsInt64("STORAGE_QUOTA_MODERATOR", 5368709120), // 5GB default
+				"admin":     getEnvAsInt64("STORAGE_QUOTA_ADMIN", 0),
+			},
+
+			ThumbnailSize:  getEnvAsInt("IMAGE_THUMBNAIL_SIZE", 256),
+			MediumSize:     getEnvAsInt("IMAGE_MEDIUM_SIZE", 1024),
+			MaxImagePixels: getEnvAsInt("IMAGE_MAX_PIXELS", 50000000), // 50 megapixels
+
+			KeepImageMetadata: getEnvAsBool("IMAGE_KEEP_METADATA", false),
+
+			URLSecret: getEnv("MEDIA_URL_SECRET", ""),
+			URLTTL:    getEnvAsDuration("MEDIA_URL_TTL", time.Hour),
+			S3: S3Config{
+				Endpoint:        getEnv("S3_ENDPOINT", ""),
+				Region:          getEnv("S3_REGION", "us-east-1"),
+				Bucket:          getEnv("S3_BUCKET", ""),
+				AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+				SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+				PathStyle:       getEnvAsBool("S3_USE_PATH_STYLE", false),
+			},
+			Scan: ScanConfig{
+				Driver:        getEnv("UPLOAD_SCANNER", "none"),
+				ClamdAddress:  getEnv("CLAMD_ADDRESS", "127.0.0.1:3310"),
+				Timeout:       getEnvAsDuration("CLAMD_TIMEOUT", 30*time.Second),
+				RetryInterval: getEnvAsDuration("UPLOAD_SCAN_RETRY_INTERVAL", time.Minute),
+			},
 		},
 		CORS: CORSConfig{
 			AllowedOrigins: getEnvAsSlice("CORS_ALLOWED_ORIGINS", []string{"http://localhost:3000", "http://localhost:8080"}),
 		},
+		WebSocket: WebSocketConfig{
+			EnableCompression:    getEnvAsBool("WS_ENABLE_COMPRESSION", true),
+			CompressionLevel:     getEnvAsInt("WS_COMPRESSION_LEVEL", 1),        // flate.BestSpeed
+			CompressionThreshold: getEnvAsInt("WS_COMPRESSION_THRESHOLD", 1024), // 1KB default
+			MaxMessageSize:       getEnvAsInt64("WS_MAX_MESSAGE_SIZE", 65536),   // 64KB default
+			WriteWait:            getEnvAsDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+			PongWait:             getEnvAsDuration("WS_PONG_TIMEOUT", 60*time.Second),
+			PingPeriod:           getEnvAsDuration("WS_PING_INTERVAL", 54*time.Second),
+			MessageRateLimit:     getEnvAsFloat64("WS_RATE_LIMIT", 10),
+			MessageBurst:         getEnvAsInt("WS_RATE_BURST", 20),
+			MaxRateViolations:    getEnvAsInt("WS_RATE_LIMIT_VIOLATIONS", 5),
+			TicketTTL:            getEnvAsDuration("WS_TICKET_TTL", 30*time.Second),
+			AuthTimeout:          getEnvAsDuration("WS_AUTH_TIMEOUT", 10*time.Second),
+		},
+		Admin: AdminConfig{
+			Emails: getEnvAsSlice("ADMIN_EMAILS", []string{}),
+		},
+	}
+
+	// Refuse to sign tokens with the well-known default secret outside development
+	if config.JWT.SigningKeyFile == "" && config.JWT.Secret == defaultJWTSecret && !config.IsDevelopment() {
+		return nil, fmt.Errorf("JWT_SECRET must be changed from its default when APP_ENV is %q", config.Server.Environment)
+	}
+
+	if config.OIDC.Enabled() && config.OIDC.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required when OIDC_ISSUER_URL is set")
+	}
+
+	if config.Login.Store != "memory" && config.Login.Store != "postgres" {
+		return nil, fmt.Errorf("LOGIN_THROTTLE_STORE must be memory or postgres, got %q", config.Login.Store)
+	}
+
+	// Media URLs are signed with the JWT secret unless they get their own
+	if config.Upload.URLSecret == "" {
+		if config.JWT.SigningKeyFile != "" && !config.IsDevelopment() {
+			return nil, fmt.Errorf("MEDIA_URL_SECRET is required when JWT_SIGNING_KEY_FILE is set")
+		}
+		config.Upload.URLSecret = config.JWT.Secret
+	}
+
+	if config.Upload.ThumbnailSize < 1 || config.Upload.MediumSize < config.Upload.ThumbnailSize {
+		return nil, fmt.Errorf("IMAGE_MEDIUM_SIZE (%d) must be at least IMAGE_THUMBNAIL_SIZE (%d), which must be positive",
+			config.Upload.MediumSize, config.Upload.ThumbnailSize)
+	}
+
+	if config.Upload.ResumableMaxPending < 1 {
+		return nil, fmt.Errorf("UPLOAD_RESUMABLE_MAX_PENDING must be positive")
+	}
+
+	if config.Upload.Driver == "s3" && (config.Upload.S3.Endpoint == "" || config.Upload.S3.Bucket == "") {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required when STORAGE_DRIVER is s3")
+	}
+
+	if config.Upload.Scan.Timeout <= 0 || config.Upload.Scan.RetryInterval <= 0 {
+		return nil, fmt.Errorf("CLAMD_TIMEOUT and UPLOAD_SCAN_RETRY_INTERVAL must be positive")
+	}
+
+	if config.Password.HashAlgorithm != "bcrypt" && config.Password.HashAlgorithm != "argon2id" {
+		return nil, fmt.Errorf("PASSWORD_HASH_ALGORITHM must be bcrypt or argon2id, got %q", config.Password.HashAlgorithm)
+	}
+
+	// bcrypt ignores everything after 72 bytes
+	if config.Password.MinLength < 1 || config.Password.MinLength > 72 {
+		return nil, fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and 72, got %d", config.Password.MinLength)
+	}
+
+	if config.Password.BcryptCost < 4 || config.Password.BcryptCost > 31 {
+		return nil, fmt.Errorf("PASSWORD_BCRYPT_COST must be between 4 and 31, got %d", config.Password.BcryptCost)
+	}
+
+	if config.Password.Argon2Time < 1 || config.Password.Argon2Memory < 8 ||
+		config.Password.Argon2Parallelism < 1 || config.Password.Argon2Parallelism > 255 {
+		return nil, fmt.Errorf("PASSWORD_ARGON2_TIME, PASSWORD_ARGON2_MEMORY and PASSWORD_ARGON2_PARALLELISM are out of range")
+	}
+
+	// Timers are created from these, they must be positive
+	if config.WebSocket.WriteWait <= 0 || config.WebSocket.PongWait <= 0 || config.WebSocket.PingPeriod <= 0 {
+		return nil, fmt.Errorf("WS_WRITE_TIMEOUT, WS_PONG_TIMEOUT and WS_PING_INTERVAL must be positive")
+	}
+
+	// Pings must arrive before the peer's read deadline expires
+	if config.WebSocket.PingPeriod >= config.WebSocket.PongWait {
+		return nil, fmt.Errorf("WS_PING_INTERVAL (%s) must be shorter than WS_PONG_TIMEOUT (%s)",
+			config.WebSocket.PingPeriod, config.WebSocket.PongWait)
 	}
 
 	return config, nil
 }
 
+// IsDevelopment reports whether the application runs in development mode
+func (c *Config) IsDevelopment() bool {
+	return c.Server.Environment == "development"
+}
+
+// Enabled reports whether single sign-on is configured
+func (c *OIDCConfig) Enabled() bool {
+	return c.IssuerURL != ""
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -91,6 +429,42 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvAsInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat64(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsSlice(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
 		return strings.Split(value, ",")
@@ -65,6 +65,23 @@ func (db *DB) RunMigrations() error {
 		createUsersTable,
 		createMessagesTable,
 		createBroadcastMessagesTable,
+		createRefreshTokensTable,
+		createTokenRevocationsTable,
+		createUserIdentitiesTable,
+		addRefreshTokenMFAColumn,
+		createTwoFactorTables,
+		addUserEmailVerifiedColumn,
+		createLoginAttemptTables,
+		addUserRoleColumn,
+		createBotsAndAPITokens,
+		addMessageImageColumns,
+		createAttachmentsTable,
+		createBlobsTable,
+		addUserStorageQuotaColumn,
+		addAttachmentStatusColumn,
+		addTokenGenerationColumn,
+		addBlobStoredColumn,
+		addLoginThrottlePendingColumns,
 		createIndexes,
 	}
 
@@ -38,6 +38,176 @@ CREATE TABLE IF NOT EXISTS broadcast_messages (
     UNIQUE(message_id, recipient_id)
 );`
 
+const createRefreshTokensTable = `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE,
+    replaced_by UUID,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);`
+
+const createTokenRevocationsTable = `
+CREATE TABLE IF NOT EXISTS token_revocations (
+    token_id VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    revoked_before TIMESTAMP WITH TIME ZONE NOT NULL
+);`
+
+const createUserIdentitiesTable = `
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(issuer, subject)
+);`
+
+const addRefreshTokenMFAColumn = `
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS mfa BOOLEAN NOT NULL DEFAULT FALSE;`
+
+const createTwoFactorTables = `
+CREATE TABLE IF NOT EXISTS user_two_factor (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE
+);`
+
+const addUserEmailVerifiedColumn = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;`
+
+const createLoginAttemptTables = `
+CREATE TABLE IF NOT EXISTS login_throttle (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS failed_login_attempts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    action VARCHAR(20) NOT NULL,
+    identifier VARCHAR(255) NOT NULL,
+    ip_address VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    reason VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);`
+
+const addUserRoleColumn = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'moderator', 'admin'));`
+
+const createBotsAndAPITokens = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_id UUID REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    rate_limit INTEGER NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    revoked_at TIMESTAMP WITH TIME ZONE
+);`
+
+const addMessageImageColumns = `
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_width INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_height INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_thumbnail_url TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_medium_url TEXT;`
+
+const createAttachmentsTable = `
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT UNIQUE NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    width INTEGER,
+    height INTEGER,
+    thumbnail_key TEXT,
+    medium_key TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    attached_at TIMESTAMP WITH TIME ZONE
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL;`
+
+const createBlobsTable = `
+DO $$
+BEGIN
+    IF to_regclass('blobs') IS NULL THEN
+        CREATE TABLE blobs (
+            storage_key TEXT PRIMARY KEY,
+            sha256 VARCHAR(64) NOT NULL,
+            size BIGINT NOT NULL,
+            thumbnail_key TEXT,
+            medium_key TEXT,
+            ref_count INTEGER NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+        );
+
+        INSERT INTO blobs (storage_key, sha256, size, thumbnail_key, medium_key, ref_count, created_at)
+        SELECT storage_key, MIN(sha256), MIN(size), MIN(thumbnail_key), MIN(medium_key), COUNT(*), MIN(created_at)
+        FROM attachments
+        GROUP BY storage_key;
+    END IF;
+END $$;
+
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_storage_key_key;`
+
+const addUserStorageQuotaColumn = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_quota BIGINT;`
+
+const addTokenGenerationColumn = `
+ALTER TABLE user_token_revocations ADD COLUMN IF NOT EXISTS generation BIGINT NOT NULL DEFAULT 1;`
+
+const addBlobStoredColumn = `
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS stored BOOLEAN NOT NULL DEFAULT TRUE;`
+
+const addLoginThrottlePendingColumns = `
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS pending INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS pending_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE login_throttle ALTER COLUMN last_failure_at DROP NOT NULL;`
+
+const addAttachmentStatusColumn = `
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'clean'
+    CHECK (status IN ('pending', 'clean', 'infected'));`
+
 const createIndexes = `
 -- Indexes for better query performance
 CREATE INDEX IF NOT EXISTS idx_messages_sender_id ON messages(sender_id);
@@ -48,4 +218,17 @@ CREATE INDEX IF NOT EXISTS idx_broadcast_messages_message_id ON broadcast_messag
 CREATE INDEX IF NOT EXISTS idx_broadcast_messages_recipient_id ON broadcast_messages(recipient_id);
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
-CREATE INDEX IF NOT EXISTS idx_users_is_online ON users(is_online);`
+CREATE INDEX IF NOT EXISTS idx_users_is_online ON users(is_online);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_token_revocations_expires_at ON token_revocations(expires_at);
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+CREATE INDEX IF NOT EXISTS idx_two_factor_recovery_codes_user_id ON two_factor_recovery_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_failed_login_attempts_created_at ON failed_login_attempts(created_at);
+CREATE INDEX IF NOT EXISTS idx_users_owner_id ON users(owner_id);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_created_by ON api_tokens(created_by);
+CREATE INDEX IF NOT EXISTS idx_attachments_uploader_id ON attachments(uploader_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_unattached ON attachments(created_at) WHERE attached_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_attachment_id ON messages(attachment_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_storage_key ON attachments(storage_key);
+CREATE INDEX IF NOT EXISTS idx_attachments_pending ON attachments(created_at) WHERE status = 'pending';`
@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer writes each message to an .eml file instead of sending it,
+// for development and tests
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer creates a file mailer writing to dir
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+// Send writes a message to a new file
+func (m *FileMailer) Send(msg *Message) error {
+	if err := validateHeaders(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), uuid.New())
+	if err := os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg), 0644); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+
+	return nil
+}
+
+// LogMailer writes messages to the log instead of sending them
+type LogMailer struct {
+	from string
+}
+
+// NewLogMailer creates a log mailer
+func NewLogMailer(from string) *LogMailer {
+	return &LogMailer{from: from}
+}
+
+// Send logs a message
+func (m *LogMailer) Send(msg *Message) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
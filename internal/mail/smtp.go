@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer sends emails through an SMTP server. STARTTLS is used when the
+// server supports it.
+type SMTPMailer struct {
+	addr   string
+	auth   smtp.Auth
+	from   string // From header, with the display name
+	sender string // Bare address for the envelope
+}
+
+// NewSMTPMailer creates an SMTP mailer. Authentication is skipped when no
+// username is given. from may include a display name, as in
+// "Name <address>".
+func NewSMTPMailer(host, port, username, password, from string) (*SMTPMailer, error) {
+	address, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+
+	mailer := &SMTPMailer{
+		addr:   net.JoinHostPort(host, port),
+		from:   address.String(),
+		sender: address.Address,
+	}
+
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return mailer, nil
+}
+
+// Send sends a message
+func (m *SMTPMailer) Send(msg *Message) error {
+	if err := validateHeaders(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	if err := smtp.SendMail(m.addr, m.auth, m.sender, []string{msg.To}, format(m.from, msg)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
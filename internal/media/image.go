@@ -0,0 +1,273 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // Register the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+)
+
+// Variant names, used as suffixes of their storage keys
+const (
+	VariantThumbnail = "thumb"
+	VariantMedium    = "medium"
+)
+
+const (
+	jpegQuality = 85
+
+	// Originals are only re-encoded to apply their orientation, at a
+	// higher quality than variants
+	originalJPEGQuality = 92
+)
+
+var (
+	// ErrInvalidImage is returned for images that cannot be decoded
+	ErrInvalidImage = errors.New("invalid image")
+
+	// ErrImageTooLarge is returned for images with more pixels than allowed
+	ErrImageTooLarge = errors.New("image dimensions too large")
+)
+
+// EncodedImage is a rendered image variant
+type EncodedImage struct {
+	Name   string // thumb or medium
+	Data   []byte
+	Type   *FileType
+	Width  int
+	Height int
+}
+
+// ProcessedImage is an uploaded image with its variants. Variants are only
+// rendered for images larger than their size; smaller images are their own
+// variants.
+type ProcessedImage struct {
+	Data     []byte // Original to store, without metadata unless it is kept
+	Width    int    // Dimensions once the EXIF orientation is applied
+	Height   int
+	Variants []*EncodedImage
+}
+
+// ImageProcessor decodes uploaded images and renders smaller variants with
+// the standard library codecs
+type ImageProcessor struct {
+	thumbnailSize int
+	mediumSize    int
+	maxPixels     int
+	keepMetadata  bool
+}
+
+// NewImageProcessor creates an image processor with the configured sizes
+func NewImageProcessor(cfg *config.UploadConfig) *ImageProcessor {
+	return &ImageProcessor{
+		thumbnailSize: cfg.ThumbnailSize,
+		mediumSize:    cfg.MediumSize,
+		maxPixels:     cfg.MaxImagePixels,
+		keepMetadata:  cfg.KeepImageMetadata,
+	}
+}
+
+// Supports reports whether variants can be rendered for a file type
+func (p *ImageProcessor) Supports(fileType *FileType) bool {
+	switch fileType.ContentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Process decodes an image and renders its variants. The dimensions are
+// checked before decoding, so small files cannot expand into huge images.
+// Unless metadata is kept, EXIF, XMP and text metadata such as GPS
+// coordinates are removed from the original, after applying its orientation.
+func (p *ImageProcessor) Process(data []byte, fileType *FileType) (*ProcessedImage, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if cfg.Width*cfg.Height > p.maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	orientation := imageOrientation(data, fileType)
+	src := orient(toRGBA(img), orientation)
+	bounds := src.Bounds()
+
+	processed := &ProcessedImage{Data: data, Width: bounds.Dx(), Height: bounds.Dy()}
+	if !p.keepMetadata {
+		processed.Data, err = stripMetadata(data, src, orientation, fileType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, variant := range []struct {
+		name string
+		size int
+	}{
+		{VariantThumbnail, p.thumbnailSize},
+		{VariantMedium, p.mediumSize},
+	} {
+		// Animations would lose all but their first frame
+		if fileType.ContentType == "image/gif" && variant.name != VariantThumbnail {
+			continue
+		}
+		if bounds.Dx() <= variant.size && bounds.Dy() <= variant.size {
+			continue
+		}
+
+		encoded, err := encodeVariant(src, variant.size, fileType)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Name = variant.name
+		processed.Variants = append(processed.Variants, encoded)
+	}
+
+	return processed, nil
+}
+
+// imageOrientation reads the EXIF orientation of a JPEG or PNG
+func imageOrientation(data []byte, fileType *FileType) int {
+	switch fileType.ContentType {
+	case "image/jpeg":
+		return jpegOrientation(data)
+	case "image/png":
+		return pngOrientation(data)
+	}
+	return orientationNormal
+}
+
+// stripMetadata removes the metadata of a JPEG or PNG. Upright images keep
+// their encoded data; others are re-encoded from the oriented pixels, which
+// leaves all metadata behind.
+func stripMetadata(data []byte, oriented *image.RGBA, orientation int, fileType *FileType) ([]byte, error) {
+	var stripped []byte
+	var ok bool
+	switch fileType.ContentType {
+	case "image/jpeg":
+		stripped, ok = stripJPEGMetadata(data)
+	case "image/png":
+		stripped, ok = stripPNGMetadata(data)
+	default:
+		return data, nil
+	}
+
+	if ok && orientation == orientationNormal {
+		return stripped, nil
+	}
+
+	var buf bytes.Buffer
+	if fileType.ContentType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, oriented, &jpeg.Options{Quality: originalJPEGQuality}); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+	} else if err := png.Encode(&buf, oriented); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeVariant scales an image to fit in a square of the given size.
+// JPEG stays JPEG, other formats become PNG to keep their transparency.
+func encodeVariant(src *image.RGBA, size int, fileType *FileType) (*EncodedImage, error) {
+	width, height := fit(src.Bounds().Dx(), src.Bounds().Dy(), size)
+	scaled := resize(src, width, height)
+
+	var buf bytes.Buffer
+	variantType := knownTypes[".png"]
+	if fileType.ContentType == "image/jpeg" {
+		variantType = knownTypes[".jpg"]
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, fmt.Errorf("failed to encode image variant: %w", err)
+		}
+	} else if err := png.Encode(&buf, scaled); err != nil {
+		return nil, fmt.Errorf("failed to encode image variant: %w", err)
+	}
+
+	return &EncodedImage{
+		Data:   buf.Bytes(),
+		Type:   variantType,
+		Width:  width,
+		Height: height,
+	}, nil
+}
+
+// VariantKey returns the storage key of an image variant, next to the
+// original
+func VariantKey(key, name, extension string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "_" + name + extension
+}
+
+// fit scales dimensions down to fit in a square, keeping the aspect ratio
+func fit(width, height, size int) (int, int) {
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+// toRGBA converts an image to RGBA with its origin at (0, 0)
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && bounds.Min == (image.Point{}) {
+		return rgba
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// resize scales an image down by averaging the source pixels covered by each
+// destination pixel
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max(y0+1, (y+1)*srcHeight/height)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max(x0+1, (x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
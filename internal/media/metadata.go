@@ -0,0 +1,255 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// EXIF orientation values that need no transformation
+const orientationNormal = 1
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripJPEGMetadata removes EXIF, XMP, IPTC and comment segments from a
+// JPEG without re-encoding it. The JFIF and Adobe segments and ICC color
+// profiles are kept, and anything after the end of the image is dropped.
+func stripJPEGMetadata(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for i+2 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, false
+		}
+		marker := data[i+1]
+
+		// Fill bytes before a marker
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		if marker == 0xD9 { // End of image
+			out.Write(data[i : i+2])
+			return out.Bytes(), true
+		}
+
+		if i+4 > len(data) {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, false
+		}
+
+		if keepJPEGSegment(marker, data[i+4:end]) {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		// Entropy-coded data follows the start of scan, up to the next
+		// marker other than a restart or a stuffed zero
+		if marker == 0xDA {
+			start := i
+			for i+1 < len(data) && !(data[i] == 0xFF && data[i+1] != 0x00 && (data[i+1] < 0xD0 || data[i+1] > 0xD7)) {
+				i++
+			}
+			out.Write(data[start:i])
+		}
+	}
+
+	return nil, false
+}
+
+// keepJPEGSegment reports whether a segment carries image data rather than
+// metadata
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0: // JFIF
+		return true
+	case marker == 0xE2: // ICC profile, but not multi-picture data
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE: // Adobe color transform
+		return true
+	case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE: // Other applications, comments
+		return false
+	}
+	return true
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return orientationNormal
+	}
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+
+		payload := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return tiffOrientation(payload[6:])
+		}
+		i = end
+	}
+
+	return orientationNormal
+}
+
+// stripPNGMetadata removes EXIF, text and timestamp chunks from a PNG
+// without re-encoding it, and drops anything after the image end
+func stripPNGMetadata(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	i := len(pngSignature)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[i:end])
+		}
+
+		if string(data[i+4:i+8]) == "IEND" {
+			return out.Bytes(), true
+		}
+		i = end
+	}
+
+	return nil, false
+}
+
+// pngOrientation reads the orientation from the EXIF chunk of a PNG
+func pngOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return orientationNormal
+	}
+
+	i := len(pngSignature)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			return tiffOrientation(data[i+8 : i+8+length])
+		case "IDAT", "IEND": // EXIF must come before the image data
+			return orientationNormal
+		}
+		i = end
+	}
+
+	return orientationNormal
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of EXIF data
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return orientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return orientationNormal
+	}
+
+	entries := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		// Orientation is a SHORT stored in the first bytes of the value
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return orientationNormal
+			}
+			return orientation
+		}
+	}
+
+	return orientationNormal
+}
+
+// orient transforms an image as its EXIF orientation describes, so it
+// displays upright without the orientation tag
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= orientationNormal || orientation > 8 {
+		return src
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 { // Rotated by 90 degrees
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = width-1-x, y
+			case 3: // Rotated 180 degrees
+				sx, sy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, height-1-y
+			case 5: // Mirrored along the top-left diagonal
+				sx, sy = y, x
+			case 6: // Needs a clockwise rotation
+				sx, sy = y, height-1-x
+			case 7: // Mirrored along the top-right diagonal
+				sx, sy = width-1-y, height-1-x
+			case 8: // Needs a counter-clockwise rotation
+				sx, sy = width-1-y, x
+			}
+
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+
+	return dst
+}
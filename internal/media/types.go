@@ -0,0 +1,185 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SniffLength is how many leading bytes of a file type detection looks at
+const SniffLength = 512
+
+// Kinds of uploaded files, matching the message types
+const (
+	KindImage = "image"
+	KindVideo = "video"
+	KindFile  = "file"
+)
+
+var (
+	// ErrTypeNotAllowed is returned for extensions outside the allow-list
+	ErrTypeNotAllowed = errors.New("file type not allowed")
+
+	// ErrTypeMismatch is returned when the content of a file does not match
+	// its extension
+	ErrTypeMismatch = errors.New("file content does not match its extension")
+)
+
+// FileType describes an accepted kind of upload
+type FileType struct {
+	Extension   string
+	ContentType string // Served Content-Type
+	Kind        string // image, video or file
+
+	// matches reports whether the leading bytes of a file are of this type
+	matches func(head []byte) bool
+}
+
+// Inline reports whether browsers may display the file in the page. Other
+// types are downloaded, so they cannot run in the app's origin.
+func (t *FileType) Inline() bool {
+	return t.Kind == KindImage || t.Kind == KindVideo
+}
+
+// knownTypes lists every extension the allow-list can contain
+var knownTypes = map[string]*FileType{
+	".jpg":  {ContentType: "image/jpeg", Kind: KindImage, matches: sniffed("image/jpeg")},
+	".jpeg": {ContentType: "image/jpeg", Kind: KindImage, matches: sniffed("image/jpeg")},
+	".png":  {ContentType: "image/png", Kind: KindImage, matches: sniffed("image/png")},
+	".gif":  {ContentType: "image/gif", Kind: KindImage, matches: sniffed("image/gif")},
+	".webp": {ContentType: "image/webp", Kind: KindImage, matches: sniffed("image/webp")},
+	".mp4":  {ContentType: "video/mp4", Kind: KindVideo, matches: isISOMedia},
+	".mov":  {ContentType: "video/quicktime", Kind: KindVideo, matches: isISOMedia},
+	".avi":  {ContentType: "video/x-msvideo", Kind: KindVideo, matches: sniffed("video/avi")},
+	".webm": {ContentType: "video/webm", Kind: KindVideo, matches: sniffed("video/webm")},
+	".pdf":  {ContentType: "application/pdf", Kind: KindFile, matches: sniffed("application/pdf")},
+	".txt":  {ContentType: "text/plain; charset=utf-8", Kind: KindFile, matches: isText},
+	".doc":  {ContentType: "application/msword", Kind: KindFile, matches: hasPrefix("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	".docx": {ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Kind: KindFile, matches: hasPrefix("PK\x03\x04")},
+	".xlsx": {ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Kind: KindFile, matches: hasPrefix("PK\x03\x04")},
+	".zip":  {ContentType: "application/zip", Kind: KindFile, matches: hasPrefix("PK\x03\x04")},
+}
+
+func init() {
+	for ext, fileType := range knownTypes {
+		fileType.Extension = ext
+	}
+}
+
+// TypeChecker accepts uploads whose extension is on the allow-list and whose
+// content matches the extension
+type TypeChecker struct {
+	allowed map[string]*FileType
+}
+
+// NewTypeChecker creates a checker for the given extensions
+func NewTypeChecker(extensions []string) (*TypeChecker, error) {
+	checker := &TypeChecker{allowed: make(map[string]*FileType)}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		fileType, ok := knownTypes[ext]
+		if !ok {
+			return nil, fmt.Errorf("unsupported upload type %q", ext)
+		}
+		checker.allowed[ext] = fileType
+	}
+
+	return checker, nil
+}
+
+// Check detects the type of a file from its name and leading bytes
+func (c *TypeChecker) Check(filename string, head []byte) (*FileType, error) {
+	fileType, ok := c.allowed[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, ErrTypeNotAllowed
+	}
+
+	if !fileType.matches(head) {
+		return nil, ErrTypeMismatch
+	}
+
+	return fileType, nil
+}
+
+// Allows reports whether the extension of a file name is on the allow-list,
+// before its content is available
+func (c *TypeChecker) Allows(filename string) bool {
+	_, ok := c.allowed[strings.ToLower(filepath.Ext(filename))]
+	return ok
+}
+
+// Extensions lists the allowed extensions without their dots
+func (c *TypeChecker) Extensions() []string {
+	extensions := make([]string, 0, len(c.allowed))
+	for ext := range c.allowed {
+		extensions = append(extensions, strings.TrimPrefix(ext, "."))
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// TypeOf returns the type of a stored file from its extension
+func TypeOf(filename string) (*FileType, bool) {
+	fileType, ok := knownTypes[strings.ToLower(filepath.Ext(filename))]
+	return fileType, ok
+}
+
+// SanitizeFilename makes an uploaded file name safe to keep as metadata and
+// to send back in headers: no directories, control characters or invalid
+// UTF-8, and at most 255 bytes
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// sniffed matches files that the standard content sniffing algorithm
+// detects as contentType
+func sniffed(contentType string) func([]byte) bool {
+	return func(head []byte) bool {
+		return http.DetectContentType(head) == contentType
+	}
+}
+
+func hasPrefix(magic string) func([]byte) bool {
+	return func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte(magic))
+	}
+}
+
+// isISOMedia matches MP4 and QuickTime files, which start with an ftyp box
+func isISOMedia(head []byte) bool {
+	return len(head) >= 12 && string(head[4:8]) == "ftyp"
+}
+
+// isText matches files the sniffing algorithm sees as plain text, which
+// excludes HTML and other markup browsers would render
+func isText(head []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(head), "text/plain")
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes of personal access tokens
+const (
+	ScopeMessagesSend = "messages:send"
+	ScopeMessagesRead = "messages:read"
+	ScopeUsersRead    = "users:read"
+)
+
+// ValidScope reports whether scope is a known personal access token scope
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeMessagesSend, ScopeMessagesRead, ScopeUsersRead:
+		return true
+	}
+	return false
+}
+
+// APIToken is a personal access token. It acts as UserID, which is either
+// its creator or a bot owned by the creator.
+type APIToken struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	UserID     uuid.UUID  `json:"user_id" db:"user_id"`
+	CreatedBy  uuid.UUID  `json:"created_by" db:"created_by"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"` // Start of the token, to recognize it
+	TokenHash  string     `json:"-" db:"token_hash"`  // SHA-256 of the token
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	RateLimit  int        `json:"rate_limit" db:"rate_limit"` // Requests per minute
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+type CreateAPITokenRequest struct {
+	Name          string     `json:"name" validate:"required,max=100"`
+	Scopes        []string   `json:"scopes" validate:"required"`
+	BotID         *uuid.UUID `json:"bot_id,omitempty"`          // Issue the token for an owned bot
+	ExpiresInDays int        `json:"expires_in_days,omitempty"` // 0 never expires
+	RateLimit     int        `json:"rate_limit,omitempty"`      // 0 uses the default
+}
+
+// CreateAPITokenResponse carries the token itself, which is only shown once
+type CreateAPITokenResponse struct {
+	Token    string    `json:"token"`
+	APIToken *APIToken `json:"api_token"`
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username" validate:"required,min=3,max=50"`
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scan states of attachments
+const (
+	AttachmentPending  = "pending"  // Not scanned yet, cannot be sent or downloaded
+	AttachmentClean    = "clean"    // Scanned and found clean
+	AttachmentInfected = "infected" // Malware found, its files are deleted
+)
+
+// Attachment is an uploaded file. It is an orphan until a message of its
+// uploader references it, and orphans are deleted after a grace period.
+type Attachment struct {
+	ID           uuid.UUID  `json:"id" db:"id"`
+	UploaderID   uuid.UUID  `json:"uploader_id" db:"uploader_id"`
+	StorageKey   string     `json:"-" db:"storage_key"`
+	Filename     string     `json:"filename" db:"filename"` // Sanitized original name
+	ContentType  string     `json:"content_type" db:"content_type"`
+	Kind         string     `json:"kind" db:"kind"` // image, video or file
+	Size         int64      `json:"size" db:"size"`
+	SHA256       string     `json:"sha256" db:"sha256"` // Hex digest of the stored content
+	Width        *int       `json:"width,omitempty" db:"width"`
+	Height       *int       `json:"height,omitempty" db:"height"`
+	ThumbnailKey *string    `json:"-" db:"thumbnail_key"`
+	MediumKey    *string    `json:"-" db:"medium_key"`
+	Status       string     `json:"status" db:"status"` // pending, clean or infected
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	AttachedAt   *time.Time `json:"attached_at,omitempty" db:"attached_at"` // First sent in a message
+}
+
+// Blob is a stored file, shared by every attachment with the same content.
+// It is deleted when the last of them goes away.
+type Blob struct {
+	StorageKey   string    `json:"-" db:"storage_key"`
+	SHA256       string    `json:"sha256" db:"sha256"`
+	Size         int64     `json:"size" db:"size"`
+	ThumbnailKey *string   `json:"-" db:"thumbnail_key"`
+	MediumKey    *string   `json:"-" db:"medium_key"`
+	RefCount     int       `json:"ref_count" db:"ref_count"` // Attachments referencing the blob
+	Stored       bool      `json:"stored" db:"stored"`       // Files are in the blob store
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// StorageUsage is how much a user stores in uploads. Every attachment counts
+// in full, even when its content is shared with other uploads.
+type StorageUsage struct {
+	UserID         uuid.UUID `json:"user_id"`
+	UsedBytes      int64     `json:"used_bytes"`
+	Attachments    int       `json:"attachments"`
+	QuotaBytes     *int64    `json:"quota_bytes"`     // Null when unlimited
+	RemainingBytes *int64    `json:"remaining_bytes"` // Null when unlimited
+	CustomQuota    bool      `json:"custom_quota"`    // Set for the user rather than their role
+}
+
+// StorageConsumer is a user in the storage report
+type StorageConsumer struct {
+	StorageUsage
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+}
+
+// StorageReport sums up the storage of every upload, with the users storing
+// the most
+type StorageReport struct {
+	Attachments  int               `json:"attachments"`
+	UsedBytes    int64             `json:"used_bytes"`   // Counted against quotas
+	Blobs        int               `json:"blobs"`        // Distinct contents stored
+	StoredBytes  int64             `json:"stored_bytes"` // Actually stored, without variants
+	TopConsumers []StorageConsumer `json:"top_consumers"`
+}
+
+// UpdateStorageQuotaRequest sets the quota of a user, null to use the quota
+// of their role and 0 for unlimited
+type UpdateStorageQuotaRequest struct {
+	QuotaBytes *int64 `json:"quota_bytes"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FailedLoginAttempt is an audit record of a failed login or registration
+type FailedLoginAttempt struct {
+	ID         uuid.UUID `json:"id" db:"id"`
+	Action     string    `json:"action" db:"action"`         // login, register or change_password
+	Identifier string    `json:"identifier" db:"identifier"` // Email the attempt was made with
+	IPAddress  string    `json:"ip_address" db:"ip_address"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	Reason     string    `json:"reason" db:"reason"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
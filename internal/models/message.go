@@ -29,9 +29,14 @@ type Message struct {
 	RecipientID    *uuid.UUID     `json:"recipient_id,omitempty" db:"recipient_id"` // nil for broadcast messages
 	Content        string         `json:"content" db:"content"`
 	MessageType    MessageType    `json:"message_type" db:"message_type"`
+	AttachmentID   *uuid.UUID     `json:"attachment_id,omitempty" db:"attachment_id"`
 	MediaURL       *string        `json:"media_url,omitempty" db:"media_url"`
 	MediaFilename  *string        `json:"media_filename,omitempty" db:"media_filename"`
 	MediaSize      *int64         `json:"media_size,omitempty" db:"media_size"`
+	MediaWidth     *int           `json:"width,omitempty" db:"media_width"`
+	MediaHeight    *int           `json:"height,omitempty" db:"media_height"`
+	ThumbnailURL   *string        `json:"thumbnail_url,omitempty" db:"media_thumbnail_url"`
+	MediumURL      *string        `json:"medium_url,omitempty" db:"media_medium_url"`
 	DeliveryStatus DeliveryStatus `json:"delivery_status" db:"delivery_status"`
 	CreatedAt      time.Time      `json:"created_at" db:"created_at"`
 	UpdatedAt      time.Time      `json:"updated_at" db:"updated_at"`
@@ -43,7 +48,8 @@ type MessageRequest struct {
 	RecipientIDs []uuid.UUID `json:"recipient_ids,omitempty"` // For broadcast messages
 	Content      string      `json:"content" validate:"required"`
 	MessageType  MessageType `json:"message_type" validate:"required"`
-	MediaURL     *string     `json:"media_url,omitempty"`
+	AttachmentID *uuid.UUID  `json:"attachment_id,omitempty"` // From the upload response
+	MediaURL     *string     `json:"media_url,omitempty"`     // Alternative to attachment_id
 }
 
 type MessageResponse struct {
@@ -53,9 +59,14 @@ type MessageResponse struct {
 	RecipientID    *uuid.UUID     `json:"recipient_id,omitempty"`
 	Content        string         `json:"content"`
 	MessageType    MessageType    `json:"message_type"`
+	AttachmentID   *uuid.UUID     `json:"attachment_id,omitempty"`
 	MediaURL       *string        `json:"media_url,omitempty"`
 	MediaFilename  *string        `json:"media_filename,omitempty"`
 	MediaSize      *int64         `json:"media_size,omitempty"`
+	MediaWidth     *int           `json:"width,omitempty"`
+	MediaHeight    *int           `json:"height,omitempty"`
+	ThumbnailURL   *string        `json:"thumbnail_url,omitempty"`
+	MediumURL      *string        `json:"medium_url,omitempty"`
 	DeliveryStatus DeliveryStatus `json:"delivery_status"`
 	CreatedAt      time.Time      `json:"created_at"`
 	IsBroadcast    bool           `json:"is_broadcast"`
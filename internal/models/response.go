@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // APIResponse represents a standard API response structure
 type APIResponse struct {
@@ -20,17 +25,37 @@ type APIError struct {
 
 // AuthResponse represents authentication response
 type AuthResponse struct {
-	Token     string       `json:"token"`
-	ExpiresAt time.Time    `json:"expires_at"`
-	User      UserResponse `json:"user"`
+	Token            string       `json:"token"`
+	ExpiresAt        time.Time    `json:"expires_at"`
+	RefreshToken     string       `json:"refresh_token"`
+	RefreshExpiresAt time.Time    `json:"refresh_expires_at"`
+	User             UserResponse `json:"user"`
 }
 
 // UploadResponse represents file upload response
 type UploadResponse struct {
-	Filename string `json:"filename"`
-	URL      string `json:"url"`
-	Size     int64  `json:"size"`
-	Type     string `json:"type"`
+	ID          uuid.UUID `json:"id"`       // Attachment to reference in messages
+	Filename    string    `json:"filename"` // Original name of the file
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	Type        string    `json:"type"`
+	ContentType string    `json:"content_type"`
+	Status      string    `json:"status"` // URLs are only given once the file is clean
+
+	// Images only
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	MediumURL    string `json:"medium_url,omitempty"`
+}
+
+// ResumableUploadResponse describes a resumable upload
+type ResumableUploadResponse struct {
+	ID        string          `json:"id"`
+	Length    int64           `json:"length"`
+	Offset    int64           `json:"offset"` // Bytes received so far
+	ExpiresAt time.Time       `json:"expires_at"`
+	Upload    *UploadResponse `json:"upload,omitempty"` // Stored file, once complete
 }
 
 // PaginationMeta represents pagination metadata
@@ -48,6 +73,75 @@ type WebSocketMessage struct {
 	Timestamp time.Time   `json:"timestamp"`
 }
 
+// WSTicketResponse represents a single-use WebSocket ticket
+type WSTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// WebSocketAuthData represents the payload of an auth frame
+type WebSocketAuthData struct {
+	Token  string `json:"token,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// LongPollResponse represents the events returned by a long-poll request
+type LongPollResponse struct {
+	SessionID uuid.UUID         `json:"session_id"`
+	Events    []json.RawMessage `json:"events"`
+}
+
+// WebSocketMetrics represents outbound WebSocket traffic statistics
+type WebSocketMetrics struct {
+	MessagesSent       int64   `json:"messages_sent"`
+	CompressedMessages int64   `json:"compressed_messages"`
+	PayloadBytes       int64   `json:"payload_bytes"`
+	WireBytes          int64   `json:"wire_bytes"`
+	BytesSaved         int64   `json:"bytes_saved"`
+	CompressionRatio   float64 `json:"compression_ratio"`
+}
+
+// HubStats represents a snapshot of the WebSocket hub
+type HubStats struct {
+	ConnectedUsers    int              `json:"connected_users"`
+	ConnectedClients  int              `json:"connected_clients"`
+	Users             []HubUserStats   `json:"users"`
+	RecentDisconnects []HubDisconnect  `json:"recent_disconnects"`
+	Metrics           WebSocketMetrics `json:"metrics"`
+}
+
+// HubUserStats represents the connections of a single user
+type HubUserStats struct {
+	UserID   uuid.UUID        `json:"user_id"`
+	Username string           `json:"username"`
+	Clients  []HubClientStats `json:"clients"`
+}
+
+// HubClientStats represents a single connection registered with the hub
+type HubClientStats struct {
+	ID            uuid.UUID `json:"id"`
+	Transport     string    `json:"transport"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	AgeSeconds    float64   `json:"age_seconds"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	Compressed    bool      `json:"compressed"`
+}
+
+// HubDisconnect represents a connection that left the hub
+type HubDisconnect struct {
+	ClientID       uuid.UUID `json:"client_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	Username       string    `json:"username"`
+	Transport      string    `json:"transport"`
+	Reason         string    `json:"reason"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at"`
+}
+
 // WebSocket message types
 const (
 	WSMessageTypeNewMessage     = "new_message"
@@ -56,6 +150,7 @@ const (
 	WSMessageTypeError          = "error"
 	WSMessageTypePing           = "ping"
 	WSMessageTypePong           = "pong"
+	WSMessageTypeAuth           = "auth"
 )
 
 // NewSuccessResponse creates a successful API response
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TwoFactor holds a user's TOTP enrollment. The enrollment only takes effect
+// once ConfirmedAt is set.
+type TwoFactor struct {
+	UserID         uuid.UUID  `json:"user_id" db:"user_id"`
+	Secret         string     `json:"-" db:"secret"`
+	ConfirmedAt    *time.Time `json:"confirmed_at,omitempty" db:"confirmed_at"`
+	LastUsedStep   int64      `json:"-" db:"last_used_step"` // Time step of the last accepted code
+	FailedAttempts int        `json:"-" db:"failed_attempts"`
+	LockedUntil    *time.Time `json:"-" db:"locked_until"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Enabled reports whether the enrollment has been confirmed
+func (t *TwoFactor) Enabled() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type TwoFactorVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TwoFactorConfirmResponse struct {
+	RecoveryCodes []string      `json:"recovery_codes"`
+	Auth          *AuthResponse `json:"auth"`
+}
+
+type TwoFactorStatusResponse struct {
+	Enabled                bool       `json:"enabled"`
+	Required               bool       `json:"required"`
+	ConfirmedAt            *time.Time `json:"confirmed_at,omitempty"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
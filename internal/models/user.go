@@ -6,6 +6,34 @@ import (
 	"github.com/google/uuid"
 )
 
+// Role grants access to privileged routes. Each role has the permissions
+// of the roles below it.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// roleRanks orders the roles from least to most privileged
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r has the permissions of the minimum role
+func (r Role) AtLeast(minimum Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[minimum]
+}
+
 type User struct {
 	ID        uuid.UUID `json:"id" db:"id"`
 	Username  string    `json:"username" db:"username"`
@@ -15,12 +43,23 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 	IsOnline  bool      `json:"is_online" db:"is_online"`
 	LastSeen  time.Time `json:"last_seen" db:"last_seen"`
+	Role      Role      `json:"role" db:"role"`
+
+	// Bots act only through personal access tokens created by their owner
+	IsBot   bool       `json:"is_bot" db:"is_bot"`
+	OwnerID *uuid.UUID `json:"owner_id,omitempty" db:"owner_id"`
+
+	// Set once the user proved control of the email address
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"`
+
+	// Bytes of uploads the user may store, overriding the quota of their role
+	StorageQuota *int64 `json:"-" db:"storage_quota"`
 }
 
 type UserRegistration struct {
 	Username string `json:"username" validate:"required,min=3,max=50"`
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=6"`
+	Password string `json:"password" validate:"required"`
 }
 
 type UserLogin struct {
@@ -29,14 +68,33 @@ type UserLogin struct {
 }
 
 type UserResponse struct {
+	ID            uuid.UUID  `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	Role          Role       `json:"role"`
+	IsBot         bool       `json:"is_bot"`
+	OwnerID       *uuid.UUID `json:"owner_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	IsOnline      bool       `json:"is_online"`
+	LastSeen      time.Time  `json:"last_seen"`
+}
+
+// PublicUserResponse is what every user can see about other users
+type PublicUserResponse struct {
 	ID        uuid.UUID `json:"id"`
 	Username  string    `json:"username"`
-	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	IsBot     bool      `json:"is_bot"`
 	CreatedAt time.Time `json:"created_at"`
 	IsOnline  bool      `json:"is_online"`
 	LastSeen  time.Time `json:"last_seen"`
 }
 
+type UpdateRoleRequest struct {
+	Role Role `json:"role" validate:"required"`
+}
+
 type UserStatus struct {
 	UserID   uuid.UUID `json:"user_id"`
 	IsOnline bool      `json:"is_online"`
@@ -46,11 +104,51 @@ type UserStatus struct {
 // ToResponse converts User to UserResponse (excludes sensitive data)
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
+		ID:            u.ID,
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified(),
+		Role:          u.Role,
+		IsBot:         u.IsBot,
+		OwnerID:       u.OwnerID,
+		CreatedAt:     u.CreatedAt,
+		IsOnline:      u.IsOnline,
+		LastSeen:      u.LastSeen,
+	}
+}
+
+// ToPublicResponse converts User to PublicUserResponse (excludes the email)
+func (u *User) ToPublicResponse() PublicUserResponse {
+	return PublicUserResponse{
 		ID:        u.ID,
 		Username:  u.Username,
-		Email:     u.Email,
+		Role:      u.Role,
+		IsBot:     u.IsBot,
 		CreatedAt: u.CreatedAt,
 		IsOnline:  u.IsOnline,
 		LastSeen:  u.LastSeen,
 	}
 }
+
+// EmailVerified reports whether the user verified their email address
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+type EmailRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
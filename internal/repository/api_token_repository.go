@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Columns read by every API token query, in the order scanAPIToken expects them
+const apiTokenColumns = `id, user_id, created_by, name, prefix, token_hash, scopes, rate_limit, expires_at, last_used_at, created_at, revoked_at`
+
+type APITokenRepository struct {
+	db *database.DB
+}
+
+func NewAPITokenRepository(db *database.DB) *APITokenRepository {
+	return &APITokenRepository{db: db}
+}
+
+// scanAPIToken scans a row selected with apiTokenColumns
+func scanAPIToken(row rowScanner) (*models.APIToken, error) {
+	token := &models.APIToken{}
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.CreatedBy,
+		&token.Name,
+		&token.Prefix,
+		&token.TokenHash,
+		pq.Array(&token.Scopes),
+		&token.RateLimit,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+		&token.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Create stores a new API token
+func (r *APITokenRepository) Create(token *models.APIToken) error {
+	query := `
+		INSERT INTO api_tokens (id, user_id, created_by, name, prefix, token_hash, scopes, rate_limit, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	_, err := r.db.Exec(query,
+		token.ID,
+		token.UserID,
+		token.CreatedBy,
+		token.Name,
+		token.Prefix,
+		token.TokenHash,
+		pq.Array(token.Scopes),
+		token.RateLimit,
+		token.ExpiresAt,
+		token.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	return nil
+}
+
+// GetByHash retrieves an API token by the hash of the token
+func (r *APITokenRepository) GetByHash(tokenHash string) (*models.APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE token_hash = $1`
+
+	token, err := scanAPIToken(r.db.QueryRow(query, tokenHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API token not found")
+		}
+		return nil, fmt.Errorf("failed to get API token: %w", err)
+	}
+
+	return token, nil
+}
+
+// GetByCreator retrieves the tokens a user created for themselves and their
+// bots, newest first
+func (r *APITokenRepository) GetByCreator(userID uuid.UUID) ([]models.APIToken, error) {
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE created_by = $1 ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, nil
+}
+
+// Revoke revokes a token created by the given user and reports whether it
+// was found and still active
+func (r *APITokenRepository) Revoke(tokenID, createdBy uuid.UUID) (bool, error) {
+	query := `
+		UPDATE api_tokens
+		SET revoked_at = $1
+		WHERE id = $2 AND created_by = $3 AND revoked_at IS NULL
+	`
+
+	result, err := r.db.Exec(query, time.Now(), tokenID, createdBy)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API token: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API token: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// TouchLastUsed records when a token was last used
+func (r *APITokenRepository) TouchLastUsed(tokenID uuid.UUID, usedAt time.Time) error {
+	_, err := r.db.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, usedAt, tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to update API token last use: %w", err)
+	}
+
+	return nil
+}
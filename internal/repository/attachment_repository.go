@@ -0,0 +1,288 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Columns read by every attachment query, in the order scanAttachment expects them
+const attachmentColumns = `id, uploader_id, storage_key, filename, content_type, kind, size, sha256, width, height, thumbnail_key, medium_key, status, created_at, attached_at`
+
+type AttachmentRepository struct {
+	db *database.DB
+}
+
+func NewAttachmentRepository(db *database.DB) *AttachmentRepository {
+	return &AttachmentRepository{db: db}
+}
+
+// scanAttachment scans a row selected with attachmentColumns
+func scanAttachment(row rowScanner) (*models.Attachment, error) {
+	attachment := &models.Attachment{}
+	err := row.Scan(
+		&attachment.ID,
+		&attachment.UploaderID,
+		&attachment.StorageKey,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Kind,
+		&attachment.Size,
+		&attachment.SHA256,
+		&attachment.Width,
+		&attachment.Height,
+		&attachment.ThumbnailKey,
+		&attachment.MediumKey,
+		&attachment.Status,
+		&attachment.CreatedAt,
+		&attachment.AttachedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// Create stores a new attachment
+func (r *AttachmentRepository) Create(attachment *models.Attachment) error {
+	query := `
+		INSERT INTO attachments (id, uploader_id, storage_key, filename, content_type, kind, size, sha256,
+		                         width, height, thumbnail_key, medium_key, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	`
+
+	_, err := r.db.Exec(query,
+		attachment.ID,
+		attachment.UploaderID,
+		attachment.StorageKey,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.Kind,
+		attachment.Size,
+		attachment.SHA256,
+		attachment.Width,
+		attachment.Height,
+		attachment.ThumbnailKey,
+		attachment.MediumKey,
+		attachment.Status,
+		attachment.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create attachment: %w", err)
+	}
+
+	return nil
+}
+
+// GetByID retrieves an attachment by its ID
+func (r *AttachmentRepository) GetByID(id uuid.UUID) (*models.Attachment, error) {
+	query := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id = $1`
+
+	attachment, err := scanAttachment(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("attachment not found")
+		}
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+
+	return attachment, nil
+}
+
+// GetByStorageKey retrieves the latest attachment of a user stored under a
+// blob key. Users uploading the same content get attachments sharing a key.
+func (r *AttachmentRepository) GetByStorageKey(key string, uploaderID uuid.UUID) (*models.Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + ` FROM attachments
+		WHERE storage_key = $1 AND uploader_id = $2
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+
+	attachment, err := scanAttachment(r.db.QueryRow(query, key, uploaderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("attachment not found")
+		}
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+
+	return attachment, nil
+}
+
+// MarkAttached records that an attachment was sent in a message, and
+// reports whether it still exists
+func (r *AttachmentRepository) MarkAttached(id uuid.UUID, attachedAt time.Time) (bool, error) {
+	query := `UPDATE attachments SET attached_at = COALESCE(attached_at, $1) WHERE id = $2`
+
+	result, err := r.db.Exec(query, attachedAt, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark attachment as attached: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark attachment as attached: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// SetScanStatus records the scan verdict of a pending attachment, and
+// reports whether it was still pending
+func (r *AttachmentRepository) SetScanStatus(id uuid.UUID, status string) (bool, error) {
+	result, err := r.db.Exec(`UPDATE attachments SET status = $1 WHERE id = $2 AND status = 'pending'`, status, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to update attachment status: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update attachment status: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// GetPending retrieves attachments created before a time and not scanned
+// yet, oldest first
+func (r *AttachmentRepository) GetPending(createdBefore time.Time, limit int) ([]models.Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + ` FROM attachments
+		WHERE status = 'pending' AND created_at < $1
+		ORDER BY created_at
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(query, createdBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending attachments: %w", err)
+	}
+	defer rows.Close()
+
+	attachments := []models.Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments = append(attachments, *attachment)
+	}
+
+	return attachments, nil
+}
+
+// GetOrphans retrieves attachments created before a time and never sent in
+// a message, oldest first
+func (r *AttachmentRepository) GetOrphans(createdBefore time.Time, limit int) ([]models.Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + ` FROM attachments
+		WHERE attached_at IS NULL AND created_at < $1
+		ORDER BY created_at
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(query, createdBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orphan attachments: %w", err)
+	}
+	defer rows.Close()
+
+	attachments := []models.Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments = append(attachments, *attachment)
+	}
+
+	return attachments, nil
+}
+
+// DeleteOrphan deletes an attachment unless it was sent in a message
+// meanwhile, and reports whether it was deleted. The status of the
+// attachment is refreshed, as it may have been scanned since it was read.
+func (r *AttachmentRepository) DeleteOrphan(orphan *models.Attachment) (bool, error) {
+	err := r.db.QueryRow(`DELETE FROM attachments WHERE id = $1 AND attached_at IS NULL RETURNING status`, orphan.ID).Scan(&orphan.Status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to delete attachment: %w", err)
+	}
+
+	return true, nil
+}
+
+// GetUsage returns the total size and number of the attachments of a user.
+// Infected attachments are left out, their files are deleted.
+func (r *AttachmentRepository) GetUsage(uploaderID uuid.UUID) (int64, int, error) {
+	var size int64
+	var count int
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(size), 0), COUNT(*) FROM attachments WHERE uploader_id = $1 AND status <> 'infected'`, uploaderID).Scan(&size, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get storage usage: %w", err)
+	}
+
+	return size, count, nil
+}
+
+// GetTotals returns the total size and number of all attachments, except
+// infected ones
+func (r *AttachmentRepository) GetTotals() (int64, int, error) {
+	var size int64
+	var count int
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(size), 0), COUNT(*) FROM attachments WHERE status <> 'infected'`).Scan(&size, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get attachment totals: %w", err)
+	}
+
+	return size, count, nil
+}
+
+// GetTopConsumers retrieves the users whose attachments take the most
+// storage, largest first. Their quota is only set when they have their own.
+func (r *AttachmentRepository) GetTopConsumers(limit int) ([]models.StorageConsumer, error) {
+	query := `
+		SELECT u.id, u.username, u.role, u.storage_quota, SUM(a.size) AS used, COUNT(*)
+		FROM attachments a
+		JOIN users u ON a.uploader_id = u.id
+		WHERE a.status <> 'infected'
+		GROUP BY u.id
+		ORDER BY used DESC, u.username
+		LIMIT $1
+	`
+
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage consumers: %w", err)
+	}
+	defer rows.Close()
+
+	consumers := []models.StorageConsumer{}
+	for rows.Next() {
+		var consumer models.StorageConsumer
+		err := rows.Scan(
+			&consumer.UserID,
+			&consumer.Username,
+			&consumer.Role,
+			&consumer.QuotaBytes,
+			&consumer.UsedBytes,
+			&consumer.Attachments,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan storage consumer: %w", err)
+		}
+		consumer.CustomQuota = consumer.QuotaBytes != nil
+		consumers = append(consumers, consumer)
+	}
+
+	return consumers, nil
+}
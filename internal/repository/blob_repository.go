@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+)
+
+type BlobRepository struct {
+	db *database.DB
+}
+
+func NewBlobRepository(db *database.DB) *BlobRepository {
+	return &BlobRepository{db: db}
+}
+
+// Acquire adds a reference to a blob, recording the blob if it is new, and
+// reports whether its files are stored. Until they are, every uploader of
+// the content stores them, so none depends on another one succeeding.
+func (r *BlobRepository) Acquire(blob *models.Blob) (bool, error) {
+	query := `
+		INSERT INTO blobs (storage_key, sha256, size, thumbnail_key, medium_key, ref_count, stored, created_at)
+		VALUES ($1, $2, $3, $4, $5, 1, FALSE, $6)
+		ON CONFLICT (storage_key) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING ref_count, stored
+	`
+
+	err := r.db.QueryRow(query,
+		blob.StorageKey,
+		blob.SHA256,
+		blob.Size,
+		blob.ThumbnailKey,
+		blob.MediumKey,
+		blob.CreatedAt,
+	).Scan(&blob.RefCount, &blob.Stored)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire blob: %w", err)
+	}
+
+	return blob.Stored, nil
+}
+
+// MarkStored records that the files of a blob are in the blob store
+func (r *BlobRepository) MarkStored(storageKey string) error {
+	if _, err := r.db.Exec(`UPDATE blobs SET stored = TRUE WHERE storage_key = $1`, storageKey); err != nil {
+		return fmt.Errorf("failed to mark blob as stored: %w", err)
+	}
+
+	return nil
+}
+
+// Release drops a reference to a blob. With the last one, deleteFiles is
+// called and the record deleted while the record stays locked, so uploads
+// of the same content wait and then store the files again. Blobs without a
+// record are left alone, their files may belong to a new upload.
+func (r *BlobRepository) Release(storageKey string, deleteFiles func()) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var refCount int
+	err = tx.QueryRow(`UPDATE blobs SET ref_count = ref_count - 1 WHERE storage_key = $1 RETURNING ref_count`, storageKey).Scan(&refCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to release blob: %w", err)
+	}
+
+	if refCount <= 0 {
+		deleteFiles()
+		if _, err := tx.Exec(`DELETE FROM blobs WHERE storage_key = $1`, storageKey); err != nil {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to release blob: %w", err)
+	}
+
+	return nil
+}
+
+// GetTotals returns the total size and number of stored blobs
+func (r *BlobRepository) GetTotals() (int64, int, error) {
+	var size int64
+	var count int
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(size), 0), COUNT(*) FROM blobs`).Scan(&size, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get blob totals: %w", err)
+	}
+
+	return size, count, nil
+}
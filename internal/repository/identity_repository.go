@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+)
+
+type IdentityRepository struct {
+	db *database.DB
+}
+
+func NewIdentityRepository(db *database.DB) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+// Create links a user to an external identity
+func (r *IdentityRepository) Create(identity *models.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (id, user_id, issuer, subject, email, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := r.db.Exec(query,
+		identity.ID,
+		identity.UserID,
+		identity.Issuer,
+		identity.Subject,
+		identity.Email,
+		identity.CreatedAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create user identity: %w", err)
+	}
+
+	return nil
+}
+
+// GetBySubject retrieves the identity with the given subject at an issuer
+func (r *IdentityRepository) GetBySubject(issuer, subject string) (*models.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, issuer, subject, email, created_at
+		FROM user_identities WHERE issuer = $1 AND subject = $2
+	`
+
+	identity := &models.UserIdentity{}
+	err := r.db.QueryRow(query, issuer, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Issuer,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user identity not found")
+		}
+		return nil, fmt.Errorf("failed to get user identity: %w", err)
+	}
+
+	return identity, nil
+}
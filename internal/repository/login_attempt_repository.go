@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+)
+
+// LoginAttemptRepository is the PostgreSQL implementation of
+// auth.AttemptStore, shared by every server instance
+type LoginAttemptRepository struct {
+	db *database.DB
+}
+
+func NewLoginAttemptRepository(db *database.DB) *LoginAttemptRepository {
+	return &LoginAttemptRepository{db: db}
+}
+
+var _ auth.AttemptStore = (*LoginAttemptRepository)(nil)
+
+// Columns of login_throttle making up an auth.AttemptState
+const attemptStateColumns = `failures, last_failure_at, locked_until, pending, pending_at`
+
+// scanAttemptState scans attemptStateColumns
+func scanAttemptState(row *sql.Row) (auth.AttemptState, error) {
+	var state auth.AttemptState
+	var lastFailure, lockedUntil, pendingAt sql.NullTime
+	err := row.Scan(&state.Failures, &lastFailure, &lockedUntil, &state.Pending, &pendingAt)
+	if err != nil {
+		return auth.AttemptState{}, err
+	}
+	state.LastFailure = lastFailure.Time
+	state.LockedUntil = lockedUntil.Time
+	state.PendingAt = pendingAt.Time
+
+	return state, nil
+}
+
+// get returns the state of a key
+func (r *LoginAttemptRepository) get(key string) (auth.AttemptState, error) {
+	query := `SELECT ` + attemptStateColumns + ` FROM login_throttle WHERE key = $1`
+
+	state, err := scanAttemptState(r.db.QueryRow(query, key))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return auth.AttemptState{}, nil
+		}
+		return auth.AttemptState{}, fmt.Errorf("failed to get login attempts: %w", err)
+	}
+
+	return state, nil
+}
+
+// Claim checks and counts an attempt of a key in a single statement, so
+// none passes the check on a stale count. The update only applies while
+// the key does not have to wait, the same rule as auth.AttemptLimits.Wait;
+// otherwise no row is returned.
+func (r *LoginAttemptRepository) Claim(key string, at time.Time, limits *auth.AttemptLimits) (auth.AttemptState, bool, error) {
+	query := `
+		INSERT INTO login_throttle (key, failures, last_failure_at, pending, pending_at)
+		VALUES ($1, 0, NULL, 1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET pending = (CASE WHEN login_throttle.pending_at >= $7 THEN login_throttle.pending ELSE 0 END) + 1,
+		    pending_at = EXCLUDED.pending_at
+		WHERE (login_throttle.locked_until IS NULL OR login_throttle.locked_until <= $2)
+		  AND (login_throttle.last_failure_at IS NULL OR login_throttle.last_failure_at < $3
+		       OR login_throttle.last_failure_at + make_interval(secs => LEAST(
+		              $5::float8 * power(2, LEAST(login_throttle.failures - 1, 30)), $6::float8)) <= $2)
+		  AND (CASE WHEN login_throttle.pending_at >= $7 THEN login_throttle.pending ELSE 0 END)
+		      < GREATEST($4 - (CASE WHEN login_throttle.last_failure_at >= $3 THEN login_throttle.failures ELSE 0 END), 1)
+		RETURNING ` + attemptStateColumns
+
+	windowStart := at.Add(-limits.Window)
+	pendingStart := at.Add(-auth.AttemptTimeout)
+
+	state, err := scanAttemptState(r.db.QueryRow(query, key, at, windowStart, limits.MaxFailures,
+		limits.BackoffBase.Seconds(), limits.BackoffMax.Seconds(), pendingStart))
+	if err == sql.ErrNoRows {
+		state, err = r.get(key)
+		return state, false, err
+	}
+	if err != nil {
+		return auth.AttemptState{}, false, fmt.Errorf("failed to record login attempt: %w", err)
+	}
+
+	// Keys are only needed until their failures are forgotten and their
+	// attempts are over
+	_, err = r.db.Exec(`
+		DELETE FROM login_throttle
+		WHERE (last_failure_at IS NULL OR last_failure_at < $1)
+		  AND (locked_until IS NULL OR locked_until < $2)
+		  AND (pending_at IS NULL OR pending_at < $3)
+	`, windowStart, at, pendingStart)
+	if err != nil {
+		return auth.AttemptState{}, false, fmt.Errorf("failed to delete expired login attempts: %w", err)
+	}
+
+	return state, true, nil
+}
+
+// RecordFailure ends an attempt of a key as a failure in a single
+// statement, so concurrent failures are all counted
+func (r *LoginAttemptRepository) RecordFailure(key string, at time.Time, limits *auth.AttemptLimits) (auth.AttemptState, error) {
+	query := `
+		INSERT INTO login_throttle (key, failures, last_failure_at, locked_until)
+		VALUES ($1, 1, $2, CASE WHEN $4 <= 1 THEN $5::timestamptz END)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE WHEN login_throttle.last_failure_at >= $3 THEN login_throttle.failures + 1 ELSE 1 END,
+		    last_failure_at = EXCLUDED.last_failure_at,
+		    locked_until = CASE
+		        WHEN (CASE WHEN login_throttle.last_failure_at >= $3 THEN login_throttle.failures + 1 ELSE 1 END) >= $4 THEN $5
+		        ELSE login_throttle.locked_until
+		    END,
+		    pending = GREATEST(login_throttle.pending - 1, 0)
+		RETURNING ` + attemptStateColumns
+
+	state, err := scanAttemptState(r.db.QueryRow(query, key, at, at.Add(-limits.Window), limits.MaxFailures, at.Add(limits.Lockout)))
+	if err != nil {
+		return auth.AttemptState{}, fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	return state, nil
+}
+
+// Refund ends an attempt of a key without a failure, dropping keys left
+// with neither failures nor attempts
+func (r *LoginAttemptRepository) Refund(key string) error {
+	_, err := r.db.Exec(`UPDATE login_throttle SET pending = GREATEST(pending - 1, 0) WHERE key = $1`, key)
+	if err != nil {
+		return fmt.Errorf("failed to end login attempt: %w", err)
+	}
+
+	_, err = r.db.Exec(`DELETE FROM login_throttle WHERE key = $1 AND pending = 0 AND failures = 0`, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// Reset forgets the failures of a key
+func (r *LoginAttemptRepository) Reset(key string) error {
+	_, err := r.db.Exec(`DELETE FROM login_throttle WHERE key = $1`, key)
+	if err != nil {
+		return fmt.Errorf("failed to reset login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// Audit stores a failed attempt
+func (r *LoginAttemptRepository) Audit(attempt *models.FailedLoginAttempt) error {
+	query := `
+		INSERT INTO failed_login_attempts (id, action, identifier, ip_address, user_agent, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := r.db.Exec(query,
+		attempt.ID,
+		attempt.Action,
+		attempt.Identifier,
+		attempt.IPAddress,
+		attempt.UserAgent,
+		attempt.Reason,
+		attempt.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to audit login attempt: %w", err)
+	}
+
+	return nil
+}
+
+// RecentFailures returns the latest failed attempts, newest first
+func (r *LoginAttemptRepository) RecentFailures(limit int) ([]models.FailedLoginAttempt, error) {
+	query := `
+		SELECT id, action, identifier, ip_address, user_agent, reason, created_at
+		FROM failed_login_attempts
+		ORDER BY created_at DESC
+		LIMIT $1
+	`
+
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get failed login attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []models.FailedLoginAttempt{}
+	for rows.Next() {
+		var attempt models.FailedLoginAttempt
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.Action,
+			&attempt.Identifier,
+			&attempt.IPAddress,
+			&attempt.UserAgent,
+			&attempt.Reason,
+			&attempt.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan failed login attempt: %w", err)
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, nil
+}
@@ -22,8 +22,9 @@ func NewMessageRepository(db *database.DB) *MessageRepository {
 // Create creates a new message in the database
 func (r *MessageRepository) Create(message *models.Message) error {
 	query := `
-		INSERT INTO messages (id, sender_id, recipient_id, content, message_type, media_url, media_filename, media_size, delivery_status, created_at, updated_at, is_broadcast)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		INSERT INTO messages (id, sender_id, recipient_id, content, message_type, attachment_id, media_url, media_filename, media_size,
+		                      media_width, media_height, media_thumbnail_url, media_medium_url, delivery_status, created_at, updated_at, is_broadcast)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 	`
 
 	_, err := r.db.Exec(query,
@@ -32,9 +33,14 @@ func (r *MessageRepository) Create(message *models.Message) error {
 		message.RecipientID,
 		message.Content,
 		message.MessageType,
+		message.AttachmentID,
 		message.MediaURL,
 		message.MediaFilename,
 		message.MediaSize,
+		message.MediaWidth,
+		message.MediaHeight,
+		message.ThumbnailURL,
+		message.MediumURL,
 		message.DeliveryStatus,
 		message.CreatedAt,
 		message.UpdatedAt,
@@ -51,7 +57,8 @@ func (r *MessageRepository) Create(message *models.Message) error {
 // GetByID retrieves a message by its ID
 func (r *MessageRepository) GetByID(id uuid.UUID) (*models.Message, error) {
 	query := `
-		SELECT id, sender_id, recipient_id, content, message_type, media_url, media_filename, media_size, delivery_status, created_at, updated_at, is_broadcast
+		SELECT id, sender_id, recipient_id, content, message_type, attachment_id, media_url, media_filename, media_size,
+		       media_width, media_height, media_thumbnail_url, media_medium_url, delivery_status, created_at, updated_at, is_broadcast
 		FROM messages WHERE id = $1
 	`
 
@@ -62,9 +69,14 @@ func (r *MessageRepository) GetByID(id uuid.UUID) (*models.Message, error) {
 		&message.RecipientID,
 		&message.Content,
 		&message.MessageType,
+		&message.AttachmentID,
 		&message.MediaURL,
 		&message.MediaFilename,
 		&message.MediaSize,
+		&message.MediaWidth,
+		&message.MediaHeight,
+		&message.ThumbnailURL,
+		&message.MediumURL,
 		&message.DeliveryStatus,
 		&message.CreatedAt,
 		&message.UpdatedAt,
@@ -101,8 +113,9 @@ func (r *MessageRepository) GetChatHistory(userID1, userID2 uuid.UUID, page, lim
 
 	// Get messages
 	query := `
-		SELECT m.id, m.sender_id, u.username, m.recipient_id, m.content, m.message_type, 
-		       m.media_url, m.media_filename, m.media_size, m.delivery_status, m.created_at, m.is_broadcast
+		SELECT m.id, m.sender_id, u.username, m.recipient_id, m.content, m.message_type, m.attachment_id,
+		       m.media_url, m.media_filename, m.media_size, m.media_width, m.media_height, m.media_thumbnail_url, m.media_medium_url,
+		       m.delivery_status, m.created_at, m.is_broadcast
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
 		WHERE ((m.sender_id = $1 AND m.recipient_id = $2) OR (m.sender_id = $2 AND m.recipient_id = $1))
@@ -127,9 +140,14 @@ func (r *MessageRepository) GetChatHistory(userID1, userID2 uuid.UUID, page, lim
 			&msg.RecipientID,
 			&msg.Content,
 			&msg.MessageType,
+			&msg.AttachmentID,
 			&msg.MediaURL,
 			&msg.MediaFilename,
 			&msg.MediaSize,
+			&msg.MediaWidth,
+			&msg.MediaHeight,
+			&msg.ThumbnailURL,
+			&msg.MediumURL,
 			&msg.DeliveryStatus,
 			&msg.CreatedAt,
 			&msg.IsBroadcast,
@@ -162,8 +180,9 @@ func (r *MessageRepository) GetUserMessages(userID uuid.UUID, page, limit int) (
 
 	// Get messages
 	query := `
-		SELECT DISTINCT m.id, m.sender_id, u.username, m.recipient_id, m.content, m.message_type, 
-		       m.media_url, m.media_filename, m.media_size, m.delivery_status, m.created_at, m.is_broadcast
+		SELECT DISTINCT m.id, m.sender_id, u.username, m.recipient_id, m.content, m.message_type, m.attachment_id,
+		       m.media_url, m.media_filename, m.media_size, m.media_width, m.media_height, m.media_thumbnail_url, m.media_medium_url,
+		       m.delivery_status, m.created_at, m.is_broadcast
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
 		LEFT JOIN broadcast_messages bm ON m.id = bm.message_id
@@ -188,9 +207,14 @@ func (r *MessageRepository) GetUserMessages(userID uuid.UUID, page, limit int) (
 			&msg.RecipientID,
 			&msg.Content,
 			&msg.MessageType,
+			&msg.AttachmentID,
 			&msg.MediaURL,
 			&msg.MediaFilename,
 			&msg.MediaSize,
+			&msg.MediaWidth,
+			&msg.MediaHeight,
+			&msg.ThumbnailURL,
+			&msg.MediumURL,
 			&msg.DeliveryStatus,
 			&msg.CreatedAt,
 			&msg.IsBroadcast,
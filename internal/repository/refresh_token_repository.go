@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+type RefreshTokenRepository struct {
+	db *database.DB
+}
+
+func NewRefreshTokenRepository(db *database.DB) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+// Create stores a new refresh token
+func (r *RefreshTokenRepository) Create(token *models.RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at, mfa)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := r.db.Exec(query,
+		token.ID,
+		token.UserID,
+		token.FamilyID,
+		token.TokenHash,
+		token.ExpiresAt,
+		token.CreatedAt,
+		token.MFA,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// GetByHash retrieves a refresh token by the hash of its value
+func (r *RefreshTokenRepository) GetByHash(tokenHash string) (*models.RefreshToken, error) {
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, created_at, used_at, replaced_by, revoked_at, mfa
+		FROM refresh_tokens WHERE token_hash = $1
+	`
+
+	token := &models.RefreshToken{}
+	err := r.db.QueryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+		&token.UsedAt,
+		&token.ReplacedBy,
+		&token.RevokedAt,
+		&token.MFA,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("refresh token not found")
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	return token, nil
+}
+
+// MarkUsed marks a refresh token as rotated into replacedBy. It reports
+// false if the token had already been used or revoked, so only one of
+// several concurrent rotations can succeed.
+func (r *RefreshTokenRepository) MarkUsed(id, replacedBy uuid.UUID) (bool, error) {
+	query := `
+		UPDATE refresh_tokens
+		SET used_at = $1, replaced_by = $2
+		WHERE id = $3 AND used_at IS NULL AND revoked_at IS NULL
+	`
+
+	result, err := r.db.Exec(query, time.Now(), replacedBy, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark refresh token as used: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark refresh token as used: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// RevokeFamily revokes every token descended from the same login
+func (r *RefreshTokenRepository) RevokeFamily(familyID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $1
+		WHERE family_id = $2 AND revoked_at IS NULL
+	`
+
+	_, err := r.db.Exec(query, time.Now(), familyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token family: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAllForUser revokes every refresh token of a user
+func (r *RefreshTokenRepository) RevokeAllForUser(userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $1
+		WHERE user_id = $2 AND revoked_at IS NULL
+	`
+
+	_, err := r.db.Exec(query, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeOtherFamilies revokes the refresh tokens of every session of a user
+// except one, and returns the IDs of the sessions that were still active
+func (r *RefreshTokenRepository) RevokeOtherFamilies(userID, keepFamilyID uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $1
+		WHERE user_id = $2 AND family_id <> $3 AND revoked_at IS NULL
+		RETURNING family_id
+	`
+
+	rows, err := r.db.Query(query, time.Now(), userID, keepFamilyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[uuid.UUID]bool)
+	var familyIDs []uuid.UUID
+	for rows.Next() {
+		var familyID uuid.UUID
+		if err := rows.Scan(&familyID); err != nil {
+			return nil, fmt.Errorf("failed to scan refresh token family: %w", err)
+		}
+		if !seen[familyID] {
+			seen[familyID] = true
+			familyIDs = append(familyIDs, familyID)
+		}
+	}
+
+	return familyIDs, rows.Err()
+}
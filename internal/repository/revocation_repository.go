@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+
+	"github.com/google/uuid"
+)
+
+// RevocationRepository is the PostgreSQL implementation of auth.RevocationStore
+type RevocationRepository struct {
+	db *database.DB
+}
+
+func NewRevocationRepository(db *database.DB) *RevocationRepository {
+	return &RevocationRepository{db: db}
+}
+
+var _ auth.RevocationStore = (*RevocationRepository)(nil)
+
+// Revoke revokes a token ID or session ID until it would have expired anyway
+func (r *RevocationRepository) Revoke(userID uuid.UUID, id string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO token_revocations (token_id, user_id, expires_at, revoked_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token_id) DO UPDATE SET expires_at = GREATEST(token_revocations.expires_at, EXCLUDED.expires_at)
+	`
+
+	_, err := r.db.Exec(query, id, userID, expiresAt, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	// Revocations are only needed until the token expires
+	if _, err := r.db.Exec(`DELETE FROM token_revocations WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("failed to delete expired revocations: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAllForUser revokes every token issued to a user so far, by
+// starting a new token generation. Users start at generation 0.
+func (r *RevocationRepository) RevokeAllForUser(userID uuid.UUID) error {
+	query := `
+		INSERT INTO user_token_revocations (user_id, revoked_before, generation)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (user_id) DO UPDATE
+		SET revoked_before = EXCLUDED.revoked_before, generation = user_token_revocations.generation + 1
+	`
+
+	_, err := r.db.Exec(query, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+
+	return nil
+}
+
+// TokenGeneration returns the current token generation of a user
+func (r *RevocationRepository) TokenGeneration(userID uuid.UUID) (int64, error) {
+	var generation int64
+	err := r.db.QueryRow(`SELECT generation FROM user_token_revocations WHERE user_id = $1`, userID).Scan(&generation)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get token generation: %w", err)
+	}
+
+	return generation, nil
+}
+
+// IsRevoked reports whether the token, its session or all of the user's
+// tokens have been revoked
+func (r *RevocationRepository) IsRevoked(claims *auth.Claims) (bool, error) {
+	query := `
+		SELECT EXISTS(SELECT 1 FROM token_revocations WHERE token_id IN ($1, $2) AND expires_at > NOW())
+		    OR EXISTS(SELECT 1 FROM user_token_revocations WHERE user_id = $3 AND generation > $4)
+	`
+
+	var revoked bool
+	err := r.db.QueryRow(query, claims.ID, claims.SessionID.String(), claims.UserID, claims.Generation).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/database"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+type TwoFactorRepository struct {
+	db *database.DB
+}
+
+func NewTwoFactorRepository(db *database.DB) *TwoFactorRepository {
+	return &TwoFactorRepository{db: db}
+}
+
+// GetByUserID retrieves a user's TOTP enrollment, or nil if there is none
+func (r *TwoFactorRepository) GetByUserID(userID uuid.UUID) (*models.TwoFactor, error) {
+	query := `
+		SELECT user_id, secret, confirmed_at, last_used_step, failed_attempts, locked_until, created_at
+		FROM user_two_factor WHERE user_id = $1
+	`
+
+	twoFactor := &models.TwoFactor{}
+	err := r.db.QueryRow(query, userID).Scan(
+		&twoFactor.UserID,
+		&twoFactor.Secret,
+		&twoFactor.ConfirmedAt,
+		&twoFactor.LastUsedStep,
+		&twoFactor.FailedAttempts,
+		&twoFactor.LockedUntil,
+		&twoFactor.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get two-factor enrollment: %w", err)
+	}
+
+	return twoFactor, nil
+}
+
+// SavePending stores a new unconfirmed secret, replacing any earlier
+// unconfirmed one. Confirmed enrollments are left untouched.
+func (r *TwoFactorRepository) SavePending(userID uuid.UUID, secret string) error {
+	query := `
+		INSERT INTO user_two_factor (user_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_used_step = 0,
+		    failed_attempts = 0, locked_until = NULL
+		WHERE user_two_factor.confirmed_at IS NULL
+	`
+
+	_, err := r.db.Exec(query, userID, secret, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save two-factor secret: %w", err)
+	}
+
+	return nil
+}
+
+// Confirm enables the enrollment and replaces the recovery codes
+func (r *TwoFactorRepository) Confirm(userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE user_two_factor
+		SET confirmed_at = $1, last_used_step = $2, failed_attempts = 0, locked_until = NULL
+		WHERE user_id = $3
+	`, time.Now(), step, userID)
+	if err != nil {
+		return fmt.Errorf("failed to confirm two-factor enrollment: %w", err)
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records the time step of an accepted code. It reports false if a
+// code of that or a later step was already accepted, so a code can only be
+// used once even by concurrent requests.
+func (r *TwoFactorRepository) UseStep(userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE user_two_factor
+		SET last_used_step = $1, failed_attempts = 0, locked_until = NULL
+		WHERE user_id = $2 AND last_used_step < $1
+	`
+
+	result, err := r.db.Exec(query, step, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to record two-factor code: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record two-factor code: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// RecordFailure counts a wrong code and locks verification until lockUntil
+// once maxAttempts is reached
+func (r *TwoFactorRepository) RecordFailure(userID uuid.UUID, maxAttempts int, lockUntil time.Time) error {
+	query := `
+		UPDATE user_two_factor
+		SET failed_attempts = failed_attempts + 1,
+		    locked_until = CASE WHEN failed_attempts + 1 >= $1 THEN $2 ELSE locked_until END
+		WHERE user_id = $3
+	`
+
+	_, err := r.db.Exec(query, maxAttempts, lockUntil, userID)
+	if err != nil {
+		return fmt.Errorf("failed to record two-factor failure: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes a user's enrollment and recovery codes
+func (r *TwoFactorRepository) Delete(userID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM two_factor_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM user_two_factor WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete two-factor enrollment: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes with new ones
+func (r *TwoFactorRepository) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes an unused recovery code and reports whether one
+// matched
+func (r *TwoFactorRepository) UseRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+		UPDATE two_factor_recovery_codes
+		SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+	`
+
+	result, err := r.db.Exec(query, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	return rows == 1, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (r *TwoFactorRepository) CountRecoveryCodes(userID uuid.UUID) (int, error) {
+	query := `SELECT COUNT(*) FROM two_factor_recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+
+	var count int
+	if err := r.db.QueryRow(query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+
+	return count, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM two_factor_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	for _, hash := range codeHashes {
+		_, err := tx.Exec(`
+			INSERT INTO two_factor_recovery_codes (id, user_id, code_hash, created_at)
+			VALUES ($1, $2, $3, $4)
+		`, uuid.New(), userID, hash, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	return nil
+}
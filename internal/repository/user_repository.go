@@ -11,6 +11,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// Columns read by every user query, in the order scanUser expects them
+const userColumns = `id, username, email, password_hash, created_at, updated_at, is_online, last_seen, email_verified_at, role, is_bot, owner_id, storage_quota`
+
 type UserRepository struct {
 	db *database.DB
 }
@@ -19,11 +22,41 @@ func NewUserRepository(db *database.DB) *UserRepository {
 	return &UserRepository{db: db}
 }
 
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans a row selected with userColumns
+func scanUser(row rowScanner) (*models.User, error) {
+	user := &models.User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Password,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsOnline,
+		&user.LastSeen,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.IsBot,
+		&user.OwnerID,
+		&user.StorageQuota,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 // Create creates a new user in the database
 func (r *UserRepository) Create(user *models.User) error {
 	query := `
-		INSERT INTO users (id, username, email, password_hash, created_at, updated_at, is_online, last_seen)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO users (id, username, email, password_hash, created_at, updated_at, is_online, last_seen, email_verified_at, role, is_bot, owner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 	`
 
 	_, err := r.db.Exec(query,
@@ -35,6 +68,10 @@ func (r *UserRepository) Create(user *models.User) error {
 		user.UpdatedAt,
 		user.IsOnline,
 		user.LastSeen,
+		user.EmailVerifiedAt,
+		user.Role,
+		user.IsBot,
+		user.OwnerID,
 	)
 
 	if err != nil {
@@ -46,23 +83,9 @@ func (r *UserRepository) Create(user *models.User) error {
 
 // GetByID retrieves a user by their ID
 func (r *UserRepository) GetByID(id uuid.UUID) (*models.User, error) {
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at, is_online, last_seen
-		FROM users WHERE id = $1
-	`
-
-	user := &models.User{}
-	err := r.db.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Password,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.IsOnline,
-		&user.LastSeen,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
 
+	user, err := scanUser(r.db.QueryRow(query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -75,23 +98,9 @@ func (r *UserRepository) GetByID(id uuid.UUID) (*models.User, error) {
 
 // GetByEmail retrieves a user by their email
 func (r *UserRepository) GetByEmail(email string) (*models.User, error) {
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at, is_online, last_seen
-		FROM users WHERE email = $1
-	`
-
-	user := &models.User{}
-	err := r.db.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Password,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.IsOnline,
-		&user.LastSeen,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
 
+	user, err := scanUser(r.db.QueryRow(query, email))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -104,23 +113,9 @@ func (r *UserRepository) GetByEmail(email string) (*models.User, error) {
 
 // GetByUsername retrieves a user by their username
 func (r *UserRepository) GetByUsername(username string) (*models.User, error) {
-	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at, is_online, last_seen
-		FROM users WHERE username = $1
-	`
-
-	user := &models.User{}
-	err := r.db.QueryRow(query, username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Password,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.IsOnline,
-		&user.LastSeen,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
 
+	user, err := scanUser(r.db.QueryRow(query, username))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -134,7 +129,7 @@ func (r *UserRepository) GetByUsername(username string) (*models.User, error) {
 // UpdateOnlineStatus updates a user's online status and last seen time
 func (r *UserRepository) UpdateOnlineStatus(userID uuid.UUID, isOnline bool) error {
 	query := `
-		UPDATE users 
+		UPDATE users
 		SET is_online = $1, last_seen = $2, updated_at = $3
 		WHERE id = $4
 	`
@@ -148,13 +143,91 @@ func (r *UserRepository) UpdateOnlineStatus(userID uuid.UUID, isOnline bool) err
 	return nil
 }
 
-// GetAllUsers retrieves all users (for listing purposes)
-func (r *UserRepository) GetAllUsers() ([]models.User, error) {
+// MarkEmailVerified records that the user proved control of their email address
+func (r *UserRepository) MarkEmailVerified(userID uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, $1), updated_at = $1
+		WHERE id = $2
+	`
+
+	_, err := r.db.Exec(query, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark email as verified: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces a user's password hash
+func (r *UserRepository) UpdatePassword(userID uuid.UUID, passwordHash string) error {
+	query := `
+		UPDATE users
+		SET password_hash = $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	_, err := r.db.Exec(query, passwordHash, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateRole changes a user's role
+func (r *UserRepository) UpdateRole(userID uuid.UUID, role models.Role) error {
+	query := `
+		UPDATE users
+		SET role = $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	result, err := r.db.Exec(query, role, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// UpdateStorageQuota sets the storage quota of a user, or clears it with nil
+// so the quota of their role applies
+func (r *UserRepository) UpdateStorageQuota(userID uuid.UUID, quota *int64) error {
 	query := `
-		SELECT id, username, email, password_hash, created_at, updated_at, is_online, last_seen
-		FROM users ORDER BY username
+		UPDATE users
+		SET storage_quota = $1, updated_at = $2
+		WHERE id = $3
 	`
 
+	result, err := r.db.Exec(query, quota, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to update storage quota: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update storage quota: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// GetAllUsers retrieves all users (for listing purposes)
+func (r *UserRepository) GetAllUsers() ([]models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username`
+
 	rows, err := r.db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all users: %w", err)
@@ -163,26 +236,38 @@ func (r *UserRepository) GetAllUsers() ([]models.User, error) {
 
 	var users []models.User
 	for rows.Next() {
-		var user models.User
-		err := rows.Scan(
-			&user.ID,
-			&user.Username,
-			&user.Email,
-			&user.Password,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-			&user.IsOnline,
-			&user.LastSeen,
-		)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
 		}
-		users = append(users, user)
+		users = append(users, *user)
 	}
 
 	return users, nil
 }
 
+// GetBotsByOwner retrieves the bots owned by a user
+func (r *UserRepository) GetBotsByOwner(ownerID uuid.UUID) ([]models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE is_bot AND owner_id = $1 ORDER BY username`
+
+	rows, err := r.db.Query(query, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bots: %w", err)
+	}
+	defer rows.Close()
+
+	var bots []models.User
+	for rows.Next() {
+		bot, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan bot: %w", err)
+		}
+		bots = append(bots, *bot)
+	}
+
+	return bots, nil
+}
+
 // EmailExists checks if an email is already taken
 func (r *UserRepository) EmailExists(email string) (bool, error) {
 	query := `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`
@@ -0,0 +1,108 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Size of the chunks streamed to clamd, well under its default StreamMaxLength
+const clamdChunkSize = 64 * 1024
+
+// ClamdScanner streams files to a ClamAV daemon over its TCP socket with the
+// INSTREAM command. Files larger than the daemon's StreamMaxLength cannot be
+// scanned.
+type ClamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner creates a scanner for the clamd listening on address
+// (host:port). Each scan, connection included, is limited to timeout.
+func NewClamdScanner(address string, timeout time.Duration) *ClamdScanner {
+	return &ClamdScanner{address: address, timeout: timeout}
+}
+
+// Scan sends r to clamd and parses its verdict
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock reads and writes once the context is done
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// clamd stops reading and replies with an error when the stream is too
+	// large, so the reply is read even if sending fails
+	sendErr := sendStream(conn, r)
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		return nil, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+
+	return parseClamdReply(reply)
+}
+
+// sendStream sends the INSTREAM command with r as chunks prefixed with their
+// length, ended by an empty chunk
+func sendStream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("failed to send to clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file to scan: %w", err)
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	return nil
+}
+
+// parseClamdReply reads a reply such as "stream: OK", "stream: <signature>
+// FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) (*Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	verdict := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case verdict == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd failed to scan: %s", reply)
+	}
+}
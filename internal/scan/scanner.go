@@ -0,0 +1,42 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+)
+
+// Result is the verdict of a scanner on some content
+type Result struct {
+	Infected  bool
+	Signature string // Name of the malware found, if any
+}
+
+// Scanner looks for malware in uploaded files
+type Scanner interface {
+	// Scan reads r to the end and reports what was found in it. An error
+	// means the content could not be scanned, not that it is infected.
+	Scan(ctx context.Context, r io.Reader) (*Result, error)
+}
+
+// NewScanner creates the scanner selected by the configuration
+func NewScanner(cfg *config.ScanConfig) (Scanner, error) {
+	switch cfg.Driver {
+	case "clamd":
+		return NewClamdScanner(cfg.ClamdAddress, cfg.Timeout), nil
+	case "none", "":
+		return NopScanner{}, nil
+	default:
+		return nil, fmt.Errorf("unknown upload scanner %q, use clamd or none", cfg.Driver)
+	}
+}
+
+// NopScanner finds every file clean, for deployments without a virus scanner
+type NopScanner struct{}
+
+// Scan reports r as clean without reading it
+func (NopScanner) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	return &Result{}, nil
+}
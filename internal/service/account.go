@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/mail"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/pkg/utils"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidEmailToken is returned for invalid, expired or outdated
+	// verification and password reset tokens
+	ErrInvalidEmailToken = errors.New("invalid or expired link")
+)
+
+// RequestEmailVerification sends a new verification link. Unknown and
+// already verified addresses are ignored, so the response does not reveal
+// which emails have accounts.
+func (s *UserService) RequestEmailVerification(email string) {
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil || user.EmailVerified() {
+		return
+	}
+
+	s.sendVerificationEmail(user)
+}
+
+// VerifyEmail marks the email address a verification link was sent to as
+// verified
+func (s *UserService) VerifyEmail(token string) (*models.UserResponse, error) {
+	userID, fingerprint, err := s.jwtManager.ValidateActionToken(token, auth.ActionVerifyEmail)
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	// The link is only valid for the address it was sent to
+	if fingerprint != tokenFingerprint(user.Email) {
+		return nil, ErrInvalidEmailToken
+	}
+
+	if err := s.userRepo.MarkEmailVerified(user.ID); err != nil {
+		return nil, err
+	}
+
+	user, err = s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	response := user.ToResponse()
+	return &response, nil
+}
+
+// RequestPasswordReset sends a password reset link. Unknown addresses are
+// ignored, so the response does not reveal which emails have accounts.
+func (s *UserService) RequestPasswordReset(email string) {
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		return
+	}
+
+	// Binding the token to the current hash makes it single-use: it stops
+	// working as soon as the password changes
+	token, _, err := s.jwtManager.GenerateActionToken(auth.ActionResetPassword, user.ID, tokenFingerprint(user.Password), s.account.PasswordResetTTL)
+	if err != nil {
+		log.Printf("Failed to generate password reset token for user %s: %v", user.ID, err)
+		return
+	}
+
+	s.sendEmail(&mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your Twerlo Chat account. "+
+			"Open this link to choose a new one:\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask for it, you can ignore this email.\n",
+			user.Username, s.link("reset_password", token), s.account.PasswordResetTTL),
+	})
+}
+
+// ResetPassword sets a new password with a reset link and ends every session
+// of the user. Receiving the link also proves control of the email address.
+func (s *UserService) ResetPassword(token, password string) (uuid.UUID, error) {
+	userID, fingerprint, err := s.jwtManager.ValidateActionToken(token, auth.ActionResetPassword)
+	if err != nil {
+		return uuid.Nil, ErrInvalidEmailToken
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return uuid.Nil, ErrInvalidEmailToken
+	}
+
+	if fingerprint != tokenFingerprint(user.Password) {
+		return uuid.Nil, ErrInvalidEmailToken
+	}
+
+	if err := s.passwordPolicy.Validate(password); err != nil {
+		return uuid.Nil, err
+	}
+
+	hashedPassword, err := s.hasher.Hash(password)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := s.userRepo.UpdatePassword(user.ID, hashedPassword); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := s.userRepo.MarkEmailVerified(user.ID); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := s.LogoutEverywhere(user.ID); err != nil {
+		return uuid.Nil, err
+	}
+
+	log.Printf("Password reset for user %s", user.ID)
+	return user.ID, nil
+}
+
+// sendVerificationEmail sends a link that verifies the user's email address
+func (s *UserService) sendVerificationEmail(user *models.User) {
+	token, _, err := s.jwtManager.GenerateActionToken(auth.ActionVerifyEmail, user.ID, tokenFingerprint(user.Email), s.account.EmailVerificationTTL)
+	if err != nil {
+		log.Printf("Failed to generate email verification token for user %s: %v", user.ID, err)
+		return
+	}
+
+	s.sendEmail(&mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm that this is your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s.\n",
+			user.Username, s.link("verify_email", token), s.account.EmailVerificationTTL),
+	})
+}
+
+// sendEmail sends a message in the background, SMTP servers can be slow
+func (s *UserService) sendEmail(msg *mail.Message) {
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			log.Printf("Failed to send %q email to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// link builds a link to the web interface carrying a token
+func (s *UserService) link(param, token string) string {
+	return s.baseURL + "/?" + url.Values{param: {token}}.Encode()
+}
+
+// tokenFingerprint identifies a value without revealing it
+func tokenFingerprint(value string) string {
+	return utils.HashToken(value)[:32]
+}
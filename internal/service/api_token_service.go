@@ -0,0 +1,324 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/repository"
+	"github.com/aelhady03/twerlo-chat-app/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// How often the last use of a token is written to the database
+const lastUsedResolution = time.Minute
+
+// Rate limit buckets refill within a minute, so the buckets of tokens idle
+// for longer are full and can be dropped without changing anything
+const bucketIdleTimeout = time.Minute
+
+var (
+	// ErrInvalidAPIToken is returned for unknown, revoked or expired tokens
+	ErrInvalidAPIToken = errors.New("invalid or expired API token")
+
+	// ErrAPITokenNotFound is returned when revoking a token the user did not create
+	ErrAPITokenNotFound = errors.New("API token not found")
+
+	// ErrInvalidScope is returned when creating a token without scopes or
+	// with unknown ones
+	ErrInvalidScope = errors.New("invalid scope")
+
+	// ErrInvalidRateLimit is returned for rate limits outside the allowed range
+	ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+	// ErrBotNotFound is returned for bots that do not exist or belong to
+	// someone else
+	ErrBotNotFound = errors.New("bot not found")
+
+	// ErrBotLimitReached is returned when a user already owns the maximum
+	// number of bots
+	ErrBotLimitReached = errors.New("bot limit reached")
+)
+
+type APITokenService struct {
+	tokenRepo *repository.APITokenRepository
+	userRepo  *repository.UserRepository
+	config    *config.APITokenConfig
+
+	mu      sync.Mutex
+	buckets map[uuid.UUID]*tokenBucket
+}
+
+func NewAPITokenService(tokenRepo *repository.APITokenRepository, userRepo *repository.UserRepository, cfg *config.APITokenConfig) *APITokenService {
+	return &APITokenService{
+		tokenRepo: tokenRepo,
+		userRepo:  userRepo,
+		config:    cfg,
+		buckets:   make(map[uuid.UUID]*tokenBucket),
+	}
+}
+
+var _ auth.APITokenAuthenticator = (*APITokenService)(nil)
+
+// CreateBot creates a bot user owned by ownerID. Bots cannot log in, they
+// act through tokens their owner creates for them.
+func (s *APITokenService) CreateBot(ownerID uuid.UUID, username string) (*models.UserResponse, error) {
+	bots, err := s.userRepo.GetBotsByOwner(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(bots) >= s.config.MaxBotsPerUser {
+		return nil, ErrBotLimitReached
+	}
+
+	usernameExists, err := s.userRepo.UsernameExists(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check username existence: %w", err)
+	}
+	if usernameExists {
+		return nil, fmt.Errorf("username already exists")
+	}
+
+	now := time.Now()
+	id := uuid.New()
+	bot := &models.User{
+		ID:       id,
+		Username: username,
+		// Emails are unique and required, .invalid never receives mail
+		Email:           fmt.Sprintf("bot-%s@bots.invalid", id),
+		Password:        "",
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		IsOnline:        false,
+		LastSeen:        now,
+		Role:            models.RoleUser,
+		IsBot:           true,
+		OwnerID:         &ownerID,
+		EmailVerifiedAt: &now,
+	}
+
+	if err := s.userRepo.Create(bot); err != nil {
+		return nil, fmt.Errorf("failed to create bot: %w", err)
+	}
+
+	log.Printf("Bot %s (%s) created by user %s", bot.Username, bot.ID, ownerID)
+
+	response := bot.ToResponse()
+	return &response, nil
+}
+
+// GetBots retrieves the bots owned by a user
+func (s *APITokenService) GetBots(ownerID uuid.UUID) ([]models.UserResponse, error) {
+	bots, err := s.userRepo.GetBotsByOwner(ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := []models.UserResponse{}
+	for _, bot := range bots {
+		responses = append(responses, bot.ToResponse())
+	}
+
+	return responses, nil
+}
+
+// CreateToken creates a personal access token for the creator or one of
+// their bots. The token is only returned this once, only its hash is stored.
+func (s *APITokenService) CreateToken(creatorID uuid.UUID, req *models.CreateAPITokenRequest) (*models.CreateAPITokenResponse, error) {
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !models.ValidScope(scope) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+
+	rateLimit := req.RateLimit
+	if rateLimit == 0 {
+		rateLimit = s.config.DefaultRateLimit
+	}
+	if rateLimit < 1 || rateLimit > s.config.MaxRateLimit {
+		return nil, ErrInvalidRateLimit
+	}
+
+	userID := creatorID
+	if req.BotID != nil {
+		bot, err := s.userRepo.GetByID(*req.BotID)
+		if err != nil || !bot.IsBot || bot.OwnerID == nil || *bot.OwnerID != creatorID {
+			return nil, ErrBotNotFound
+		}
+		userID = bot.ID
+	}
+
+	secret, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate API token: %w", err)
+	}
+	secret = auth.APITokenPrefix + secret
+
+	now := time.Now()
+	token := &models.APIToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		CreatedBy: creatorID,
+		Name:      req.Name,
+		Prefix:    secret[:len(auth.APITokenPrefix)+8],
+		TokenHash: utils.HashToken(secret),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+		CreatedAt: now,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, req.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := s.tokenRepo.Create(token); err != nil {
+		return nil, err
+	}
+
+	return &models.CreateAPITokenResponse{
+		Token:    secret,
+		APIToken: token,
+	}, nil
+}
+
+// GetTokens retrieves the tokens a user created, including revoked ones
+func (s *APITokenService) GetTokens(userID uuid.UUID) ([]models.APIToken, error) {
+	return s.tokenRepo.GetByCreator(userID)
+}
+
+// RevokeToken revokes a token the user created
+func (s *APITokenService) RevokeToken(userID, tokenID uuid.UUID) error {
+	revoked, err := s.tokenRepo.Revoke(tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrAPITokenNotFound
+	}
+
+	s.mu.Lock()
+	delete(s.buckets, tokenID)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// AuthenticateAPIToken returns the claims of a personal access token. The
+// claims count as two-factor, creating tokens requires a full session.
+func (s *APITokenService) AuthenticateAPIToken(secret string) (*auth.Claims, error) {
+	token, err := s.tokenRepo.GetByHash(utils.HashToken(secret))
+	if err != nil {
+		return nil, ErrInvalidAPIToken
+	}
+
+	now := time.Now()
+	if token.RevokedAt != nil || (token.ExpiresAt != nil && now.After(*token.ExpiresAt)) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	if wait := s.take(token, now); wait > 0 {
+		return nil, &auth.RateLimitError{RetryAfter: wait}
+	}
+
+	user, err := s.userRepo.GetByID(token.UserID)
+	if err != nil {
+		return nil, ErrInvalidAPIToken
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedResolution {
+		if err := s.tokenRepo.TouchLastUsed(token.ID, now); err != nil {
+			log.Printf("Failed to record use of API token %s: %v", token.ID, err)
+		}
+	}
+
+	return &auth.Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Role:     user.Role,
+		MFA:      true,
+		APIToken: true,
+		Scopes:   token.Scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:      token.ID.String(),
+			Subject: user.ID.String(),
+		},
+	}, nil
+}
+
+// take consumes a request from the token's rate limit and returns how long
+// to wait if none is left
+func (s *APITokenService) take(token *models.APIToken, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[token.ID]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(token.RateLimit), last: now}
+		s.buckets[token.ID] = bucket
+	}
+
+	return bucket.take(float64(token.RateLimit), now)
+}
+
+// SweepBuckets drops the rate limit buckets of tokens idle for
+// bucketIdleTimeout, and returns how many were dropped
+func (s *APITokenService) SweepBuckets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-bucketIdleTimeout)
+	removed := 0
+	for id, bucket := range s.buckets {
+		if bucket.last.Before(cutoff) {
+			delete(s.buckets, id)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// RunBucketSweeper drops idle rate limit buckets every interval, forever
+func (s *APITokenService) RunBucketSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.SweepBuckets()
+	}
+}
+
+// tokenBucket allows a minute's worth of requests at once and refills
+// evenly over the minute
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // Last use, when the bucket was refilled
+}
+
+// take consumes a token and returns zero, or how long until one is available
+func (b *tokenBucket) take(perMinute float64, now time.Time) time.Duration {
+	rate := perMinute / 60
+	b.tokens = min(perMinute, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+)
+
+// Pending attachments scanned again per run of the scanner
+const pendingBatchSize = 100
+
+var (
+	// ErrMalwareDetected is returned for uploads in which the scanner found
+	// malware
+	ErrMalwareDetected = errors.New("malware detected")
+
+	// ErrAttachmentPending is returned when sending an attachment that was
+	// not scanned yet
+	ErrAttachmentPending = errors.New("attachment is still being scanned")
+)
+
+// scan scans the content of a pending attachment and records the verdict.
+// Infected attachments lose their files at once, and are kept as infected
+// until swept so their uploader can learn why.
+func (s *AttachmentService) scan(ctx context.Context, attachment *models.Attachment, content io.Reader) error {
+	result, err := s.scanner.Scan(ctx, content)
+	if err != nil {
+		return fmt.Errorf("failed to scan attachment %s: %w", attachment.ID, err)
+	}
+
+	if !result.Infected {
+		updated, err := s.attachmentRepo.SetScanStatus(attachment.ID, models.AttachmentClean)
+		if err != nil {
+			return err
+		}
+		if updated {
+			attachment.Status = models.AttachmentClean
+		}
+		return nil
+	}
+
+	log.Printf("Malware %s found in attachment %s of user %s", result.Signature, attachment.ID, attachment.UploaderID)
+
+	// Only the first to record the verdict releases the blob. Attachments
+	// sharing it that were found clean before keep its files.
+	updated, err := s.attachmentRepo.SetScanStatus(attachment.ID, models.AttachmentInfected)
+	if err != nil {
+		return err
+	}
+	if updated {
+		s.releaseBlob(attachment)
+	}
+	attachment.Status = models.AttachmentInfected
+
+	return fmt.Errorf("%w: %s", ErrMalwareDetected, result.Signature)
+}
+
+// ScanPending scans again the attachments left pending by uploads whose scan
+// failed, and returns how many got a verdict. Attachments still being
+// scanned by their upload are left alone.
+func (s *AttachmentService) ScanPending() (int, error) {
+	pending, err := s.attachmentRepo.GetPending(time.Now().Add(-s.scanTimeout), pendingBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	scanned := 0
+	for i := range pending {
+		err := s.rescan(&pending[i])
+		if err != nil && !errors.Is(err, ErrMalwareDetected) {
+			log.Printf("Attachment %s still pending: %v", pending[i].ID, err)
+			continue
+		}
+		scanned++
+	}
+
+	return scanned, nil
+}
+
+// rescan scans a pending attachment from the blob store
+func (s *AttachmentService) rescan(attachment *models.Attachment) error {
+	ctx := context.Background()
+
+	content, _, err := s.store.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return fmt.Errorf("failed to read attachment %s: %w", attachment.ID, err)
+	}
+	defer content.Close()
+
+	return s.scan(ctx, attachment, content)
+}
+
+// RunScanner scans pending attachments every interval, forever
+func (s *AttachmentService) RunScanner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		scanned, err := s.ScanPending()
+		if err != nil {
+			log.Printf("Failed to scan pending attachments: %v", err)
+		}
+		if scanned > 0 {
+			log.Printf("Scanned %d pending attachments", scanned)
+		}
+	}
+}
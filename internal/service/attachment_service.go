@@ -0,0 +1,396 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/media"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/internal/repository"
+	"github.com/aelhady03/twerlo-chat-app/internal/scan"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Orphans deleted per query by the sweeper
+const orphanBatchSize = 100
+
+var (
+	// ErrUploadUnreadable is returned when the content of an upload cannot
+	// be read
+	ErrUploadUnreadable = errors.New("failed to read upload")
+
+	// ErrAttachmentNotFound is returned for attachments that do not exist or
+	// belong to someone else
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// AttachmentService stores uploads as attachments, links them to messages
+// and deletes those never sent. Files are stored once per content: every
+// attachment with the same content shares a blob, deleted with the last of
+// them. Each user may store up to the quota of their role, or their own.
+// Uploads stay pending, out of reach, until the scanner finds them clean.
+type AttachmentService struct {
+	attachmentRepo *repository.AttachmentRepository
+	blobRepo       *repository.BlobRepository
+	userRepo       *repository.UserRepository
+	store          storage.BlobStore
+	urlSigner      *storage.URLSigner
+	typeChecker    *media.TypeChecker
+	images         *media.ImageProcessor
+	scanner        scan.Scanner
+	scanTimeout    time.Duration
+	orphanGrace    time.Duration
+	roleQuotas     map[string]int64
+}
+
+func NewAttachmentService(attachmentRepo *repository.AttachmentRepository, blobRepo *repository.BlobRepository, userRepo *repository.UserRepository, store storage.BlobStore, urlSigner *storage.URLSigner, typeChecker *media.TypeChecker, scanner scan.Scanner, cfg *config.UploadConfig) *AttachmentService {
+	return &AttachmentService{
+		attachmentRepo: attachmentRepo,
+		blobRepo:       blobRepo,
+		userRepo:       userRepo,
+		store:          store,
+		urlSigner:      urlSigner,
+		typeChecker:    typeChecker,
+		images:         media.NewImageProcessor(cfg),
+		scanner:        scanner,
+		scanTimeout:    cfg.Scan.Timeout,
+		orphanGrace:    cfg.OrphanGrace,
+		roleQuotas:     cfg.RoleQuotas,
+	}
+}
+
+// Upload checks the type of a file and stores it under the hash of its
+// content, along with the variants of images. Content already stored is
+// only referenced again, but still counts against the uploader's quota.
+// The file is then scanned: infected files are deleted, and files that
+// could not be scanned are returned pending and scanned again later.
+func (s *AttachmentService) Upload(ctx context.Context, uploaderID uuid.UUID, name string, file io.ReadSeeker) (*models.Attachment, error) {
+	// Validate file type, by extension and by content
+	head := make([]byte, media.SniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("%w: %v", ErrUploadUnreadable, err)
+	}
+
+	fileType, err := s.typeChecker.Check(name, head[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUploadUnreadable, err)
+	}
+
+	// The original name is only kept by the attachment, the blob may be
+	// shared with other uploads
+	attachment := &models.Attachment{
+		ID:          uuid.New(),
+		UploaderID:  uploaderID,
+		Filename:    media.SanitizeFilename(name),
+		ContentType: fileType.ContentType,
+		Kind:        fileType.Kind,
+		Status:      models.AttachmentPending,
+		CreatedAt:   time.Now(),
+	}
+	meta := storage.Metadata{ContentType: fileType.ContentType}
+	body := file
+
+	// Images are stored without their metadata, and get resized variants
+	var variants []*media.EncodedImage
+	if s.images.Supports(fileType) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUploadUnreadable, err)
+		}
+
+		processed, err := s.images.Process(data, fileType)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(processed.Data)
+		variants = processed.Variants
+		attachment.Width, attachment.Height = &processed.Width, &processed.Height
+		meta.Width, meta.Height = processed.Width, processed.Height
+	}
+
+	// Content is stored under its hash
+	hash := sha256.New()
+	attachment.Size, err = io.Copy(hash, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUploadUnreadable, err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUploadUnreadable, err)
+	}
+	if err := s.CheckQuota(uploaderID, attachment.Size); err != nil {
+		return nil, err
+	}
+
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	attachment.StorageKey = blobKey(attachment.SHA256, fileType.Extension)
+	setVariantKeys(attachment, variants, &meta)
+
+	stored, err := s.blobRepo.Acquire(&models.Blob{
+		StorageKey:   attachment.StorageKey,
+		SHA256:       attachment.SHA256,
+		Size:         attachment.Size,
+		ThumbnailKey: attachment.ThumbnailKey,
+		MediumKey:    attachment.MediumKey,
+		CreatedAt:    attachment.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Content whose files are not stored yet, possibly because another
+	// upload of it is still storing them or failed to, is stored again
+	if !stored {
+		if err := s.storeBlob(ctx, attachment, body, variants, meta); err != nil {
+			s.releaseBlob(attachment)
+			return nil, fmt.Errorf("failed to store upload %s: %w", attachment.StorageKey, err)
+		}
+		if err := s.blobRepo.MarkStored(attachment.StorageKey); err != nil {
+			s.releaseBlob(attachment)
+			return nil, err
+		}
+	}
+
+	if err := s.attachmentRepo.Create(attachment); err != nil {
+		s.releaseBlob(attachment)
+		return nil, err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Failed to rewind attachment %s for scanning: %v", attachment.ID, err)
+		return attachment, nil
+	}
+	if err := s.scan(ctx, attachment, body); err != nil {
+		if errors.Is(err, ErrMalwareDetected) {
+			return nil, err
+		}
+		log.Printf("Attachment %s left pending: %v", attachment.ID, err)
+	}
+
+	return attachment, nil
+}
+
+// blobKey returns the storage key of content with the given hash, spread
+// over directories by the first two hex digits
+func blobKey(sha256Hex, extension string) string {
+	return fmt.Sprintf("blobs/%s/%s%s", sha256Hex[:2], sha256Hex, extension)
+}
+
+// setVariantKeys records the keys of the resized variants of an image in
+// its attachment and metadata. Images smaller than a variant serve as that
+// variant themselves.
+func setVariantKeys(attachment *models.Attachment, variants []*media.EncodedImage, meta *storage.Metadata) {
+	if attachment.Width == nil {
+		return
+	}
+
+	thumbnail, medium := attachment.StorageKey, attachment.StorageKey
+	for _, variant := range variants {
+		switch variant.Name {
+		case media.VariantThumbnail:
+			thumbnail = media.VariantKey(attachment.StorageKey, variant.Name, variant.Type.Extension)
+		case media.VariantMedium:
+			medium = media.VariantKey(attachment.StorageKey, variant.Name, variant.Type.Extension)
+		}
+	}
+
+	attachment.ThumbnailKey, attachment.MediumKey = &thumbnail, &medium
+	meta.Thumbnail, meta.Medium = thumbnail, medium
+}
+
+// storeBlob stores new content and the variants of images
+func (s *AttachmentService) storeBlob(ctx context.Context, attachment *models.Attachment, body io.Reader, variants []*media.EncodedImage, meta storage.Metadata) error {
+	for _, variant := range variants {
+		variantKey := media.VariantKey(attachment.StorageKey, variant.Name, variant.Type.Extension)
+		variantMeta := storage.Metadata{
+			ContentType: variant.Type.ContentType,
+			Width:       variant.Width,
+			Height:      variant.Height,
+		}
+
+		if err := s.store.Put(ctx, variantKey, bytes.NewReader(variant.Data), int64(len(variant.Data)), variantMeta); err != nil {
+			return err
+		}
+	}
+
+	return s.store.Put(ctx, attachment.StorageKey, body, attachment.Size, meta)
+}
+
+// Get retrieves an attachment of the given uploader
+func (s *AttachmentService) Get(uploaderID, attachmentID uuid.UUID) (*models.Attachment, error) {
+	attachment, err := s.attachmentRepo.GetByID(attachmentID)
+	if err != nil || attachment.UploaderID != uploaderID {
+		return nil, ErrAttachmentNotFound
+	}
+
+	return attachment, nil
+}
+
+// Attach looks up the attachment a message of senderID refers to, by ID or
+// by the URL of its file, and records that it was sent so it is not swept.
+// Attachments of other users cannot be sent. Returns nil when the message
+// has no attachment.
+func (s *AttachmentService) Attach(senderID uuid.UUID, attachmentID *uuid.UUID, mediaURL *string) (*models.Attachment, error) {
+	var attachment *models.Attachment
+	switch {
+	case attachmentID != nil:
+		var err error
+		attachment, err = s.Get(senderID, *attachmentID)
+		if err != nil {
+			return nil, err
+		}
+
+	case mediaURL != nil && *mediaURL != "":
+		key, ok := storage.KeyFromURL(*mediaURL)
+		if !ok {
+			return nil, ErrInvalidMediaURL
+		}
+
+		found, err := s.attachmentRepo.GetByStorageKey(key, senderID)
+		if err != nil {
+			return nil, ErrInvalidMediaURL
+		}
+		attachment = found
+
+	default:
+		return nil, nil
+	}
+
+	// Only clean attachments can be sent, and they stay clean
+	switch attachment.Status {
+	case models.AttachmentPending:
+		return nil, ErrAttachmentPending
+	case models.AttachmentInfected:
+		return nil, ErrMalwareDetected
+	}
+
+	// The sweeper may have deleted the attachment since it was looked up
+	attached, err := s.attachmentRepo.MarkAttached(attachment.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !attached {
+		return nil, ErrAttachmentNotFound
+	}
+
+	return attachment, nil
+}
+
+// UploadResponse describes an attachment to its uploader, with signed URLs
+// once it is clean
+func (s *AttachmentService) UploadResponse(attachment *models.Attachment) *models.UploadResponse {
+	response := &models.UploadResponse{
+		ID:          attachment.ID,
+		Filename:    attachment.Filename,
+		Size:        attachment.Size,
+		Type:        attachment.Kind,
+		ContentType: attachment.ContentType,
+		Status:      attachment.Status,
+	}
+	if attachment.Width != nil && attachment.Height != nil {
+		response.Width, response.Height = *attachment.Width, *attachment.Height
+	}
+	if attachment.Status != models.AttachmentClean {
+		return response
+	}
+
+	response.URL = s.urlSigner.SignNamed(attachment.StorageKey, attachment.Filename)
+	if attachment.ThumbnailKey != nil {
+		response.ThumbnailURL = s.urlSigner.Sign(*attachment.ThumbnailKey)
+	}
+	if attachment.MediumKey != nil {
+		response.MediumURL = s.urlSigner.Sign(*attachment.MediumKey)
+	}
+
+	return response
+}
+
+// SweepOrphans deletes attachments that were not sent in any message within
+// the grace period, and returns how many there were
+func (s *AttachmentService) SweepOrphans() (int, error) {
+	removed := 0
+	for {
+		orphans, err := s.attachmentRepo.GetOrphans(time.Now().Add(-s.orphanGrace), orphanBatchSize)
+		if err != nil {
+			return removed, err
+		}
+
+		for i := range orphans {
+			// Attachments sent meanwhile are kept
+			deleted, err := s.attachmentRepo.DeleteOrphan(&orphans[i])
+			if err != nil {
+				return removed, err
+			}
+			if deleted {
+				// Infected attachments released their blob when found
+				if orphans[i].Status != models.AttachmentInfected {
+					s.releaseBlob(&orphans[i])
+				}
+				removed++
+			}
+		}
+
+		if len(orphans) < orphanBatchSize {
+			return removed, nil
+		}
+	}
+}
+
+// RunOrphanSweeper deletes orphan attachments every interval, forever
+func (s *AttachmentService) RunOrphanSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := s.SweepOrphans()
+		if err != nil {
+			log.Printf("Failed to sweep orphan attachments: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Removed %d orphan attachments", removed)
+		}
+	}
+}
+
+// releaseBlob drops the reference of an attachment to its blob, and deletes
+// the blob's files if it was the last one. Failures are only logged, the
+// attachment is gone either way.
+func (s *AttachmentService) releaseBlob(attachment *models.Attachment) {
+	err := s.blobRepo.Release(attachment.StorageKey, func() {
+		s.deleteBlobFiles(attachment)
+	})
+	if err != nil {
+		log.Printf("Failed to release blob %s: %v", attachment.StorageKey, err)
+	}
+}
+
+// deleteBlobFiles deletes the files of a blob and its variants
+func (s *AttachmentService) deleteBlobFiles(attachment *models.Attachment) {
+	keys := []string{attachment.StorageKey}
+	for _, key := range []*string{attachment.ThumbnailKey, attachment.MediumKey} {
+		if key != nil && *key != attachment.StorageKey {
+			keys = append(keys, *key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := s.store.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
@@ -1,24 +1,36 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
 	"github.com/aelhady03/twerlo-chat-app/internal/repository"
+	"github.com/aelhady03/twerlo-chat-app/internal/storage"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrInvalidMediaURL is returned for media URLs that do not point at
+	// uploaded media
+	ErrInvalidMediaURL = errors.New("invalid media URL")
+)
+
 type MessageService struct {
-	messageRepo *repository.MessageRepository
-	userRepo    *repository.UserRepository
+	messageRepo       *repository.MessageRepository
+	userRepo          *repository.UserRepository
+	attachmentService *AttachmentService
+	urlSigner         *storage.URLSigner
 }
 
-func NewMessageService(messageRepo *repository.MessageRepository, userRepo *repository.UserRepository) *MessageService {
+func NewMessageService(messageRepo *repository.MessageRepository, userRepo *repository.UserRepository, attachmentService *AttachmentService, urlSigner *storage.URLSigner) *MessageService {
 	return &MessageService{
-		messageRepo: messageRepo,
-		userRepo:    userRepo,
+		messageRepo:       messageRepo,
+		userRepo:          userRepo,
+		attachmentService: attachmentService,
+		urlSigner:         urlSigner,
 	}
 }
 
@@ -45,33 +57,41 @@ func (s *MessageService) SendMessage(senderID uuid.UUID, req *models.MessageRequ
 		RecipientID:    req.RecipientID,
 		Content:        req.Content,
 		MessageType:    req.MessageType,
-		MediaURL:       req.MediaURL,
 		DeliveryStatus: models.DeliveryStatusSent,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 		IsBroadcast:    false,
 	}
 
+	if err := s.attachMedia(message, req); err != nil {
+		return nil, err
+	}
+
 	err = s.messageRepo.Create(message)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create message: %w", err)
 	}
 
 	// Return message response
-	return &models.MessageResponse{
+	return s.signMedia(&models.MessageResponse{
 		ID:             message.ID,
 		SenderID:       message.SenderID,
 		SenderUsername: sender.Username,
 		RecipientID:    message.RecipientID,
 		Content:        message.Content,
 		MessageType:    message.MessageType,
+		AttachmentID:   message.AttachmentID,
 		MediaURL:       message.MediaURL,
 		MediaFilename:  message.MediaFilename,
 		MediaSize:      message.MediaSize,
+		MediaWidth:     message.MediaWidth,
+		MediaHeight:    message.MediaHeight,
+		ThumbnailURL:   message.ThumbnailURL,
+		MediumURL:      message.MediumURL,
 		DeliveryStatus: message.DeliveryStatus,
 		CreatedAt:      message.CreatedAt,
 		IsBroadcast:    message.IsBroadcast,
-	}, nil
+	}), nil
 }
 
 // BroadcastMessage sends a message to multiple users
@@ -101,13 +121,16 @@ func (s *MessageService) BroadcastMessage(senderID uuid.UUID, req *models.Messag
 		RecipientID:    nil, // nil for broadcast messages
 		Content:        req.Content,
 		MessageType:    req.MessageType,
-		MediaURL:       req.MediaURL,
 		DeliveryStatus: models.DeliveryStatusSent,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 		IsBroadcast:    true,
 	}
 
+	if err := s.attachMedia(message, req); err != nil {
+		return nil, err
+	}
+
 	err = s.messageRepo.Create(message)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create broadcast message: %w", err)
@@ -130,20 +153,25 @@ func (s *MessageService) BroadcastMessage(senderID uuid.UUID, req *models.Messag
 	}
 
 	// Return message response
-	return &models.MessageResponse{
+	return s.signMedia(&models.MessageResponse{
 		ID:             message.ID,
 		SenderID:       message.SenderID,
 		SenderUsername: sender.Username,
 		RecipientID:    nil,
 		Content:        message.Content,
 		MessageType:    message.MessageType,
+		AttachmentID:   message.AttachmentID,
 		MediaURL:       message.MediaURL,
 		MediaFilename:  message.MediaFilename,
 		MediaSize:      message.MediaSize,
+		MediaWidth:     message.MediaWidth,
+		MediaHeight:    message.MediaHeight,
+		ThumbnailURL:   message.ThumbnailURL,
+		MediumURL:      message.MediumURL,
 		DeliveryStatus: message.DeliveryStatus,
 		CreatedAt:      message.CreatedAt,
 		IsBroadcast:    message.IsBroadcast,
-	}, nil
+	}), nil
 }
 
 // GetChatHistory retrieves chat history between two users
@@ -160,6 +188,10 @@ func (s *MessageService) GetChatHistory(userID1, userID2 uuid.UUID, page, limit
 		return nil, fmt.Errorf("failed to get chat history: %w", err)
 	}
 
+	for i := range messages {
+		s.signMedia(&messages[i])
+	}
+
 	hasMore := int64((page-1)*limit)+int64(len(messages)) < total
 
 	return &models.ChatHistory{
@@ -185,6 +217,10 @@ func (s *MessageService) GetUserMessages(userID uuid.UUID, page, limit int) (*mo
 		return nil, fmt.Errorf("failed to get user messages: %w", err)
 	}
 
+	for i := range messages {
+		s.signMedia(&messages[i])
+	}
+
 	hasMore := int64((page-1)*limit)+int64(len(messages)) < total
 
 	return &models.ChatHistory{
@@ -225,3 +261,65 @@ func (s *MessageService) GetBroadcastRecipients(messageID uuid.UUID) ([]models.B
 
 	return recipients, nil
 }
+
+// signMedia replaces the stored media URLs of a message with signed ones,
+// for responses to the sender and recipients. The file itself is downloaded
+// under the name it was uploaded with.
+func (s *MessageService) signMedia(message *models.MessageResponse) *models.MessageResponse {
+	filename := ""
+	if message.MediaFilename != nil {
+		filename = *message.MediaFilename
+	}
+
+	message.MediaURL = s.signURL(message.MediaURL, filename)
+	message.ThumbnailURL = s.signURL(message.ThumbnailURL, "")
+	message.MediumURL = s.signURL(message.MediumURL, "")
+
+	return message
+}
+
+// signURL signs a stored media URL, downloaded as filename unless empty
+func (s *MessageService) signURL(mediaURL *string, filename string) *string {
+	if mediaURL == nil {
+		return nil
+	}
+
+	key, ok := storage.KeyFromURL(*mediaURL)
+	if !ok {
+		return mediaURL
+	}
+
+	signed := s.urlSigner.SignNamed(key, filename)
+	return &signed
+}
+
+// attachMedia adds an attachment of the sender to a message, referenced by
+// ID or by the URL of its file, and copies its details. Clients may send the
+// signed URL they got from the upload, but only the unsigned path is stored.
+func (s *MessageService) attachMedia(message *models.Message, req *models.MessageRequest) error {
+	attachment, err := s.attachmentService.Attach(message.SenderID, req.AttachmentID, req.MediaURL)
+	if err != nil || attachment == nil {
+		return err
+	}
+
+	message.AttachmentID = &attachment.ID
+	message.MediaURL = mediaPath(attachment.StorageKey)
+	message.MediaFilename = &attachment.Filename
+	message.MediaSize = &attachment.Size
+	message.MediaWidth = attachment.Width
+	message.MediaHeight = attachment.Height
+	if attachment.ThumbnailKey != nil {
+		message.ThumbnailURL = mediaPath(*attachment.ThumbnailKey)
+	}
+	if attachment.MediumKey != nil {
+		message.MediumURL = mediaPath(*attachment.MediumKey)
+	}
+
+	return nil
+}
+
+// mediaPath returns the unsigned URL path of a blob
+func mediaPath(key string) *string {
+	path := storage.URLPrefix + key
+	return &path
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+
+	"github.com/google/uuid"
+)
+
+// bcrypt ignores everything after 72 bytes
+const maxPasswordLength = 72
+
+var (
+	// ErrWrongPassword is returned when the current password given to change
+	// it is wrong
+	ErrWrongPassword = errors.New("current password is incorrect")
+)
+
+// WeakPasswordError is returned for passwords rejected by the password policy
+type WeakPasswordError struct {
+	Reason string
+}
+
+func (e *WeakPasswordError) Error() string {
+	return "password " + e.Reason
+}
+
+// PasswordPolicy validates new passwords
+type PasswordPolicy struct {
+	minLength        int
+	requireUppercase bool
+	requireLowercase bool
+	requireDigit     bool
+	requireSymbol    bool
+	breached         map[string]bool // Uppercase hex SHA-1 of breached passwords
+}
+
+// NewPasswordPolicy creates a password policy and loads the breached
+// password list. Each line of the list is either a plaintext password or the
+// SHA-1 hash of one in hex, optionally followed by ":<count>" as in the
+// Pwned Passwords downloads.
+func NewPasswordPolicy(cfg *config.PasswordConfig) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		minLength:        cfg.MinLength,
+		requireUppercase: cfg.RequireUppercase,
+		requireLowercase: cfg.RequireLowercase,
+		requireDigit:     cfg.RequireDigit,
+		requireSymbol:    cfg.RequireSymbol,
+		breached:         make(map[string]bool),
+	}
+
+	if cfg.BreachedListFile == "" {
+		return policy, nil
+	}
+
+	file, err := os.Open(cfg.BreachedListFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			policy.breached[strings.ToUpper(hash)] = true
+			continue
+		}
+
+		policy.breached[sha1Hex(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %w", err)
+	}
+
+	log.Printf("Loaded %d breached passwords from %s", len(policy.breached), cfg.BreachedListFile)
+	return policy, nil
+}
+
+// Validate checks a new password against the policy
+func (p *PasswordPolicy) Validate(password string) error {
+	if len([]rune(password)) < p.minLength {
+		return &WeakPasswordError{Reason: fmt.Sprintf("must be at least %d characters long", p.minLength)}
+	}
+	if len(password) > maxPasswordLength {
+		return &WeakPasswordError{Reason: fmt.Sprintf("must be at most %d bytes long", maxPasswordLength)}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	switch {
+	case p.requireUppercase && !hasUpper:
+		return &WeakPasswordError{Reason: "must contain an uppercase letter"}
+	case p.requireLowercase && !hasLower:
+		return &WeakPasswordError{Reason: "must contain a lowercase letter"}
+	case p.requireDigit && !hasDigit:
+		return &WeakPasswordError{Reason: "must contain a digit"}
+	case p.requireSymbol && !hasSymbol:
+		return &WeakPasswordError{Reason: "must contain a symbol"}
+	}
+
+	if p.breached[sha1Hex(password)] {
+		return &WeakPasswordError{Reason: "has appeared in a data breach, please choose another one"}
+	}
+
+	return nil
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// ends every other session of the user. Accounts created through single
+// sign-on have no password yet and can set one without. Returns the IDs of
+// the ended sessions.
+func (s *UserService) ChangePassword(userID, sessionID uuid.UUID, currentPassword, newPassword string) ([]uuid.UUID, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	if user.Password != "" {
+		if ok, _ := s.hasher.Verify(currentPassword, user.Password); !ok {
+			return nil, ErrWrongPassword
+		}
+	}
+
+	if err := s.passwordPolicy.Validate(newPassword); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := s.userRepo.UpdatePassword(user.ID, hashedPassword); err != nil {
+		return nil, err
+	}
+
+	sessionIDs, err := s.refreshRepo.RevokeOtherFamilies(user.ID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access tokens of those sessions live at most one token lifetime
+	expiresAt := time.Now().Add(s.jwtManager.TokenTTL())
+	for _, id := range sessionIDs {
+		if err := s.revocations.Revoke(user.ID, id.String(), expiresAt); err != nil {
+			return nil, fmt.Errorf("failed to revoke session: %w", err)
+		}
+	}
+
+	log.Printf("Password changed for user %s, %d other sessions ended", user.ID, len(sessionIDs))
+	return sessionIDs, nil
+}
+
+// rehashPassword replaces a password hash made with outdated parameters.
+// Failures are only logged, the old hash keeps working.
+func (s *UserService) rehashPassword(userID uuid.UUID, password string) {
+	hashedPassword, err := s.hasher.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %s: %v", userID, err)
+		return
+	}
+
+	if err := s.userRepo.UpdatePassword(userID, hashedPassword); err != nil {
+		log.Printf("Failed to rehash password of user %s: %v", userID, err)
+	}
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidRole is returned for roles other than user, moderator and admin
+	ErrInvalidRole = errors.New("invalid role")
+
+	// ErrOwnRole is returned when administrators change their own role, which
+	// could leave no administrator behind
+	ErrOwnRole = errors.New("administrators cannot change their own role")
+)
+
+// UpdateUserRole changes the role of a user. The user's access tokens stop
+// being accepted, so the new role applies from their next refresh.
+func (s *UserService) UpdateUserRole(actorID, userID uuid.UUID, role models.Role) (*models.UserResponse, error) {
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+	if actorID == userID {
+		return nil, ErrOwnRole
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	if user.Role != role {
+		if err := s.userRepo.UpdateRole(userID, role); err != nil {
+			return nil, err
+		}
+
+		// Tokens carrying the old role are revoked, including those issued
+		// in the same second as the change
+		if err := s.revokeAccessTokens(userID); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Role of user %s changed from %s to %s by %s", userID, user.Role, role, actorID)
+		user.Role = role
+	}
+
+	response := user.ToResponse()
+	return &response, nil
+}
+
+// PromoteAdmins gives the admin role to the existing accounts with the given
+// email addresses, so a new deployment has an administrator
+func (s *UserService) PromoteAdmins(emails []string) error {
+	for _, email := range emails {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+
+		user, err := s.userRepo.GetByEmail(email)
+		if err != nil {
+			log.Printf("Skipping admin promotion of %s: %v", email, err)
+			continue
+		}
+		if user.Role == models.RoleAdmin {
+			continue
+		}
+
+		if err := s.userRepo.UpdateRole(user.ID, models.RoleAdmin); err != nil {
+			return fmt.Errorf("failed to promote %s: %w", email, err)
+		}
+		log.Printf("Promoted %s to admin", email)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrQuotaExceeded is returned for uploads that would take their uploader
+	// over their storage quota
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+	// ErrInvalidQuota is returned for negative storage quotas
+	ErrInvalidQuota = errors.New("storage quota cannot be negative")
+)
+
+// Usage reports how much storage the uploads of a user take, and how much
+// they may use
+func (s *AttachmentService) Usage(userID uuid.UUID) (*models.StorageUsage, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	used, count, err := s.attachmentRepo.GetUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.StorageUsage{
+		UserID:      userID,
+		UsedBytes:   used,
+		Attachments: count,
+	}
+	s.applyQuota(usage, user.Role, user.StorageQuota)
+
+	return usage, nil
+}
+
+// CheckQuota returns ErrQuotaExceeded if storing size more bytes would take
+// a user over their quota. Uploads running at the same time are not counted,
+// so together they can exceed the quota by their own size.
+func (s *AttachmentService) CheckQuota(userID uuid.UUID, size int64) error {
+	usage, err := s.Usage(userID)
+	if err != nil {
+		return err
+	}
+
+	if usage.RemainingBytes != nil && size > *usage.RemainingBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, usage.UsedBytes, *usage.QuotaBytes)
+	}
+
+	return nil
+}
+
+// SetQuota gives a user their own storage quota, 0 for unlimited, or with
+// nil puts them back on the quota of their role. Uploads already stored are
+// kept even if they exceed the new quota.
+func (s *AttachmentService) SetQuota(actorID, userID uuid.UUID, quota *int64) (*models.StorageUsage, error) {
+	if quota != nil && *quota < 0 {
+		return nil, ErrInvalidQuota
+	}
+
+	if err := s.userRepo.UpdateStorageQuota(userID, quota); err != nil {
+		return nil, err
+	}
+
+	if quota != nil {
+		log.Printf("Storage quota of user %s set to %d bytes by %s", userID, *quota, actorID)
+	} else {
+		log.Printf("Storage quota of user %s reset to their role's by %s", userID, actorID)
+	}
+
+	return s.Usage(userID)
+}
+
+// StorageReport sums up the storage taken by uploads, listing the limit
+// users storing the most
+func (s *AttachmentService) StorageReport(limit int) (*models.StorageReport, error) {
+	report := &models.StorageReport{}
+
+	var err error
+	report.UsedBytes, report.Attachments, err = s.attachmentRepo.GetTotals()
+	if err != nil {
+		return nil, err
+	}
+	report.StoredBytes, report.Blobs, err = s.blobRepo.GetTotals()
+	if err != nil {
+		return nil, err
+	}
+
+	report.TopConsumers, err = s.attachmentRepo.GetTopConsumers(limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.TopConsumers {
+		consumer := &report.TopConsumers[i]
+		s.applyQuota(&consumer.StorageUsage, consumer.Role, consumer.QuotaBytes)
+	}
+
+	return report, nil
+}
+
+// applyQuota fills in the quota of a user with the given role and quota of
+// their own, if any, and what remains of it
+func (s *AttachmentService) applyQuota(usage *models.StorageUsage, role models.Role, custom *int64) {
+	quota := s.roleQuotas[string(role)]
+	if custom != nil {
+		quota = *custom
+	}
+
+	usage.CustomQuota = custom != nil
+	usage.QuotaBytes, usage.RemainingBytes = nil, nil
+	if quota <= 0 {
+		return
+	}
+
+	remaining := max(quota-usage.UsedBytes, 0)
+	usage.QuotaBytes, usage.RemainingBytes = &quota, &remaining
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+	"github.com/aelhady03/twerlo-chat-app/pkg/utils"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Wrong codes accepted before verification is locked
+	maxTwoFactorAttempts = 5
+
+	// How long verification stays locked after too many wrong codes
+	twoFactorLockout = 15 * time.Minute
+
+	// Number of recovery codes issued at a time
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrInvalidTwoFactorChallenge is returned for invalid or expired challenge tokens
+	ErrInvalidTwoFactorChallenge = errors.New("invalid two-factor challenge")
+
+	// ErrInvalidTwoFactorCode is returned for wrong, expired or reused codes
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+	// ErrTwoFactorLocked is returned while verification is locked after too
+	// many wrong codes
+	ErrTwoFactorLocked = errors.New("too many invalid two-factor codes, try again later")
+
+	// ErrTwoFactorEnabled is returned when enrolling a user who already has
+	// two-factor authentication
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+	// ErrTwoFactorNotEnabled is returned when managing two-factor
+	// authentication of a user who has not enabled it
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+
+	// ErrTwoFactorNotPending is returned when confirming without a pending enrollment
+	ErrTwoFactorNotPending = errors.New("no two-factor enrollment to confirm")
+
+	// ErrTwoFactorRequired is returned when disabling two-factor
+	// authentication while the deployment requires it
+	ErrTwoFactorRequired = errors.New("two-factor authentication is required")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// VerifyTwoFactor completes a login started with Login using a TOTP code or
+// a recovery code
+func (s *UserService) VerifyTwoFactor(req *models.TwoFactorVerifyRequest) (*models.AuthResponse, error) {
+	userID, _, err := s.jwtManager.ValidateActionToken(req.ChallengeToken, auth.ActionTwoFactorChallenge)
+	if err != nil {
+		return nil, ErrInvalidTwoFactorChallenge
+	}
+
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !twoFactor.Enabled() {
+		return nil, ErrInvalidTwoFactorChallenge
+	}
+
+	if err := s.checkSecondFactor(twoFactor, req.Code, req.RecoveryCode); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, ErrInvalidTwoFactorChallenge
+	}
+
+	// Update user online status
+	if err := s.userRepo.UpdateOnlineStatus(user.ID, true); err != nil {
+		// Log error but don't fail login
+		log.Printf("Failed to update user online status: %v", err)
+	}
+
+	return s.issueTokens(user, uuid.New(), true)
+}
+
+// GetTwoFactorStatus reports a user's two-factor enrollment
+func (s *UserService) GetTwoFactorStatus(userID uuid.UUID) (*models.TwoFactorStatusResponse, error) {
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &models.TwoFactorStatusResponse{
+		Enabled:  twoFactor.Enabled(),
+		Required: s.twoFactor.Required,
+	}
+
+	if twoFactor.Enabled() {
+		status.ConfirmedAt = twoFactor.ConfirmedAt
+		status.RecoveryCodesRemaining, err = s.twoFactorRepo.CountRecoveryCodes(userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// SetupTwoFactor starts an enrollment by generating a new secret. It only
+// takes effect once confirmed with a code from the authenticator app.
+func (s *UserService) SetupTwoFactor(userID uuid.UUID) (*models.TwoFactorSetupResponse, error) {
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor.Enabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.twoFactorRepo.SavePending(userID, secret); err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorSetupResponse{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(s.twoFactor.Issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTwoFactor enables a pending enrollment after checking a code from
+// the authenticator app. It returns the recovery codes, which are only shown
+// this once, and tokens for a new session that counts as two-factor.
+func (s *UserService) ConfirmTwoFactor(userID uuid.UUID, code string) (*models.TwoFactorConfirmResponse, error) {
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor == nil {
+		return nil, ErrTwoFactorNotPending
+	}
+	if twoFactor.Enabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	if err := s.checkLocked(twoFactor); err != nil {
+		return nil, err
+	}
+
+	step, ok := auth.ValidateTOTP(twoFactor.Secret, code, time.Now(), twoFactor.LastUsedStep)
+	if !ok {
+		s.recordTwoFactorFailure(userID)
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.twoFactorRepo.Confirm(userID, step, hashes); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	authResponse, err := s.issueTokens(user, uuid.New(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorConfirmResponse{
+		RecoveryCodes: codes,
+		Auth:          authResponse,
+	}, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a
+// code from the authenticator app
+func (s *UserService) RegenerateRecoveryCodes(userID uuid.UUID, code string) ([]string, error) {
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !twoFactor.Enabled() {
+		return nil, ErrTwoFactorNotEnabled
+	}
+
+	if err := s.checkSecondFactor(twoFactor, code, ""); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.twoFactorRepo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTwoFactor removes a user's enrollment after checking a code from
+// the authenticator app or a recovery code
+func (s *UserService) DisableTwoFactor(userID uuid.UUID, code string) error {
+	if s.twoFactor.Required {
+		return ErrTwoFactorRequired
+	}
+
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return err
+	}
+	if !twoFactor.Enabled() {
+		return ErrTwoFactorNotEnabled
+	}
+
+	if err := s.checkSecondFactor(twoFactor, code, code); err != nil {
+		return err
+	}
+
+	return s.twoFactorRepo.Delete(userID)
+}
+
+// ResetTwoFactor removes a user's enrollment without a code, for
+// administrators helping users who lost their authenticator and recovery
+// codes. The user has to enroll again if two-factor is required.
+func (s *UserService) ResetTwoFactor(userID uuid.UUID) error {
+	if _, err := s.userRepo.GetByID(userID); err != nil {
+		return fmt.Errorf("user not found: %w", err)
+	}
+
+	if err := s.twoFactorRepo.Delete(userID); err != nil {
+		return err
+	}
+
+	log.Printf("Two-factor authentication reset for user %s", userID)
+	return nil
+}
+
+// checkSecondFactor accepts either a TOTP code or a recovery code. Accepted
+// codes cannot be used again; wrong codes count towards the lockout.
+func (s *UserService) checkSecondFactor(twoFactor *models.TwoFactor, code, recoveryCode string) error {
+	if err := s.checkLocked(twoFactor); err != nil {
+		return err
+	}
+
+	if code != "" {
+		if step, ok := auth.ValidateTOTP(twoFactor.Secret, code, time.Now(), twoFactor.LastUsedStep); ok {
+			used, err := s.twoFactorRepo.UseStep(twoFactor.UserID, step)
+			if err != nil {
+				return err
+			}
+			if used {
+				return nil
+			}
+		}
+	}
+
+	if recoveryCode != "" {
+		used, err := s.twoFactorRepo.UseRecoveryCode(twoFactor.UserID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if used {
+			log.Printf("Recovery code used by user %s", twoFactor.UserID)
+			return nil
+		}
+	}
+
+	s.recordTwoFactorFailure(twoFactor.UserID)
+	return ErrInvalidTwoFactorCode
+}
+
+// checkLocked returns ErrTwoFactorLocked while verification is locked
+func (s *UserService) checkLocked(twoFactor *models.TwoFactor) error {
+	if twoFactor.LockedUntil != nil && time.Now().Before(*twoFactor.LockedUntil) {
+		return ErrTwoFactorLocked
+	}
+	return nil
+}
+
+// recordTwoFactorFailure counts a wrong code towards the lockout
+func (s *UserService) recordTwoFactorFailure(userID uuid.UUID) {
+	log.Printf("Invalid two-factor code for user %s", userID)
+	if err := s.twoFactorRepo.RecordFailure(userID, maxTwoFactorAttempts, time.Now().Add(twoFactorLockout)); err != nil {
+		log.Printf("Failed to record two-factor failure for user %s: %v", userID, err)
+	}
+}
+
+// generateRecoveryCodes returns new recovery codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and separators
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return utils.HashToken(normalized)
+}
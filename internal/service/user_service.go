@@ -1,10 +1,16 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+	"github.com/aelhady03/twerlo-chat-app/internal/mail"
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
 	"github.com/aelhady03/twerlo-chat-app/internal/repository"
 	"github.com/aelhady03/twerlo-chat-app/pkg/utils"
@@ -12,42 +18,121 @@ import (
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+	// ErrRefreshTokenReused is returned when an already rotated refresh token
+	// is presented again; the whole token family is revoked in response
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+
+	// ErrOIDCEmailRequired is returned when the identity provider does not
+	// share an email address for a new user
+	ErrOIDCEmailRequired = errors.New("identity provider did not return an email address")
+
+	// ErrOIDCEmailNotVerified is returned when an external identity would be
+	// linked to an existing account through an unverified email address
+	ErrOIDCEmailNotVerified = errors.New("email address not verified by identity provider")
+
+	// ErrEmailNotVerified is returned on login while email verification is
+	// required and the user has not verified their address
+	ErrEmailNotVerified = errors.New("email address not verified")
+)
+
+// RefreshTokenReusedError is returned for replayed refresh tokens, with the
+// session that was revoked in response. It matches ErrRefreshTokenReused.
+type RefreshTokenReusedError struct {
+	SessionID uuid.UUID
+}
+
+func (e *RefreshTokenReusedError) Error() string {
+	return ErrRefreshTokenReused.Error()
+}
+
+func (e *RefreshTokenReusedError) Unwrap() error {
+	return ErrRefreshTokenReused
+}
+
 type UserService struct {
-	userRepo   *repository.UserRepository
-	jwtManager *auth.JWTManager
+	userRepo        *repository.UserRepository
+	identityRepo    *repository.IdentityRepository
+	refreshRepo     *repository.RefreshTokenRepository
+	twoFactorRepo   *repository.TwoFactorRepository
+	revocations     auth.RevocationStore
+	jwtManager      *auth.JWTManager
+	mailer          mail.Mailer
+	passwordPolicy  *PasswordPolicy
+	hasher          *utils.PasswordHasher
+	refreshTokenTTL time.Duration
+	twoFactor       *config.TwoFactorConfig
+	account         *config.AccountConfig
+	baseURL         string
 }
 
-func NewUserService(userRepo *repository.UserRepository, jwtManager *auth.JWTManager) *UserService {
+func NewUserService(
+	userRepo *repository.UserRepository,
+	identityRepo *repository.IdentityRepository,
+	refreshRepo *repository.RefreshTokenRepository,
+	twoFactorRepo *repository.TwoFactorRepository,
+	revocations auth.RevocationStore,
+	jwtManager *auth.JWTManager,
+	mailer mail.Mailer,
+	passwordPolicy *PasswordPolicy,
+	cfg *config.Config,
+) *UserService {
 	return &UserService{
-		userRepo:   userRepo,
-		jwtManager: jwtManager,
+		userRepo:       userRepo,
+		identityRepo:   identityRepo,
+		refreshRepo:    refreshRepo,
+		twoFactorRepo:  twoFactorRepo,
+		revocations:    revocations,
+		jwtManager:     jwtManager,
+		mailer:         mailer,
+		passwordPolicy: passwordPolicy,
+		hasher: &utils.PasswordHasher{
+			Algorithm:     cfg.Password.HashAlgorithm,
+			BcryptCost:    cfg.Password.BcryptCost,
+			Argon2Time:    uint32(cfg.Password.Argon2Time),
+			Argon2Memory:  uint32(cfg.Password.Argon2Memory),
+			Argon2Threads: uint8(cfg.Password.Argon2Parallelism),
+		},
+		refreshTokenTTL: cfg.JWT.RefreshTokenTTL,
+		twoFactor:       &cfg.TwoFactor,
+		account:         &cfg.Account,
+		baseURL:         strings.TrimRight(cfg.Server.BaseURL, "/"),
 	}
 }
 
-// Register creates a new user account
-func (s *UserService) Register(req *models.UserRegistration) (*models.AuthResponse, error) {
+// Register creates a new user account and sends an email verification link.
+// While email verification is required, no tokens are issued and the new
+// user is returned instead.
+func (s *UserService) Register(req *models.UserRegistration) (*models.AuthResponse, *models.UserResponse, error) {
 	// Check if email already exists
 	emailExists, err := s.userRepo.EmailExists(req.Email)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check email existence: %w", err)
+		return nil, nil, fmt.Errorf("failed to check email existence: %w", err)
 	}
 	if emailExists {
-		return nil, fmt.Errorf("email already exists")
+		return nil, nil, fmt.Errorf("email already exists")
 	}
 
 	// Check if username already exists
 	usernameExists, err := s.userRepo.UsernameExists(req.Username)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check username existence: %w", err)
+		return nil, nil, fmt.Errorf("failed to check username existence: %w", err)
 	}
 	if usernameExists {
-		return nil, fmt.Errorf("username already exists")
+		return nil, nil, fmt.Errorf("username already exists")
+	}
+
+	if err := s.passwordPolicy.Validate(req.Password); err != nil {
+		return nil, nil, err
 	}
 
 	// Hash password
-	hashedPassword, err := utils.HashPassword(req.Password)
+	hashedPassword, err := s.hasher.Hash(req.Password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to hash password: %w", err)
+		return nil, nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
 	// Create user
@@ -60,37 +145,58 @@ func (s *UserService) Register(req *models.UserRegistration) (*models.AuthRespon
 		UpdatedAt: time.Now(),
 		IsOnline:  false,
 		LastSeen:  time.Now(),
+		Role:      models.RoleUser,
 	}
 
 	err = s.userRepo.Create(user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return nil, nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Generate JWT token
-	token, expiresAt, err := s.jwtManager.GenerateToken(user.ID, user.Username, user.Email)
+	s.sendVerificationEmail(user)
+
+	if s.account.RequireEmailVerification {
+		response := user.ToResponse()
+		return nil, &response, nil
+	}
+
+	// Generate access and refresh tokens
+	authResponse, err := s.issueTokens(user, uuid.New(), false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %w", err)
+		return nil, nil, err
 	}
 
-	return &models.AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
-		User:      user.ToResponse(),
-	}, nil
+	return authResponse, nil, nil
 }
 
-// Login authenticates a user and returns a JWT token
-func (s *UserService) Login(req *models.UserLogin) (*models.AuthResponse, error) {
+// Login authenticates a user and returns a JWT token. Users with two-factor
+// authentication get a challenge instead, to be completed with
+// VerifyTwoFactor.
+func (s *UserService) Login(req *models.UserLogin) (*models.AuthResponse, *models.TwoFactorChallengeResponse, error) {
 	// Get user by email
 	user, err := s.userRepo.GetByEmail(req.Email)
 	if err != nil {
-		return nil, fmt.Errorf("invalid email or password")
+		return nil, nil, fmt.Errorf("invalid email or password")
 	}
 
 	// Check password
-	if !utils.CheckPasswordHash(req.Password, user.Password) {
-		return nil, fmt.Errorf("invalid email or password")
+	ok, needsRehash := s.hasher.Verify(req.Password, user.Password)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid email or password")
+	}
+
+	// Upgrade hashes made with another algorithm or older parameters
+	if needsRehash {
+		s.rehashPassword(user.ID, req.Password)
+	}
+
+	if s.account.RequireEmailVerification && !user.EmailVerified() {
+		return nil, nil, ErrEmailNotVerified
+	}
+
+	challenge, err := s.twoFactorChallenge(user.ID)
+	if err != nil || challenge != nil {
+		return nil, challenge, err
 	}
 
 	// Update user online status
@@ -100,16 +206,292 @@ func (s *UserService) Login(req *models.UserLogin) (*models.AuthResponse, error)
 		fmt.Printf("Failed to update user online status: %v\n", err)
 	}
 
+	// Generate access and refresh tokens
+	authResponse, err := s.issueTokens(user, uuid.New(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authResponse, nil, nil
+}
+
+// twoFactorChallenge starts the second step of a login for users with
+// two-factor authentication, and returns nil for the others
+func (s *UserService) twoFactorChallenge(userID uuid.UUID) (*models.TwoFactorChallengeResponse, error) {
+	twoFactor, err := s.twoFactorRepo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !twoFactor.Enabled() {
+		return nil, nil
+	}
+
+	challenge, expiresAt, err := s.jwtManager.GenerateActionToken(auth.ActionTwoFactorChallenge, userID, "", s.twoFactor.ChallengeTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate challenge token: %w", err)
+	}
+
+	return &models.TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge,
+		ExpiresAt:         expiresAt,
+	}, nil
+}
+
+// LoginWithOIDC signs in the user behind an identity verified by the OIDC
+// provider. Unknown identities are linked to the account with the same
+// verified email, or a new account is provisioned for them. Like Login,
+// users with two-factor authentication get a challenge instead of tokens,
+// and the others must enroll when two-factor authentication is required.
+func (s *UserService) LoginWithOIDC(identity *auth.OIDCIdentity) (*models.AuthResponse, *models.TwoFactorChallengeResponse, error) {
+	user, err := s.findOrCreateOIDCUser(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.account.RequireEmailVerification && !user.EmailVerified() {
+		return nil, nil, ErrEmailNotVerified
+	}
+
+	challenge, err := s.twoFactorChallenge(user.ID)
+	if err != nil || challenge != nil {
+		return nil, challenge, err
+	}
+
+	// Update user online status
+	err = s.userRepo.UpdateOnlineStatus(user.ID, true)
+	if err != nil {
+		// Log error but don't fail login
+		log.Printf("Failed to update user online status: %v", err)
+	}
+
+	// Generate access and refresh tokens
+	authResponse, err := s.issueTokens(user, uuid.New(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authResponse, nil, nil
+}
+
+// findOrCreateOIDCUser resolves the user linked to an external identity
+func (s *UserService) findOrCreateOIDCUser(identity *auth.OIDCIdentity) (*models.User, error) {
+	if linked, err := s.identityRepo.GetBySubject(identity.Issuer, identity.Subject); err == nil {
+		return s.userRepo.GetByID(linked.UserID)
+	}
+
+	if identity.Email == "" {
+		return nil, ErrOIDCEmailRequired
+	}
+
+	// Link to an existing account, but only through a verified email address,
+	// otherwise anyone able to set an email at the provider could take it over
+	user, err := s.userRepo.GetByEmail(identity.Email)
+	if err == nil {
+		if !identity.EmailVerified {
+			return nil, ErrOIDCEmailNotVerified
+		}
+		if !user.EmailVerified() {
+			if err := s.userRepo.MarkEmailVerified(user.ID); err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+	} else {
+		user, err = s.provisionOIDCUser(identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	link := &models.UserIdentity{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Issuer:    identity.Issuer,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	}
+	if err := s.identityRepo.Create(link); err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	return user, nil
+}
+
+// provisionOIDCUser creates an account for a first-time OIDC user
+func (s *UserService) provisionOIDCUser(identity *auth.OIDCIdentity) (*models.User, error) {
+	username, err := s.availableUsername(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	// No password: the empty hash never matches, so the account can only
+	// sign in through the identity provider
+	user := &models.User{
+		ID:        uuid.New(),
+		Username:  username,
+		Email:     identity.Email,
+		Password:  "",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		IsOnline:  false,
+		LastSeen:  time.Now(),
+		Role:      models.RoleUser,
+	}
+	if identity.EmailVerified {
+		user.EmailVerifiedAt = &user.CreatedAt
+	}
+
+	if err := s.userRepo.Create(user); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	log.Printf("Provisioned user %s for %s at %s", user.Username, identity.Subject, identity.Issuer)
+	return user, nil
+}
+
+// availableUsername derives an unused username from the identity's preferred
+// username or email address
+func (s *UserService) availableUsername(identity *auth.OIDCIdentity) (string, error) {
+	base := sanitizeUsername(identity.PreferredUsername)
+	if len(base) < 3 {
+		base = sanitizeUsername(strings.SplitN(identity.Email, "@", 2)[0])
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	candidate := base
+	for i := 2; i < 100; i++ {
+		exists, err := s.userRepo.UsernameExists(candidate)
+		if err != nil {
+			return "", fmt.Errorf("failed to check username existence: %w", err)
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+
+	return base + "-" + uuid.NewString()[:8], nil
+}
+
+// sanitizeUsername keeps the characters allowed in usernames
+func sanitizeUsername(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can be used once; presenting a used token again
+// revokes every token in its family.
+func (s *UserService) Refresh(refreshToken string) (*models.AuthResponse, error) {
+	stored, err := s.refreshRepo.GetByHash(utils.HashToken(refreshToken))
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if stored.RevokedAt != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if stored.UsedAt != nil {
+		return nil, s.revokeReusedFamily(stored)
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	user, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Rotate: the old token is consumed before its replacement is issued
+	replacementID := uuid.New()
+	rotated, err := s.refreshRepo.MarkUsed(stored.ID, replacementID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if !rotated {
+		// Another request used this token first
+		return nil, s.revokeReusedFamily(stored)
+	}
+
+	return s.issueTokensWithID(user, stored.FamilyID, replacementID, stored.MFA)
+}
+
+// revokeReusedFamily ends the session of a replayed refresh token like
+// Logout does: its refresh tokens and the access tokens carrying its family
+// as their session are revoked. Failures are only logged, the replay is
+// reported either way.
+func (s *UserService) revokeReusedFamily(token *models.RefreshToken) error {
+	log.Printf("Refresh token reuse detected for user %s, revoking family %s", token.UserID, token.FamilyID)
+
+	sessionExpiresAt := time.Now().Add(s.jwtManager.TokenTTL())
+	if err := s.revocations.Revoke(token.UserID, token.FamilyID.String(), sessionExpiresAt); err != nil {
+		log.Printf("Failed to revoke session %s: %v", token.FamilyID, err)
+	}
+
+	if err := s.refreshRepo.RevokeFamily(token.FamilyID); err != nil {
+		log.Printf("Failed to revoke refresh token family %s: %v", token.FamilyID, err)
+	}
+
+	return &RefreshTokenReusedError{SessionID: token.FamilyID}
+}
+
+// issueTokens generates an access token and a refresh token in the given
+// family. mfa records whether the login passed a second factor.
+func (s *UserService) issueTokens(user *models.User, familyID uuid.UUID, mfa bool) (*models.AuthResponse, error) {
+	return s.issueTokensWithID(user, familyID, uuid.New(), mfa)
+}
+
+// issueTokensWithID is issueTokens with a preassigned refresh token ID
+func (s *UserService) issueTokensWithID(user *models.User, familyID, refreshTokenID uuid.UUID, mfa bool) (*models.AuthResponse, error) {
 	// Generate JWT token
-	token, expiresAt, err := s.jwtManager.GenerateToken(user.ID, user.Username, user.Email)
+	token, expiresAt, err := s.jwtManager.GenerateToken(user.ID, user.Username, user.Email, user.Role, familyID, mfa)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
+	// Generate opaque refresh token, only its hash is stored
+	refreshToken, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	now := time.Now()
+	stored := &models.RefreshToken{
+		ID:        refreshTokenID,
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: utils.HashToken(refreshToken),
+		ExpiresAt: now.Add(s.refreshTokenTTL),
+		CreatedAt: now,
+		MFA:       mfa,
+	}
+
+	if err := s.refreshRepo.Create(stored); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
 	return &models.AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
-		User:      user.ToResponse(),
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: stored.ExpiresAt,
+		User:             user.ToResponse(),
 	}, nil
 }
 
@@ -124,7 +506,8 @@ func (s *UserService) GetUserByID(id uuid.UUID) (*models.UserResponse, error) {
 	return &response, nil
 }
 
-// GetAllUsers retrieves all users (excluding sensitive information)
+// GetAllUsers retrieves all users with their email addresses, for
+// administrators
 func (s *UserService) GetAllUsers() ([]models.UserResponse, error) {
 	users, err := s.userRepo.GetAllUsers()
 	if err != nil {
@@ -139,6 +522,21 @@ func (s *UserService) GetAllUsers() ([]models.UserResponse, error) {
 	return responses, nil
 }
 
+// GetPublicUsers retrieves all users without their email addresses
+func (s *UserService) GetPublicUsers() ([]models.PublicUserResponse, error) {
+	users, err := s.userRepo.GetAllUsers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	var responses []models.PublicUserResponse
+	for _, user := range users {
+		responses = append(responses, user.ToPublicResponse())
+	}
+
+	return responses, nil
+}
+
 // UpdateOnlineStatus updates a user's online status
 func (s *UserService) UpdateOnlineStatus(userID uuid.UUID, isOnline bool) error {
 	err := s.userRepo.UpdateOnlineStatus(userID, isOnline)
@@ -149,8 +547,58 @@ func (s *UserService) UpdateOnlineStatus(userID uuid.UUID, isOnline bool) error
 	return nil
 }
 
-// Logout updates user's online status to offline
-func (s *UserService) Logout(userID uuid.UUID) error {
+// Logout ends the session of the given token: the token and every other
+// access token of the session stop being accepted, and the session's
+// refresh tokens are revoked
+func (s *UserService) Logout(claims *auth.Claims) error {
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	if err := s.revocations.Revoke(claims.UserID, claims.ID, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	// Older access tokens of the session live at most one token lifetime
+	sessionExpiresAt := time.Now().Add(s.jwtManager.TokenTTL())
+	if err := s.revocations.Revoke(claims.UserID, claims.SessionID.String(), sessionExpiresAt); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	if err := s.refreshRepo.RevokeFamily(claims.SessionID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	return s.setOffline(claims.UserID)
+}
+
+// LogoutEverywhere ends every session of a user
+func (s *UserService) LogoutEverywhere(userID uuid.UUID) error {
+	if err := s.revokeAccessTokens(userID); err != nil {
+		return err
+	}
+
+	if err := s.refreshRepo.RevokeAllForUser(userID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	return s.setOffline(userID)
+}
+
+// revokeAccessTokens revokes every access token issued to a user so far,
+// for logging out everywhere and for role changes alike. Tokens issued
+// afterwards stay valid, even within the same second.
+func (s *UserService) revokeAccessTokens(userID uuid.UUID) error {
+	if err := s.revocations.RevokeAllForUser(userID); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// setOffline updates user's online status to offline
+func (s *UserService) setOffline(userID uuid.UUID) error {
 	err := s.userRepo.UpdateOnlineStatus(userID, false)
 	if err != nil {
 		return fmt.Errorf("failed to update online status: %w", err)
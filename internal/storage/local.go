@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore keeps blobs as files in a directory, each with a hidden JSON
+// file holding its metadata. Every replica needs the same directory, so it
+// suits single instances and shared volumes.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore creates a local store in dir
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &LocalStore{dir: dir}, nil
+}
+
+// Put writes a blob to a temporary file and renames it into place, so
+// readers never see a partial file
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, meta Metadata) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("failed to write blob: expected %d bytes, got %d", size, written)
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode blob metadata: %w", err)
+	}
+	if err := os.WriteFile(metadataPath(filePath), metaJSON, 0644); err != nil {
+		return fmt.Errorf("failed to write blob metadata: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	return nil
+}
+
+// Get opens a blob file
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		file.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	return file, fileInfo(filePath, stat), nil
+}
+
+// Stat describes a blob file
+func (s *LocalStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil || stat.IsDir() {
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to stat blob: %w", err)
+	}
+
+	return fileInfo(filePath, stat), nil
+}
+
+// Delete removes a blob file
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	os.Remove(metadataPath(filePath))
+
+	return nil
+}
+
+// path maps a key to its file
+func (s *LocalStore) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// fileInfo describes a blob file. Files stored without metadata get a
+// content type derived from their extension.
+func fileInfo(filePath string, stat os.FileInfo) *BlobInfo {
+	info := &BlobInfo{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}
+
+	if data, err := os.ReadFile(metadataPath(filePath)); err == nil {
+		json.Unmarshal(data, &info.Metadata)
+	}
+	if info.ContentType == "" {
+		info.ContentType = mime.TypeByExtension(filepath.Ext(filePath))
+	}
+
+	return info
+}
+
+// metadataPath returns the metadata file of a blob file
+func metadataPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".json")
+}
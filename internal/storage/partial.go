@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrOffsetMismatch is returned when a chunk does not start where the
+	// upload stopped
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+
+	// ErrUploadLocked is returned while another request writes to an upload
+	ErrUploadLocked = errors.New("upload is locked by another request")
+
+	// ErrTooManyUploads is returned when creating an upload for an owner
+	// who already has as many uploads in progress as allowed
+	ErrTooManyUploads = errors.New("too many uploads in progress")
+
+	// ErrUploadComplete is returned when writing to a finished upload
+	ErrUploadComplete = errors.New("upload is already complete")
+
+	// ErrUploadIncomplete is returned when completing an upload whose data
+	// was not all received
+	ErrUploadIncomplete = errors.New("upload is not fully received")
+
+	// ErrNotStored wraps the error of a CompleteFunc. The data of the upload
+	// is kept, so completing it can be retried.
+	ErrNotStored = errors.New("upload could not be stored")
+)
+
+// CompleteFunc stores the data of a fully received upload and returns what
+// it was stored as
+type CompleteFunc func(upload *PartialUpload, data io.ReadSeeker) (string, error)
+
+// AdmitFunc decides whether an upload may be created, given the total length
+// of the uploads its owner already has in progress
+type AdmitFunc func(pendingLength int64) error
+
+// createLockName names the lock taken while uploads are created, so owners
+// cannot exceed their limits with concurrent requests
+const createLockName = ".create"
+
+// partialIDPattern matches upload IDs, so they are safe in file names
+var partialIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// PartialUpload is a resumable upload. Its data grows chunk by chunk until
+// Offset reaches Length, and it is then stored as Result.
+type PartialUpload struct {
+	ID        string
+	Owner     string
+	Filename  string
+	Length    int64
+	Offset    int64 `json:"-"` // Size of the data received so far
+	ExpiresAt time.Time
+	Result    string `json:",omitempty"` // What a completed upload was stored as
+}
+
+// Done reports whether all the data of the upload was received
+func (u *PartialUpload) Done() bool {
+	return u.Result != "" || u.Offset == u.Length
+}
+
+// PartialStore keeps resumable uploads in a directory until they are
+// complete: each upload has a data file and a JSON file describing it.
+// Requests for an upload must reach a replica sharing the directory; they
+// are serialized with locks on files in the directory.
+type PartialStore struct {
+	dir        string
+	ttl        time.Duration
+	maxPending int // Uploads in progress each owner may have
+
+	creating sync.Mutex // Held while an upload is created
+	mutex    sync.Mutex
+	locked   map[string]*os.File // Lock files of the uploads being written to
+}
+
+// NewPartialStore creates a store of resumable uploads in dir. Uploads
+// expire ttl after they are created, and each owner may have up to
+// maxPending of them in progress.
+func NewPartialStore(dir string, ttl time.Duration, maxPending int) (*PartialStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create resumable upload directory: %w", err)
+	}
+
+	return &PartialStore{dir: dir, ttl: ttl, maxPending: maxPending, locked: make(map[string]*os.File)}, nil
+}
+
+// Create starts an upload of length bytes. It returns ErrTooManyUploads if
+// the owner has too many uploads in progress, and the error of admit if it
+// refuses the upload.
+func (s *PartialStore) Create(owner, filename string, length int64, admit AdmitFunc) (*PartialUpload, error) {
+	s.creating.Lock()
+	defer s.creating.Unlock()
+
+	lock, err := s.lockFile(createLockName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	pending, pendingLength, err := s.pending(owner)
+	if err != nil {
+		return nil, err
+	}
+	if pending >= s.maxPending {
+		return nil, ErrTooManyUploads
+	}
+	if err := admit(pendingLength); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate upload ID: %w", err)
+	}
+
+	upload := &PartialUpload{
+		ID:        hex.EncodeToString(id),
+		Owner:     owner,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: time.Now().Add(s.ttl).UTC().Truncate(time.Second),
+	}
+
+	if err := os.WriteFile(s.dataPath(upload.ID), nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	if err := s.save(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// pending returns how many uploads of owner are in progress, and their
+// total length
+func (s *PartialStore) pending(owner string) (int, int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list resumable uploads: %w", err)
+	}
+
+	count := 0
+	var length int64
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !partialIDPattern.MatchString(id) {
+			continue
+		}
+
+		upload, err := s.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if upload.Owner != owner || upload.Result != "" {
+			continue
+		}
+		count++
+		length += upload.Length
+	}
+
+	return count, length, nil
+}
+
+// Get looks up an upload that has not expired
+func (s *PartialStore) Get(id string) (*PartialUpload, error) {
+	if !partialIDPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	var upload PartialUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload: %w", err)
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	if upload.Result != "" {
+		upload.Offset = upload.Length
+		return &upload, nil
+	}
+
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat upload: %w", err)
+	}
+	upload.Offset = stat.Size()
+
+	return &upload, nil
+}
+
+// Append writes a chunk starting at offset. Whatever was received is kept
+// even if reading r fails, so the client can resume from there; the upload
+// is returned with its new offset in both cases. Data past the length of
+// the upload is not read. Once all the data is received, the upload is
+// completed with complete before it is unlocked; an empty chunk at the end
+// of an upload whose completion failed retries it.
+func (s *PartialStore) Append(id string, offset int64, r io.Reader, complete CompleteFunc) (*PartialUpload, error) {
+	if err := s.lock(id); err != nil {
+		return nil, err
+	}
+	defer s.unlock(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Result != "" {
+		return nil, ErrUploadComplete
+	}
+	if offset != upload.Offset {
+		return nil, ErrOffsetMismatch
+	}
+	if upload.Done() {
+		return upload, s.complete(upload, complete)
+	}
+
+	file, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %w", err)
+	}
+
+	written, err := io.Copy(file, io.LimitReader(r, upload.Length-upload.Offset))
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write upload file: %w", closeErr)
+	}
+	upload.Offset += written
+	if err != nil || !upload.Done() {
+		return upload, err
+	}
+
+	return upload, s.complete(upload, complete)
+}
+
+// Complete completes an upload whose data was all received but that was
+// not stored, because storing failed or the process stopped meanwhile.
+// Uploads already complete are returned as they are.
+func (s *PartialStore) Complete(id string, complete CompleteFunc) (*PartialUpload, error) {
+	if err := s.lock(id); err != nil {
+		return nil, err
+	}
+	defer s.unlock(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Result != "" {
+		return upload, nil
+	}
+	if !upload.Done() {
+		return nil, ErrUploadIncomplete
+	}
+
+	return upload, s.complete(upload, complete)
+}
+
+// complete stores the data of a locked, fully received upload with
+// complete, then records the result and removes the data. The upload is
+// kept until it expires, so clients that lost the final response can look
+// up the result.
+func (s *PartialStore) complete(upload *PartialUpload, complete CompleteFunc) error {
+	file, err := os.Open(s.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer file.Close()
+
+	result, err := complete(upload, file)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotStored, err)
+	}
+
+	upload.Result = result
+	if err := s.save(upload); err != nil {
+		upload.Result = ""
+		return err
+	}
+
+	os.Remove(s.dataPath(upload.ID))
+	return nil
+}
+
+// Delete removes an upload. Deleting a missing upload is not an error.
+func (s *PartialStore) Delete(id string) error {
+	if err := s.lock(id); err != nil {
+		return err
+	}
+	defer s.unlock(id)
+
+	s.remove(id)
+	return nil
+}
+
+// Sweep removes expired uploads and returns how many there were
+func (s *PartialStore) Sweep() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list resumable uploads: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !partialIDPattern.MatchString(id) {
+			continue
+		}
+
+		if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if s.lock(id) != nil {
+			continue
+		}
+		s.remove(id)
+		s.unlock(id)
+		removed++
+	}
+
+	return removed, nil
+}
+
+// RunSweeper removes expired uploads every interval, forever
+func (s *PartialStore) RunSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := s.Sweep()
+		if err != nil {
+			log.Printf("Failed to sweep resumable uploads: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("Removed %d expired resumable uploads", removed)
+		}
+	}
+}
+
+// save writes the description of an upload
+func (s *PartialStore) save(upload *PartialUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+
+	if err := os.WriteFile(s.infoPath(upload.ID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the files of an upload
+func (s *PartialStore) remove(id string) {
+	if !partialIDPattern.MatchString(id) {
+		return
+	}
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// lock reserves an upload for one request, in this process and in the
+// replicas sharing the directory
+func (s *PartialStore) lock(id string) error {
+	if !partialIDPattern.MatchString(id) {
+		return ErrNotFound
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.locked[id] != nil {
+		return ErrUploadLocked
+	}
+	file, err := s.lockFile(id, false)
+	if err != nil {
+		return err
+	}
+	s.locked[id] = file
+	return nil
+}
+
+// unlock releases an upload. The lock file of an upload that does not exist
+// (anymore) is removed while still locked: requests that opened it before
+// then find no upload once they lock it.
+func (s *PartialStore) unlock(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file := s.locked[id]
+	if _, err := os.Stat(s.infoPath(id)); errors.Is(err, os.ErrNotExist) {
+		os.Remove(s.lockPath(id))
+	}
+	file.Close()
+	delete(s.locked, id)
+}
+
+// lockFile opens the lock file called name and locks it, waiting for other
+// holders if wait is set. Closing the file releases the lock.
+func (s *PartialStore) lockFile(name string, wait bool) (*os.File, error) {
+	file, err := os.OpenFile(s.lockPath(name), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload lock: %w", err)
+	}
+	if err := flock(file, wait); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *PartialStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *PartialStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *PartialStore) lockPath(name string) string {
+	return filepath.Join(s.dir, name+".lock")
+}
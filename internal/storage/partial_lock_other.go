@@ -0,0 +1,11 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// flock does nothing where flock(2) is missing: uploads are then only locked
+// within the process, so replicas must not share the directory
+func flock(file *os.File, wait bool) error {
+	return nil
+}
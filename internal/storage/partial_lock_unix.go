@@ -0,0 +1,29 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive lock on file, which is released when the file
+// is closed. It returns ErrUploadLocked if the file is locked and wait is
+// not set.
+func flock(file *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	err := syscall.Flock(int(file.Fd()), how)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrUploadLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock upload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLPrefix is the path under which the app serves stored media
+const URLPrefix = "/uploads/"
+
+var (
+	// ErrInvalidSignature is returned for media URLs without a valid signature
+	ErrInvalidSignature = errors.New("invalid media URL signature")
+
+	// ErrURLExpired is returned for signed media URLs past their expiry
+	ErrURLExpired = errors.New("media URL expired")
+)
+
+// URLSigner issues and checks time-limited media URLs. Whoever holds a
+// signed URL can download the blob until it expires, so URLs are only handed
+// to users allowed to see the blob.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewURLSigner creates a signer issuing URLs valid for ttl
+func NewURLSigner(secret string, ttl time.Duration) *URLSigner {
+	return &URLSigner{
+		secret: []byte(secret),
+		ttl:    ttl,
+	}
+}
+
+// Sign returns a signed URL of a blob
+func (s *URLSigner) Sign(key string) string {
+	return s.SignNamed(key, "")
+}
+
+// SignNamed returns a signed URL of a blob that is downloaded as filename.
+// Blobs are shared by everyone who uploaded the same content, so the name
+// comes with the URL rather than from the blob.
+func (s *URLSigner) SignNamed(key, filename string) string {
+	expires := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	if filename != "" {
+		query.Set("name", filename)
+	}
+	query.Set("signature", s.signature(key, expires, filename))
+
+	return URLPrefix + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode()
+}
+
+// Verify checks the signature and expiry of a media URL's query parameters,
+// including the file name if any, and returns the time left until it expires
+func (s *URLSigner) Verify(key string, query url.Values) (time.Duration, error) {
+	expires := query.Get("expires")
+	signature := query.Get("signature")
+	if expires == "" || signature == "" {
+		return 0, ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.signature(key, expires, query.Get("name")))) {
+		return 0, ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidSignature
+	}
+
+	remaining := time.Until(time.Unix(unix, 0))
+	if remaining <= 0 {
+		return 0, ErrURLExpired
+	}
+
+	return remaining, nil
+}
+
+// signature computes the signature of a blob key, expiry and file name, if
+// any
+func (s *URLSigner) signature(key, expires, filename string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	if filename != "" {
+		mac.Write([]byte("\n" + filename))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// KeyFromURL extracts the blob key from a media URL, signed or not, absolute
+// or relative
+func KeyFromURL(mediaURL string) (string, bool) {
+	u, err := url.Parse(mediaURL)
+	if err != nil || !strings.HasPrefix(u.Path, URLPrefix) {
+		return "", false
+	}
+
+	key := strings.TrimPrefix(u.Path, URLPrefix)
+	if validateKey(key) != nil {
+		return "", false
+	}
+
+	return key, true
+}
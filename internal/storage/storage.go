@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
+)
+
+// ErrNotFound is returned for keys without a blob
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that could escape the store, such as
+// absolute paths or keys with ".." segments
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Metadata is stored along with a blob
+type Metadata struct {
+	ContentType string
+	Filename    string // Original name of the upload
+
+	// Images only
+	Width     int    `json:",omitempty"`
+	Height    int    `json:",omitempty"`
+	Thumbnail string `json:",omitempty"` // Key of the thumbnail variant
+	Medium    string `json:",omitempty"` // Key of the medium variant
+}
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Metadata
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores uploaded media under slash-separated keys
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any blob
+	// already there
+	Put(ctx context.Context, key string, r io.Reader, size int64, meta Metadata) error
+
+	// Get opens a blob. The reader is an io.ReadSeeker when the driver
+	// supports seeking, so range requests can be served.
+	Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error)
+
+	// Stat describes a blob without reading it
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+
+	// Delete removes a blob. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore creates the blob store selected by the configuration
+func NewBlobStore(cfg *config.UploadConfig) (BlobStore, error) {
+	switch cfg.Driver {
+	case "s3":
+		return NewS3Store(&cfg.S3), nil
+	case "local", "":
+		return NewLocalStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q, use local or s3", cfg.Driver)
+	}
+}
+
+// validateKey rejects keys that are not clean relative paths
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol used to pass a bearer token in Sec-WebSocket-Protocol.
+// Clients offer ["bearer", "<jwt>"] and the server selects "bearer".
+const bearerSubprotocol = "bearer"
+
+var (
+	errInvalidTicket = errors.New("invalid or expired ticket")
+
+	errTwoFactorRequired = errors.New("two-factor authentication must be enabled to continue")
+)
+
+// ticket is a single-use credential for opening a WebSocket connection
+type ticket struct {
+	claims    *auth.Claims
+	expiresAt time.Time
+}
+
+// ticketStore keeps issued WebSocket tickets in memory
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets map[string]ticket
+	ttl     time.Duration
+}
+
+func newTicketStore(ttl time.Duration) *ticketStore {
+	return &ticketStore{
+		tickets: make(map[string]ticket),
+		ttl:     ttl,
+	}
+}
+
+// issue creates a ticket carrying the given claims
+func (s *ticketStore) issue(claims *auth.Claims) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate ticket: %w", err)
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+
+	// Tickets are never issued for longer than the token they stand in for
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Time.Before(expiresAt) {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired tickets that were never redeemed
+	for key, t := range s.tickets {
+		if now.After(t.expiresAt) {
+			delete(s.tickets, key)
+		}
+	}
+	s.tickets[value] = ticket{claims: claims, expiresAt: expiresAt}
+
+	return value, expiresAt, nil
+}
+
+// redeem consumes a ticket and returns its claims
+func (s *ticketStore) redeem(value string) (*auth.Claims, error) {
+	s.mu.Lock()
+	t, exists := s.tickets[value]
+	delete(s.tickets, value)
+	s.mu.Unlock()
+
+	if !exists || time.Now().After(t.expiresAt) {
+		return nil, errInvalidTicket
+	}
+
+	return t.claims, nil
+}
+
+// IssueTicket handles requests for a single-use WebSocket ticket
+func IssueTicket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	value, expiresAt, err := hub.tickets.issue(claims)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "TICKET_FAILED", "Failed to issue WebSocket ticket")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, models.NewSuccessResponse("WebSocket ticket issued successfully", models.WSTicketResponse{
+		Ticket:    value,
+		ExpiresAt: expiresAt,
+	}))
+}
+
+// redeemTicket consumes a ticket and makes sure the token it was issued
+// for has not been revoked since
+func redeemTicket(hub *Hub, jwtManager *auth.JWTManager, value string) (*auth.Claims, error) {
+	claims, err := hub.tickets.redeem(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jwtManager.CheckRevoked(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// authenticateRequest checks the credentials sent with the upgrade request,
+// in order: a ticket and a bearer subprotocol. Tokens are not accepted in
+// the query string, where they would end up in access logs. It returns nil
+// claims when no credentials were sent, in which case the client must
+// authenticate with its first frame.
+func authenticateRequest(hub *Hub, jwtManager *auth.JWTManager, r *http.Request) (*auth.Claims, error) {
+	if value := r.URL.Query().Get("ticket"); value != "" {
+		return redeemTicket(hub, jwtManager, value)
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == bearerSubprotocol && i+1 < len(protocols) {
+			return validateToken(hub, jwtManager, protocols[i+1])
+		}
+	}
+
+	return nil, nil
+}
+
+// validateToken checks an access token sent to /ws. While two-factor
+// authentication is required, the session must have passed a second factor,
+// as auth.RequireTwoFactor demands for the API; tickets are only issued to
+// such sessions.
+func validateToken(hub *Hub, jwtManager *auth.JWTManager, token string) (*auth.Claims, error) {
+	claims, err := jwtManager.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if hub.requireTwoFactor && !claims.MFA {
+		return nil, errTwoFactorRequired
+	}
+
+	return claims, nil
+}
+
+// authenticateFirstFrame waits for an auth frame carrying a token or ticket
+func authenticateFirstFrame(hub *Hub, jwtManager *auth.JWTManager, conn *websocket.Conn) (*auth.Claims, error) {
+	conn.SetReadLimit(hub.config.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(hub.config.AuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth frame: %w", err)
+	}
+
+	var frame struct {
+		Type string                   `json:"type"`
+		Data models.WebSocketAuthData `json:"data"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil || frame.Type != models.WSMessageTypeAuth {
+		return nil, errors.New("first frame must be an auth message")
+	}
+
+	switch {
+	case frame.Data.Ticket != "":
+		return redeemTicket(hub, jwtManager, frame.Data.Ticket)
+	case frame.Data.Token != "":
+		return validateToken(hub, jwtManager, frame.Data.Token)
+	default:
+		return nil, errors.New("auth message requires a token or ticket")
+	}
+}
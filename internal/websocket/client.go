@@ -13,51 +13,65 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Close codes sent when the server ends a connection
 const (
-	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
+	CloseAuthFailed   = 4000
+	CloseTokenExpired = 4001
+	CloseKicked       = 4002
+	CloseTokenRevoked = 4003
 )
 
 // ServeWS handles websocket requests from the peer
 func ServeWS(hub *Hub, jwtManager *auth.JWTManager, w http.ResponseWriter, r *http.Request) {
-	// Get token from query parameter
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
-	}
-
-	// Validate token
-	claims, err := jwtManager.ValidateToken(token)
+	claims, err := authenticateRequest(hub, jwtManager, r)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	conn, err := hub.upgrader.Upgrade(cw, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
+	// Without credentials on the request the first frame must authenticate
+	if claims == nil {
+		claims, err = authenticateFirstFrame(hub, jwtManager, conn)
+		if err != nil {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(CloseAuthFailed, "authentication failed"),
+				time.Now().Add(hub.config.WriteWait))
+			conn.Close()
+			return
+		}
+	}
+
+	// Compression is negotiated only when both sides support it
+	compress := hub.config.EnableCompression && supportsCompression(r)
+	if compress {
+		if err := conn.SetCompressionLevel(hub.config.CompressionLevel); err != nil {
+			log.Printf("Invalid WebSocket compression level %d: %v", hub.config.CompressionLevel, err)
+		}
+	}
+
 	// Create client
 	client := &Client{
-		ID:       uuid.New(),
-		UserID:   claims.UserID,
-		Username: claims.Username,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Hub:      hub,
+		ID:          uuid.New(),
+		UserID:      claims.UserID,
+		Username:    claims.Username,
+		SessionID:   claims.SessionID,
+		Transport:   TransportWebSocket,
+		Conn:        conn,
+		Send:        make(chan []byte, 256),
+		Hub:         hub,
+		ExpiresAt:   tokenExpiry(claims),
+		ConnectedAt: time.Now(),
+		RemoteAddr:  r.RemoteAddr,
+		netConn:     cw.conn,
+		compress:    compress,
 	}
 
 	// Register client with hub
@@ -70,27 +84,47 @@ func ServeWS(hub *Hub, jwtManager *auth.JWTManager, w http.ResponseWriter, r *ht
 
 // readPump pumps messages from the websocket connection to the hub
 func (c *Client) readPump() {
+	// Removing the client closes Send, after which writePump flushes any
+	// queued frames and closes the connection
+	reason := "connection closed"
 	defer func() {
-		c.Hub.unregister <- c
-		c.Conn.Close()
+		c.Hub.removeClient(c, reason)
 	}()
 
-	c.Conn.SetReadLimit(maxMessageSize)
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	cfg := c.Hub.config
+	c.Conn.SetReadLimit(cfg.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.Conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
 		return nil
 	})
 
+	limiter := newTokenBucket(cfg.MessageRateLimit, cfg.MessageBurst)
+	violations := 0
+
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
+			reason = err.Error()
 			break
 		}
 
+		if !limiter.allow() {
+			violations++
+			if violations >= cfg.MaxRateViolations {
+				log.Printf("Disconnecting %s (%s): inbound rate limit exceeded", c.Username, c.UserID)
+				c.sendError("Rate limit exceeded, closing connection")
+				c.Hub.disconnect(c, websocket.ClosePolicyViolation, "rate limit exceeded")
+				break
+			}
+			c.sendError("Rate limit exceeded, message dropped")
+			continue
+		}
+		violations = 0
+
 		// Handle incoming message
 		c.handleMessage(message)
 	}
@@ -98,7 +132,17 @@ func (c *Client) readPump() {
 
 // writePump pumps messages from the hub to the websocket connection
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	cfg := c.Hub.config
+	ticker := time.NewTicker(cfg.PingPeriod)
+
+	// Close the connection when the token it was opened with expires
+	var expired <-chan time.Time
+	if !c.ExpiresAt.IsZero() {
+		expiry := time.NewTimer(time.Until(c.ExpiresAt))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
@@ -107,35 +151,48 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
 			if !ok {
 				// The hub closed the channel
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+				closeMessage := c.closeMessage
+				if closeMessage == nil {
+					closeMessage = []byte{}
+				}
+				c.Conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
-			w.Write(message)
 
-			// Add queued chat messages to the current websocket message
+			// Add queued chat messages to the current websocket message.
+			// Queued slices may be shared with other clients, so copy first.
+			payload := message
 			n := len(c.Send)
+			if n > 0 {
+				payload = append([]byte(nil), message...)
+			}
 			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.Send)
+				payload = append(payload, '\n')
+				payload = append(payload, <-c.Send...)
 			}
 
-			if err := w.Close(); err != nil {
+			// Only compress payloads large enough to benefit from it
+			compressed := c.compress && len(payload) >= cfg.CompressionThreshold
+			c.Conn.EnableWriteCompression(compressed)
+
+			written := c.netConn.bytesWritten.Load()
+			if err := c.Conn.WriteMessage(websocket.TextMessage, payload); err != nil {
 				return
 			}
+			c.Hub.metrics.recordMessage(int64(len(payload)), c.netConn.bytesWritten.Load()-written, compressed)
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case <-expired:
+			// Closing Send makes the next iteration write the close frame
+			c.Hub.disconnect(c, CloseTokenExpired, "token expired")
 		}
 	}
 }
@@ -174,11 +231,7 @@ func (c *Client) sendPong() {
 		return
 	}
 
-	select {
-	case c.Send <- data:
-	default:
-		close(c.Send)
-	}
+	c.Hub.deliver([]*Client{c}, data)
 }
 
 // sendError sends an error message to the client
@@ -197,11 +250,7 @@ func (c *Client) sendError(message string) {
 		return
 	}
 
-	select {
-	case c.Send <- data:
-	default:
-		close(c.Send)
-	}
+	c.Hub.deliver([]*Client{c}, data)
 }
 
 // handleDeliveryUpdate processes delivery status updates from the client
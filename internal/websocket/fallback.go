@@ -0,0 +1,284 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Default time a long-poll request waits for the first event
+	longPollTimeout = 25 * time.Second
+
+	// Upper bound for the timeout a client may request
+	maxLongPollTimeout = 60 * time.Second
+
+	// Long-poll sessions that are not polled for this long are dropped
+	longPollSessionTTL = 90 * time.Second
+
+	// How often the hub looks for expired long-poll sessions
+	longPollSweepInterval = 30 * time.Second
+
+	// Maximum number of events returned by a single poll
+	maxLongPollEvents = 100
+
+	// Reconnection delay suggested to SSE clients, in milliseconds
+	sseRetryMillis = 3000
+)
+
+var errPollSessionNotFound = errors.New("poll session not found")
+
+// pollSession keeps a long-poll client registered with the hub between polls
+type pollSession struct {
+	client *Client
+
+	// Serializes concurrent polls on the same session
+	mu sync.Mutex
+
+	// Time of the last poll in Unix nanoseconds
+	lastPoll atomic.Int64
+}
+
+// ServeSSE streams the hub events for the authenticated user as Server-Sent Events
+func ServeSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorResponse(w, http.StatusInternalServerError, "STREAMING_UNSUPPORTED", "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable proxy buffering
+	w.WriteHeader(http.StatusOK)
+
+	client := newFallbackClient(hub, claims, TransportSSE, r)
+	hub.register <- client
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis)
+	flusher.Flush()
+
+	ticker := time.NewTicker(hub.config.PingPeriod)
+	defer ticker.Stop()
+
+	// End the stream when the token it was opened with expires
+	var expired <-chan time.Time
+	if !client.ExpiresAt.IsZero() {
+		expiry := time.NewTimer(time.Until(client.ExpiresAt))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-expired:
+			return
+
+		case message, ok := <-client.Send:
+			if !ok {
+				// The hub closed the channel
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", message); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			// Comment lines keep intermediaries from closing an idle stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// ServeLongPoll returns the hub events queued for a long-poll session,
+// waiting until at least one is available or the timeout elapses. Requests
+// without a session_id start a new session.
+func ServeLongPoll(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetUserFromContext(r.Context())
+	if !ok {
+		writeErrorResponse(w, http.StatusUnauthorized, "UNAUTHORIZED", "User not authenticated")
+		return
+	}
+
+	timeout := longPollTimeout
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		if t, err := strconv.Atoi(timeoutStr); err == nil && t >= 0 {
+			timeout = min(time.Duration(t)*time.Second, maxLongPollTimeout)
+		}
+	}
+
+	session, err := hub.getPollSession(claims, r.URL.Query().Get("session_id"), r)
+	if err != nil {
+		writeErrorResponse(w, http.StatusNotFound, "SESSION_NOT_FOUND", "Poll session not found or expired")
+		return
+	}
+
+	if !session.mu.TryLock() {
+		writeErrorResponse(w, http.StatusConflict, "POLL_IN_PROGRESS", "Another poll is already in progress for this session")
+		return
+	}
+	defer session.mu.Unlock()
+
+	session.lastPoll.Store(time.Now().UnixNano())
+	defer func() {
+		session.lastPoll.Store(time.Now().UnixNano())
+	}()
+
+	events := make([]json.RawMessage, 0)
+	open := true
+
+	// Wait for the first event
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message, ok := <-session.client.Send:
+		if ok {
+			events = append(events, message)
+		}
+		open = ok
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	// Drain whatever else is already queued
+drain:
+	for open && len(events) < maxLongPollEvents {
+		select {
+		case message, ok := <-session.client.Send:
+			if ok {
+				events = append(events, message)
+			}
+			open = ok
+		default:
+			break drain
+		}
+	}
+
+	if !open {
+		// The hub dropped this client, so the session cannot continue
+		hub.deletePollSession(session.client.ID)
+		if len(events) == 0 {
+			writeErrorResponse(w, http.StatusNotFound, "SESSION_NOT_FOUND", "Poll session not found or expired")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, models.NewSuccessResponse("Events retrieved successfully", models.LongPollResponse{
+		SessionID: session.client.ID,
+		Events:    events,
+	}))
+}
+
+// getPollSession returns the caller's long-poll session, or registers a new
+// one when sessionID is empty
+func (h *Hub) getPollSession(claims *auth.Claims, sessionID string, r *http.Request) (*pollSession, error) {
+	if sessionID == "" {
+		session := &pollSession{client: newFallbackClient(h, claims, TransportLongPoll, r)}
+		session.lastPoll.Store(time.Now().UnixNano())
+
+		h.mutex.Lock()
+		h.pollSessions[session.client.ID] = session
+		h.mutex.Unlock()
+
+		h.register <- session.client
+		return session, nil
+	}
+
+	id, err := uuid.Parse(sessionID)
+	if err != nil {
+		return nil, errPollSessionNotFound
+	}
+
+	h.mutex.RLock()
+	session, exists := h.pollSessions[id]
+	h.mutex.RUnlock()
+
+	if !exists || session.client.UserID != claims.UserID {
+		return nil, errPollSessionNotFound
+	}
+
+	return session, nil
+}
+
+// deletePollSession forgets a long-poll session without touching its client
+func (h *Hub) deletePollSession(id uuid.UUID) {
+	h.mutex.Lock()
+	delete(h.pollSessions, id)
+	h.mutex.Unlock()
+}
+
+// expirePollSessions unregisters long-poll sessions that stopped polling
+func (h *Hub) expirePollSessions() {
+	cutoff := time.Now().Add(-longPollSessionTTL).UnixNano()
+
+	h.mutex.Lock()
+	var expired []*Client
+	for id, session := range h.pollSessions {
+		if session.lastPoll.Load() < cutoff {
+			delete(h.pollSessions, id)
+			expired = append(expired, session.client)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, client := range expired {
+		h.removeClient(client, "poll session expired")
+	}
+}
+
+// newFallbackClient creates a client for a transport without a WebSocket connection
+func newFallbackClient(hub *Hub, claims *auth.Claims, transport string, r *http.Request) *Client {
+	return &Client{
+		ID:          uuid.New(),
+		UserID:      claims.UserID,
+		Username:    claims.Username,
+		SessionID:   claims.SessionID,
+		Transport:   transport,
+		Send:        make(chan []byte, 256),
+		Hub:         hub,
+		ExpiresAt:   tokenExpiry(claims),
+		ConnectedAt: time.Now(),
+		RemoteAddr:  r.RemoteAddr,
+	}
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, statusCode int, response *models.APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeErrorResponse writes a JSON error response
+func writeErrorResponse(w http.ResponseWriter, statusCode int, code, message string) {
+	writeJSON(w, statusCode, models.NewErrorResponse(code, message, ""))
+}
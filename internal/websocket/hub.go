@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aelhady03/twerlo-chat-app/internal/auth"
+	"github.com/aelhady03/twerlo-chat-app/internal/config"
 	"github.com/aelhady03/twerlo-chat-app/internal/models"
 	"github.com/aelhady03/twerlo-chat-app/internal/service"
 
@@ -15,22 +18,41 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow connections from any origin in development
-		// In production, you should check the origin properly
-		return true
-	},
-}
+// Transports a client can be connected through
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "longpoll"
+)
 
-// Client represents a WebSocket client
+// Client represents a connected client. WebSocket clients have a Conn,
+// clients on the fallback transports only consume the Send channel.
 type Client struct {
-	ID       uuid.UUID
-	UserID   uuid.UUID
-	Username string
-	Conn     *websocket.Conn
-	Send     chan []byte
-	Hub      *Hub
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Username  string
+	SessionID uuid.UUID
+	Transport string
+	Conn      *websocket.Conn
+	Send      chan []byte
+	Hub       *Hub
+
+	// Expiry of the token the client authenticated with
+	ExpiresAt time.Time
+
+	// Connection details reported by the admin endpoint
+	ConnectedAt time.Time
+	RemoteAddr  string
+
+	// Underlying network connection, used for traffic accounting
+	netConn *countingConn
+
+	// Whether permessage-deflate was negotiated for this connection
+	compress bool
+
+	// Payload of the close frame sent once the hub closes Send.
+	// Set under the hub mutex when the client is removed.
+	closeMessage []byte
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients
@@ -47,8 +69,11 @@ type Hub struct {
 	// Unregister requests from clients
 	unregister chan *Client
 
-	// User ID to client mapping for direct messaging
-	userClients map[uuid.UUID]*Client
+	// User ID to clients mapping for direct messaging
+	userClients map[uuid.UUID]map[*Client]bool
+
+	// Long-poll sessions by session ID
+	pollSessions map[uuid.UUID]*pollSession
 
 	// Mutex for thread-safe operations
 	mutex sync.RWMutex
@@ -58,74 +83,191 @@ type Hub struct {
 
 	// User service for database operations
 	userService *service.UserService
+
+	// WebSocket settings
+	config *config.WebSocketConfig
+
+	// Whether tokens must have passed a second factor, as for the API
+	requireTwoFactor bool
+
+	// Upgrader used for incoming connections
+	upgrader websocket.Upgrader
+
+	// Single-use tickets for opening WebSocket connections
+	tickets *ticketStore
+
+	// Outbound traffic and compression metrics
+	metrics *Metrics
+
+	// Most recent disconnects, oldest first
+	disconnects []models.HubDisconnect
 }
 
 // NewHub creates a new WebSocket hub
-func NewHub(jwtManager *auth.JWTManager, userService *service.UserService) *Hub {
+func NewHub(jwtManager *auth.JWTManager, userService *service.UserService, cfg *config.Config) *Hub {
 	return &Hub{
-		clients:     make(map[*Client]bool),
-		broadcast:   make(chan []byte),
-		register:    make(chan *Client),
-		unregister:  make(chan *Client),
-		userClients: make(map[uuid.UUID]*Client),
-		jwtManager:  jwtManager,
-		userService: userService,
+		clients:      make(map[*Client]bool),
+		broadcast:    make(chan []byte),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		userClients:  make(map[uuid.UUID]map[*Client]bool),
+		pollSessions: make(map[uuid.UUID]*pollSession),
+		jwtManager:   jwtManager,
+		userService:  userService,
+		config:       &cfg.WebSocket,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       newOriginChecker(cfg.CORS.AllowedOrigins),
+			EnableCompression: cfg.WebSocket.EnableCompression,
+			Subprotocols:      []string{bearerSubprotocol},
+		},
+		tickets:          newTicketStore(cfg.WebSocket.TicketTTL),
+		metrics:          &Metrics{},
+		requireTwoFactor: cfg.TwoFactor.Required,
 	}
 }
 
 // Run starts the hub and handles client registration/unregistration and message broadcasting
 func (h *Hub) Run() {
+	sweep := time.NewTicker(longPollSweepInterval)
+	defer sweep.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
-			h.mutex.Lock()
-			h.clients[client] = true
-			h.userClients[client.UserID] = client
-			h.mutex.Unlock()
+			h.addClient(client)
 
-			log.Printf("Client %s (%s) connected", client.Username, client.UserID)
+		case client := <-h.unregister:
+			h.removeClient(client, "connection closed")
 
-			// Update user online status in database
-			if err := h.userService.UpdateOnlineStatus(client.UserID, true); err != nil {
-				log.Printf("Failed to update online status for user %s: %v", client.UserID, err)
-			}
+		case message := <-h.broadcast:
+			h.sendToAll(message)
 
-			// Send user status update to all clients
-			h.broadcastUserStatus(client.UserID, client.Username, true)
+		case <-sweep.C:
+			h.expirePollSessions()
+		}
+	}
+}
 
-		case client := <-h.unregister:
-			h.mutex.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				delete(h.userClients, client.UserID)
-				close(client.Send)
-			}
-			h.mutex.Unlock()
+// addClient registers a client and announces the user as online if this is
+// their first connection
+func (h *Hub) addClient(client *Client) {
+	h.mutex.Lock()
+	h.clients[client] = true
+	if h.userClients[client.UserID] == nil {
+		h.userClients[client.UserID] = make(map[*Client]bool)
+	}
+	h.userClients[client.UserID][client] = true
+	firstConnection := len(h.userClients[client.UserID]) == 1
+	h.mutex.Unlock()
 
-			log.Printf("Client %s (%s) disconnected", client.Username, client.UserID)
+	log.Printf("Client %s (%s) connected via %s", client.Username, client.UserID, client.Transport)
 
-			// Update user online status in database
-			if err := h.userService.UpdateOnlineStatus(client.UserID, false); err != nil {
-				log.Printf("Failed to update offline status for user %s: %v", client.UserID, err)
-			}
+	if !firstConnection {
+		return
+	}
 
-			// Send user status update to all clients
-			h.broadcastUserStatus(client.UserID, client.Username, false)
+	// Update user online status in database
+	if err := h.userService.UpdateOnlineStatus(client.UserID, true); err != nil {
+		log.Printf("Failed to update online status for user %s: %v", client.UserID, err)
+	}
 
-		case message := <-h.broadcast:
-			h.mutex.RLock()
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-					delete(h.userClients, client.UserID)
-				}
-			}
-			h.mutex.RUnlock()
+	// Send user status update to all clients
+	h.broadcastUserStatus(client.UserID, client.Username, true)
+}
+
+// removeClient unregisters a client and closes its Send channel
+func (h *Hub) removeClient(client *Client, reason string) {
+	h.closeClient(client, reason, nil)
+}
+
+// disconnect unregisters a client and has its writePump send a close frame
+// with the given code and reason
+func (h *Hub) disconnect(client *Client, code int, reason string) {
+	h.closeClient(client, reason, websocket.FormatCloseMessage(code, reason))
+}
+
+// closeClient unregisters a client and closes its Send channel. The user is
+// announced as offline once their last connection is gone. Closing a client
+// that is no longer registered is a no-op.
+func (h *Hub) closeClient(client *Client, reason string, closeMessage []byte) {
+	h.mutex.Lock()
+	if _, ok := h.clients[client]; !ok {
+		h.mutex.Unlock()
+		return
+	}
+	client.closeMessage = closeMessage
+	h.recordDisconnect(client, reason)
+	delete(h.clients, client)
+	delete(h.userClients[client.UserID], client)
+	lastConnection := len(h.userClients[client.UserID]) == 0
+	if lastConnection {
+		delete(h.userClients, client.UserID)
+	}
+	close(client.Send)
+	h.mutex.Unlock()
+
+	log.Printf("Client %s (%s) disconnected: %s", client.Username, client.UserID, reason)
+
+	if !lastConnection {
+		return
+	}
+
+	// Update user online status in database
+	if err := h.userService.UpdateOnlineStatus(client.UserID, false); err != nil {
+		log.Printf("Failed to update offline status for user %s: %v", client.UserID, err)
+	}
+
+	// Send user status update to all clients
+	h.broadcastUserStatus(client.UserID, client.Username, false)
+}
+
+// deliver queues data on each client's Send channel and drops clients whose
+// buffer is full
+func (h *Hub) deliver(clients []*Client, data []byte) {
+	var slow []*Client
+
+	h.mutex.RLock()
+	for _, client := range clients {
+		if !h.clients[client] {
+			continue
+		}
+		select {
+		case client.Send <- data:
+		default:
+			slow = append(slow, client)
 		}
 	}
+	h.mutex.RUnlock()
+
+	for _, client := range slow {
+		h.removeClient(client, "send buffer full")
+	}
+}
+
+// sendToAll delivers data to every connected client
+func (h *Hub) sendToAll(data []byte) {
+	h.mutex.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mutex.RUnlock()
+
+	h.deliver(clients, data)
+}
+
+// sendToUsers delivers data to every connection of the given users
+func (h *Hub) sendToUsers(userIDs []uuid.UUID, data []byte) {
+	h.mutex.RLock()
+	var clients []*Client
+	for _, userID := range userIDs {
+		for client := range h.userClients[userID] {
+			clients = append(clients, client)
+		}
+	}
+	h.mutex.RUnlock()
+
+	h.deliver(clients, data)
 }
 
 // BroadcastMessage broadcasts a message to all connected clients
@@ -147,11 +289,7 @@ func (h *Hub) BroadcastMessage(message *models.MessageResponse) {
 
 // SendDirectMessage sends a message to a specific user
 func (h *Hub) SendDirectMessage(userID uuid.UUID, message *models.MessageResponse) {
-	h.mutex.RLock()
-	client, exists := h.userClients[userID]
-	h.mutex.RUnlock()
-
-	if !exists {
+	if !h.IsUserOnline(userID) {
 		log.Printf("User %s is not connected", userID)
 		return
 	}
@@ -168,15 +306,7 @@ func (h *Hub) SendDirectMessage(userID uuid.UUID, message *models.MessageRespons
 		return
 	}
 
-	select {
-	case client.Send <- data:
-	default:
-		close(client.Send)
-		h.mutex.Lock()
-		delete(h.clients, client)
-		delete(h.userClients, client.UserID)
-		h.mutex.Unlock()
-	}
+	h.sendToUsers([]uuid.UUID{userID}, data)
 }
 
 // SendToMultipleUsers sends a message to multiple specific users
@@ -193,20 +323,7 @@ func (h *Hub) SendToMultipleUsers(userIDs []uuid.UUID, message *models.MessageRe
 		return
 	}
 
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	for _, userID := range userIDs {
-		if client, exists := h.userClients[userID]; exists {
-			select {
-			case client.Send <- data:
-			default:
-				close(client.Send)
-				delete(h.clients, client)
-				delete(h.userClients, client.UserID)
-			}
-		}
-	}
+	h.sendToUsers(userIDs, data)
 }
 
 // broadcastUserStatus broadcasts user online/offline status to all clients
@@ -229,7 +346,8 @@ func (h *Hub) broadcastUserStatus(userID uuid.UUID, username string, isOnline bo
 		return
 	}
 
-	h.broadcast <- data
+	// Called from Run, so deliver directly instead of through h.broadcast
+	h.sendToAll(data)
 }
 
 // GetConnectedUsers returns a list of currently connected users
@@ -238,9 +356,9 @@ func (h *Hub) GetConnectedUsers() []models.UserStatus {
 	defer h.mutex.RUnlock()
 
 	var users []models.UserStatus
-	for client := range h.clients {
+	for userID := range h.userClients {
 		users = append(users, models.UserStatus{
-			UserID:   client.UserID,
+			UserID:   userID,
 			IsOnline: true,
 			LastSeen: time.Now(),
 		})
@@ -249,11 +367,50 @@ func (h *Hub) GetConnectedUsers() []models.UserStatus {
 	return users
 }
 
+// Metrics returns a snapshot of outbound traffic and compression metrics
+func (h *Hub) Metrics() models.WebSocketMetrics {
+	return h.metrics.Snapshot()
+}
+
 // IsUserOnline checks if a user is currently connected
 func (h *Hub) IsUserOnline(userID uuid.UUID) bool {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	_, exists := h.userClients[userID]
-	return exists
+	return len(h.userClients[userID]) > 0
+}
+
+// tokenExpiry returns the expiry time carried by the claims, if any
+func tokenExpiry(claims *auth.Claims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt.Time
+}
+
+// newOriginChecker returns a CheckOrigin function accepting requests without
+// an Origin header, same-origin requests and the configured origins.
+// A "*" entry allows every origin.
+func newOriginChecker(allowedOrigins []string) func(r *http.Request) bool {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Non-browser clients do not send an Origin header
+			return true
+		}
+		if allowed["*"] || allowed[strings.ToLower(origin)] {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
 }
@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+)
+
+// Metrics tracks outbound WebSocket traffic and the effect of compression
+type Metrics struct {
+	messagesSent       atomic.Int64
+	compressedMessages atomic.Int64
+	payloadBytes       atomic.Int64
+	wireBytes          atomic.Int64
+
+	// Traffic of the compressed frames only, which the savings are
+	// measured on
+	compressedPayloadBytes atomic.Int64
+	compressedWireBytes    atomic.Int64
+}
+
+// recordMessage records a frame that was written to a client.
+// payloadSize is the uncompressed size and wireSize the number of bytes
+// that actually went over the connection.
+func (m *Metrics) recordMessage(payloadSize, wireSize int64, compressed bool) {
+	m.messagesSent.Add(1)
+	m.payloadBytes.Add(payloadSize)
+	m.wireBytes.Add(wireSize)
+
+	if compressed {
+		m.compressedMessages.Add(1)
+		m.compressedPayloadBytes.Add(payloadSize)
+		m.compressedWireBytes.Add(wireSize)
+	}
+}
+
+// Snapshot returns the current metric values. Savings and the compression
+// ratio only count compressed frames, against their uncompressed size, so
+// the framing of small uncompressed frames does not show as a loss.
+func (m *Metrics) Snapshot() models.WebSocketMetrics {
+	compressedPayload := m.compressedPayloadBytes.Load()
+	compressedWire := m.compressedWireBytes.Load()
+
+	snapshot := models.WebSocketMetrics{
+		MessagesSent:       m.messagesSent.Load(),
+		CompressedMessages: m.compressedMessages.Load(),
+		PayloadBytes:       m.payloadBytes.Load(),
+		WireBytes:          m.wireBytes.Load(),
+		BytesSaved:         compressedPayload - compressedWire,
+	}
+	if compressedPayload > 0 {
+		snapshot.CompressionRatio = float64(compressedWire) / float64(compressedPayload)
+	}
+
+	return snapshot
+}
+
+// countingConn wraps a net.Conn and counts the bytes read and written
+type countingConn struct {
+	net.Conn
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter wraps the connection handed out by Hijack so that
+// the upgraded WebSocket connection reports its wire traffic
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not implement http.Hijacker")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, rw, nil
+}
+
+// supportsCompression reports whether the client offered permessage-deflate
+func supportsCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.Split(extension, ";")[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
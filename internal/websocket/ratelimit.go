@@ -0,0 +1,47 @@
+package websocket
+
+import "time"
+
+// tokenBucket is a simple token bucket rate limiter. It is only used from a
+// client's readPump, so it needs no locking, and goes away with the
+// connection. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket, or nil when rate is not positive
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token if one is available
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
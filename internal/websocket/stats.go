@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aelhady03/twerlo-chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Number of disconnects kept for the admin endpoint
+const maxRecentDisconnects = 100
+
+// recordDisconnect appends a disconnect to the recent history.
+// The caller must hold h.mutex.
+func (h *Hub) recordDisconnect(client *Client, reason string) {
+	h.disconnects = append(h.disconnects, models.HubDisconnect{
+		ClientID:       client.ID,
+		UserID:         client.UserID,
+		Username:       client.Username,
+		Transport:      client.Transport,
+		Reason:         reason,
+		ConnectedAt:    client.ConnectedAt,
+		DisconnectedAt: time.Now(),
+	})
+
+	if len(h.disconnects) > maxRecentDisconnects {
+		h.disconnects = h.disconnects[len(h.disconnects)-maxRecentDisconnects:]
+	}
+}
+
+// Stats returns a snapshot of the connected clients and recent disconnects
+func (h *Hub) Stats() models.HubStats {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	now := time.Now()
+	stats := models.HubStats{
+		ConnectedUsers:    len(h.userClients),
+		ConnectedClients:  len(h.clients),
+		Users:             make([]models.HubUserStats, 0, len(h.userClients)),
+		RecentDisconnects: make([]models.HubDisconnect, len(h.disconnects)),
+		Metrics:           h.metrics.Snapshot(),
+	}
+
+	for userID, clients := range h.userClients {
+		user := models.HubUserStats{
+			UserID:  userID,
+			Clients: make([]models.HubClientStats, 0, len(clients)),
+		}
+
+		for client := range clients {
+			user.Username = client.Username
+			clientStats := models.HubClientStats{
+				ID:            client.ID,
+				Transport:     client.Transport,
+				RemoteAddr:    client.RemoteAddr,
+				ConnectedAt:   client.ConnectedAt,
+				AgeSeconds:    now.Sub(client.ConnectedAt).Seconds(),
+				QueueDepth:    len(client.Send),
+				QueueCapacity: cap(client.Send),
+				Compressed:    client.compress,
+			}
+			if client.netConn != nil {
+				clientStats.BytesIn = client.netConn.bytesRead.Load()
+				clientStats.BytesOut = client.netConn.bytesWritten.Load()
+			}
+			user.Clients = append(user.Clients, clientStats)
+		}
+
+		sort.Slice(user.Clients, func(i, j int) bool {
+			return user.Clients[i].ConnectedAt.Before(user.Clients[j].ConnectedAt)
+		})
+		stats.Users = append(stats.Users, user)
+	}
+
+	sort.Slice(stats.Users, func(i, j int) bool {
+		return stats.Users[i].Username < stats.Users[j].Username
+	})
+
+	// Most recent disconnect first
+	for i, disconnect := range h.disconnects {
+		stats.RecentDisconnects[len(h.disconnects)-1-i] = disconnect
+	}
+
+	return stats
+}
+
+// DisconnectUser closes every connection of a user and returns how many
+// connections were closed
+func (h *Hub) DisconnectUser(userID uuid.UUID, reason string) int {
+	return h.disconnectWhere(func(c *Client) bool {
+		return c.UserID == userID
+	}, CloseKicked, reason)
+}
+
+// DisconnectSession closes every connection opened with tokens of the given
+// session after it has been revoked
+func (h *Hub) DisconnectSession(sessionID uuid.UUID, reason string) int {
+	return h.disconnectWhere(func(c *Client) bool {
+		return c.SessionID == sessionID
+	}, CloseTokenRevoked, reason)
+}
+
+// DisconnectUserSessions closes every connection of a user after all of
+// their tokens have been revoked
+func (h *Hub) DisconnectUserSessions(userID uuid.UUID, reason string) int {
+	return h.disconnectWhere(func(c *Client) bool {
+		return c.UserID == userID
+	}, CloseTokenRevoked, reason)
+}
+
+// disconnectWhere closes every client matching the filter and returns how
+// many were closed
+func (h *Hub) disconnectWhere(filter func(*Client) bool, code int, reason string) int {
+	h.mutex.RLock()
+	var clients []*Client
+	for client := range h.clients {
+		if filter(client) {
+			clients = append(clients, client)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, client := range clients {
+		h.disconnect(client, code, reason)
+	}
+
+	return len(clients)
+}
@@ -0,0 +1,13 @@
+-- Create user_identities table (accounts at external identity providers)
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(issuer, subject)
+);
+
+-- Create indexes for identity lookups
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
@@ -0,0 +1,2 @@
+-- Record when users verified their email address
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
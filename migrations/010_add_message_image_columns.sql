@@ -0,0 +1,5 @@
+-- Dimensions and resized variants of image attachments
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_width INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_height INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_thumbnail_url TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_medium_url TEXT;
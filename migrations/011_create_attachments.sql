@@ -0,0 +1,25 @@
+-- Create attachments table (uploaded files, linked to messages once sent)
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT UNIQUE NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    width INTEGER,
+    height INTEGER,
+    thumbnail_key TEXT,
+    medium_key TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    attached_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Messages reference their attachment
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL;
+
+-- Create indexes for the orphan sweeper and message lookups
+CREATE INDEX IF NOT EXISTS idx_attachments_uploader_id ON attachments(uploader_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_unattached ON attachments(created_at) WHERE attached_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_attachment_id ON messages(attachment_id);
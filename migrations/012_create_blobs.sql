@@ -0,0 +1,30 @@
+-- Create blobs table (stored files, shared by every attachment with the same
+-- content), counting the references to files uploaded before deduplication.
+-- The count only runs with the table's creation: later, attachments whose
+-- blob was released (infected ones waiting to be swept) must not bring it
+-- back.
+DO $$
+BEGIN
+    IF to_regclass('blobs') IS NULL THEN
+        CREATE TABLE blobs (
+            storage_key TEXT PRIMARY KEY,
+            sha256 VARCHAR(64) NOT NULL,
+            size BIGINT NOT NULL,
+            thumbnail_key TEXT,
+            medium_key TEXT,
+            ref_count INTEGER NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+        );
+
+        INSERT INTO blobs (storage_key, sha256, size, thumbnail_key, medium_key, ref_count, created_at)
+        SELECT storage_key, MIN(sha256), MIN(size), MIN(thumbnail_key), MIN(medium_key), COUNT(*), MIN(created_at)
+        FROM attachments
+        GROUP BY storage_key;
+    END IF;
+END $$;
+
+-- Attachments with the same content share a storage key
+ALTER TABLE attachments DROP CONSTRAINT IF EXISTS attachments_storage_key_key;
+
+-- Create index for looking up attachments by file
+CREATE INDEX IF NOT EXISTS idx_attachments_storage_key ON attachments(storage_key);
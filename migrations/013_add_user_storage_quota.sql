@@ -0,0 +1,2 @@
+-- Storage quota of a user in bytes, overriding the quota of their role
+ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_quota BIGINT;
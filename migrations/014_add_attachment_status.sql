@@ -0,0 +1,7 @@
+-- Add the scan state of attachments (pending, clean or infected); files
+-- uploaded before scanning existed are considered clean
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'clean'
+    CHECK (status IN ('pending', 'clean', 'infected'));
+
+-- Create index for rescanning pending attachments
+CREATE INDEX IF NOT EXISTS idx_attachments_pending ON attachments(created_at) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+-- Revoke tokens by generation instead of issue time. Users who already
+-- logged out everywhere start at generation 1, which revokes the tokens
+-- issued before, as they carry no generation.
+ALTER TABLE user_token_revocations ADD COLUMN IF NOT EXISTS generation BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+-- Record whether the files of a blob are stored; blobs recorded so far are
+-- all stored, new ones are not until their upload has written the files
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS stored BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,5 @@
+-- Count attempts in flight apart from failures; keys may have attempts in
+-- flight before their first failure
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS pending INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS pending_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE login_throttle ALTER COLUMN last_failure_at DROP NOT NULL;
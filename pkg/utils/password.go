@@ -1,17 +1,123 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HashPassword hashes a password using bcrypt
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// Password hashing algorithms
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// PasswordHasher hashes new passwords with the configured algorithm and
+// verifies hashes of either algorithm, so existing hashes keep working
+// after a change
+type PasswordHasher struct {
+	Algorithm     string // bcrypt or argon2id
+	BcryptCost    int
+	Argon2Time    uint32 // Iterations
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+// Hash hashes a password with the configured algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == AlgorithmArgon2id {
+		return h.hashArgon2id(password)
+	}
+
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
 	return string(bytes), err
 }
 
-// CheckPasswordHash verifies a password against its hash
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+// Verify checks a password against its hash. needsRehash reports that the
+// hash was made with another algorithm or other parameters than the
+// configured ones, and should be replaced while the password is at hand.
+func (h *PasswordHasher) Verify(password, hash string) (ok, needsRehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false
+		}
+
+		computed := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+
+		return true, h.Algorithm != AlgorithmArgon2id ||
+			params.Argon2Time != h.Argon2Time ||
+			params.Argon2Memory != h.Argon2Memory ||
+			params.Argon2Threads != h.Argon2Threads
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, h.Algorithm != AlgorithmBcrypt || err != nil || cost != h.BcryptCost
+}
+
+// hashArgon2id hashes a password into the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func (h *PasswordHasher) hashArgon2id(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decodeArgon2id parses a hash made by hashArgon2id
+func decodeArgon2id(hash string) (*PasswordHasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	params := &PasswordHasher{Algorithm: AlgorithmArgon2id}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	return params, salt, key, nil
 }
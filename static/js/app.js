@@ -1,6 +1,7 @@
 class ChatApp {
   constructor() {
     this.token = localStorage.getItem("token");
+    this.refreshToken = localStorage.getItem("refreshToken");
     this.currentUser = null;
     this.selectedUser = null;
     this.ws = null;
@@ -11,7 +12,18 @@ class ChatApp {
 
     this.initializeElements();
     this.attachEventListeners();
-    this.checkAuthStatus();
+
+    // The identity provider redirects back with a code and state
+    const params = new URLSearchParams(window.location.search);
+    if (params.has("code") && params.has("state")) {
+      this.handleSSOCallback(params.get("code"), params.get("state"));
+    } else if (params.has("verify_email")) {
+      this.handleVerifyEmail(params.get("verify_email"));
+    } else if (params.has("reset_password")) {
+      this.showResetPasswordForm(params.get("reset_password"));
+    } else {
+      this.checkAuthStatus();
+    }
   }
 
   initializeElements() {
@@ -22,7 +34,16 @@ class ChatApp {
     this.registerTab = document.getElementById("register-tab");
     this.loginForm = document.getElementById("login-form");
     this.registerForm = document.getElementById("register-form");
+    this.twoFactorForm = document.getElementById("two-factor-form");
+    this.forgotPasswordForm = document.getElementById("forgot-password-form");
+    this.resetPasswordForm = document.getElementById("reset-password-form");
     this.authError = document.getElementById("auth-error");
+    this.authNotice = document.getElementById("auth-notice");
+    this.forgotPasswordBtn = document.getElementById("forgot-password-btn");
+    this.resendVerificationBtn = document.getElementById(
+      "resend-verification-btn"
+    );
+    this.ssoBtn = document.getElementById("sso-btn");
 
     // Chat elements
     this.currentUserSpan = document.getElementById("current-user");
@@ -51,6 +72,22 @@ class ChatApp {
     // Form submissions
     this.loginForm.addEventListener("submit", (e) => this.handleLogin(e));
     this.registerForm.addEventListener("submit", (e) => this.handleRegister(e));
+    this.twoFactorForm.addEventListener("submit", (e) =>
+      this.handleTwoFactor(e)
+    );
+    this.ssoBtn.addEventListener("click", () => this.handleSSOLogin());
+    this.forgotPasswordForm.addEventListener("submit", (e) =>
+      this.handleForgotPassword(e)
+    );
+    this.resetPasswordForm.addEventListener("submit", (e) =>
+      this.handleResetPassword(e)
+    );
+    this.forgotPasswordBtn.addEventListener("click", () =>
+      this.showForgotPasswordForm()
+    );
+    this.resendVerificationBtn.addEventListener("click", () =>
+      this.handleResendVerification()
+    );
 
     // Chat functionality
     this.logoutBtn.addEventListener("click", () => this.handleLogout());
@@ -66,6 +103,9 @@ class ChatApp {
   }
 
   switchTab(tab) {
+    this.twoFactorForm.classList.add("hidden");
+    this.forgotPasswordForm.classList.add("hidden");
+    this.resetPasswordForm.classList.add("hidden");
     if (tab === "login") {
       this.loginTab.classList.add("active");
       this.registerTab.classList.remove("active");
@@ -91,19 +131,108 @@ class ChatApp {
         password,
       });
 
-      if (response.success) {
-        this.token = response.data.token;
+      if (response.success && response.data.two_factor_required) {
+        // Password accepted, ask for the second factor
+        this.challengeToken = response.data.challenge_token;
+        this.loginForm.classList.add("hidden");
+        this.twoFactorForm.classList.remove("hidden");
+        document.getElementById("two-factor-code").focus();
+      } else if (response.success) {
+        this.setTokens(response.data);
         this.currentUser = response.data.user;
-        localStorage.setItem("token", this.token);
         this.showChatSection();
       } else {
         this.showAuthError(response.error.message);
+        if (response.error.code === "EMAIL_NOT_VERIFIED") {
+          this.resendVerificationBtn.classList.remove("hidden");
+        }
       }
     } catch (error) {
       this.showAuthError("Login failed. Please try again.");
     }
   }
 
+  async handleTwoFactor(e) {
+    e.preventDefault();
+    const input = document.getElementById("two-factor-code");
+    const value = input.value.trim();
+
+    // Authenticator codes are six digits, anything else is a recovery code
+    const body = { challenge_token: this.challengeToken };
+    if (/^\d{6}$/.test(value.replace(/\s/g, ""))) {
+      body.code = value;
+    } else {
+      body.recovery_code = value;
+    }
+
+    try {
+      const response = await this.apiCall("/api/auth/2fa/verify", "POST", body);
+
+      if (response.success) {
+        this.challengeToken = null;
+        input.value = "";
+        this.twoFactorForm.classList.add("hidden");
+        this.loginForm.classList.remove("hidden");
+        this.setTokens(response.data);
+        this.currentUser = response.data.user;
+        this.showChatSection();
+      } else {
+        this.showAuthError(response.error.message);
+        if (response.error.code === "INVALID_CHALLENGE") {
+          this.twoFactorForm.classList.add("hidden");
+          this.loginForm.classList.remove("hidden");
+        }
+      }
+    } catch (error) {
+      this.showAuthError("Verification failed. Please try again.");
+    }
+  }
+
+  async handleSSOLogin() {
+    try {
+      const response = await this.apiCall("/api/auth/oidc/login", "GET");
+
+      if (response.success) {
+        window.location.href = response.data.authorization_url;
+      } else {
+        this.showAuthError(response.error.message);
+      }
+    } catch (error) {
+      this.showAuthError("Single sign-on failed. Please try again.");
+    }
+  }
+
+  async handleSSOCallback(code, state) {
+    // Drop the code from the address bar, it can only be used once
+    window.history.replaceState({}, document.title, window.location.pathname);
+
+    try {
+      const response = await this.apiCall("/api/auth/oidc/callback", "POST", {
+        code,
+        state,
+      });
+
+      if (response.success && response.data.two_factor_required) {
+        // Identity accepted, ask for the second factor
+        this.showAuthSection();
+        this.challengeToken = response.data.challenge_token;
+        this.loginForm.classList.add("hidden");
+        this.twoFactorForm.classList.remove("hidden");
+        document.getElementById("two-factor-code").focus();
+      } else if (response.success) {
+        this.setTokens(response.data);
+        this.currentUser = response.data.user;
+        this.showChatSection();
+      } else {
+        this.showAuthSection();
+        this.showAuthError(response.error.message);
+      }
+    } catch (error) {
+      this.showAuthSection();
+      this.showAuthError("Single sign-on failed. Please try again.");
+    }
+  }
+
   async handleRegister(e) {
     e.preventDefault();
     const username = document.getElementById("register-username").value;
@@ -117,10 +246,14 @@ class ChatApp {
         password,
       });
 
-      if (response.success) {
-        this.token = response.data.token;
+      if (response.success && !response.data.access_token) {
+        // The account stays pending until the email address is verified
+        this.switchTab("login");
+        document.getElementById("login-email").value = email;
+        this.showAuthNotice(response.message);
+      } else if (response.success) {
+        this.setTokens(response.data);
         this.currentUser = response.data.user;
-        localStorage.setItem("token", this.token);
         this.showChatSection();
       } else {
         this.showAuthError(response.error.message);
@@ -130,6 +263,116 @@ class ChatApp {
     }
   }
 
+  async handleVerifyEmail(token) {
+    // Drop the token from the address bar, it should not end up in history
+    window.history.replaceState({}, document.title, window.location.pathname);
+    this.showAuthSection();
+
+    try {
+      const response = await this.apiCall("/api/auth/verify-email", "POST", {
+        token,
+      });
+
+      if (response.success) {
+        document.getElementById("login-email").value = response.data.email;
+        this.showAuthNotice("Email address verified, you can now log in.");
+      } else {
+        this.showAuthError(response.error.message);
+        this.resendVerificationBtn.classList.remove("hidden");
+      }
+    } catch (error) {
+      this.showAuthError("Verification failed. Please try again.");
+    }
+  }
+
+  async handleResendVerification() {
+    const email = document.getElementById("login-email").value;
+    if (!email) {
+      this.showAuthError("Enter your email address first.");
+      return;
+    }
+
+    try {
+      const response = await this.apiCall(
+        "/api/auth/verify-email/resend",
+        "POST",
+        { email }
+      );
+
+      if (response.success) {
+        this.resendVerificationBtn.classList.add("hidden");
+        this.showAuthNotice(response.message);
+      } else {
+        this.showAuthError(response.error.message);
+      }
+    } catch (error) {
+      this.showAuthError("Failed to send the email. Please try again.");
+    }
+  }
+
+  showForgotPasswordForm() {
+    this.switchTab("login");
+    this.loginForm.classList.add("hidden");
+    this.forgotPasswordForm.classList.remove("hidden");
+    document.getElementById("forgot-password-email").value =
+      document.getElementById("login-email").value;
+    document.getElementById("forgot-password-email").focus();
+  }
+
+  async handleForgotPassword(e) {
+    e.preventDefault();
+    const email = document.getElementById("forgot-password-email").value;
+
+    try {
+      const response = await this.apiCall("/api/auth/password/forgot", "POST", {
+        email,
+      });
+
+      if (response.success) {
+        this.switchTab("login");
+        this.showAuthNotice(response.message);
+      } else {
+        this.showAuthError(response.error.message);
+      }
+    } catch (error) {
+      this.showAuthError("Failed to send the email. Please try again.");
+    }
+  }
+
+  showResetPasswordForm(token) {
+    // Drop the token from the address bar, it should not end up in history
+    window.history.replaceState({}, document.title, window.location.pathname);
+    this.resetToken = token;
+    this.showAuthSection();
+    this.loginForm.classList.add("hidden");
+    this.resetPasswordForm.classList.remove("hidden");
+    document.getElementById("reset-password").focus();
+  }
+
+  async handleResetPassword(e) {
+    e.preventDefault();
+    const input = document.getElementById("reset-password");
+
+    try {
+      const response = await this.apiCall("/api/auth/password/reset", "POST", {
+        token: this.resetToken,
+        password: input.value,
+      });
+
+      if (response.success) {
+        this.resetToken = null;
+        input.value = "";
+        this.clearTokens();
+        this.switchTab("login");
+        this.showAuthNotice(response.message);
+      } else {
+        this.showAuthError(response.error.message);
+      }
+    } catch (error) {
+      this.showAuthError("Password reset failed. Please try again.");
+    }
+  }
+
   async handleLogout() {
     try {
       await this.apiCall("/api/auth/logout", "POST");
@@ -137,9 +380,8 @@ class ChatApp {
       console.error("Logout error:", error);
     }
 
-    this.token = null;
+    this.clearTokens();
     this.currentUser = null;
-    localStorage.removeItem("token");
     this.closeWebSocket();
     this.showAuthSection();
   }
@@ -388,13 +630,15 @@ class ChatApp {
   renderMediaContent(message) {
     if (!message.media_url) return "";
 
-    const fileExtension = message.media_filename
-      ? message.media_filename.split(".").pop().toLowerCase()
-      : "";
+    // Stored files are named after their detected type
+    const mediaPath = new URL(message.media_url, window.location.origin).pathname;
+    const fileExtension = mediaPath.split(".").pop().toLowerCase();
 
-    if (["jpg", "jpeg", "png", "gif"].includes(fileExtension)) {
-      return `<div class="message-media"><img src="${message.media_url}" alt="Image" onclick="window.open('${message.media_url}', '_blank')"></div>`;
-    } else if (["mp4", "avi", "mov"].includes(fileExtension)) {
+    if (["jpg", "jpeg", "png", "gif", "webp"].includes(fileExtension)) {
+      // Show the thumbnail, open the full-size image on click
+      const src = message.thumbnail_url || message.media_url;
+      return `<div class="message-media"><img src="${src}" alt="Image" onclick="window.open('${message.media_url}', '_blank')"></div>`;
+    } else if (["mp4", "avi", "mov", "webm"].includes(fileExtension)) {
       return `<div class="message-media"><video controls><source src="${message.media_url}" type="video/${fileExtension}"></video></div>`;
     } else {
       return `<div class="message-file">📎 <a href="${
@@ -407,16 +651,16 @@ class ChatApp {
     const content = this.messageInput.value.trim();
     if (!content && !this.pendingFile) return;
 
-    let mediaUrl = null;
+    let attachmentId = null;
     if (this.pendingFile) {
-      mediaUrl = await this.uploadFile(this.pendingFile);
-      if (!mediaUrl) return;
+      attachmentId = await this.uploadFile(this.pendingFile);
+      if (!attachmentId) return;
     }
 
     const messageData = {
       content: content || "File attachment",
-      message_type: mediaUrl ? this.getMessageType(this.pendingFile) : "text",
-      media_url: mediaUrl,
+      message_type: attachmentId ? this.getMessageType(this.pendingFile) : "text",
+      attachment_id: attachmentId,
     };
 
     try {
@@ -466,8 +710,8 @@ class ChatApp {
     const formData = new FormData();
     formData.append("file", file);
 
-    try {
-      const response = await fetch("/api/media/upload", {
+    const upload = () =>
+      fetch("/api/media/upload", {
         method: "POST",
         headers: {
           Authorization: `Bearer ${this.token}`,
@@ -475,9 +719,18 @@ class ChatApp {
         body: formData,
       });
 
+    try {
+      let response = await upload();
+      if (response.status === 401 && (await this.refreshAccessToken())) {
+        response = await upload();
+      }
+
       const result = await response.json();
       if (result.success) {
-        return result.data.url;
+        if (result.data.status === "pending") {
+          return await this.waitForScan(result.data.id);
+        }
+        return result.data.id;
       } else {
         alert("File upload failed: " + result.error.message);
         return null;
@@ -489,6 +742,25 @@ class ChatApp {
     }
   }
 
+  // Uploads cannot be sent until the virus scanner finds them clean
+  async waitForScan(attachmentId) {
+    for (let attempt = 0; attempt < 30; attempt++) {
+      await new Promise((resolve) => setTimeout(resolve, 2000));
+
+      const result = await this.apiCall(`/api/media/attachments/${attachmentId}`, "GET");
+      if (!result.success) {
+        alert("File upload failed: " + result.error.message);
+        return null;
+      }
+      if (result.data.status === "clean") {
+        return attachmentId;
+      }
+    }
+
+    alert("File is still being scanned. Please try again later.");
+    return null;
+  }
+
   handleFileUpload(e) {
     const file = e.target.files[0];
     if (file) {
@@ -596,9 +868,27 @@ class ChatApp {
     this.sendBtn.disabled = false;
   }
 
-  connectWebSocket() {
+  async connectWebSocket() {
+    // Use a single-use ticket so the token never appears in the URL
+    let ticket;
+    try {
+      const response = await this.apiCall("/api/ws/ticket", "POST");
+      if (!response.success) {
+        throw new Error(response.error?.message || "Failed to get ticket");
+      }
+      ticket = response.data.ticket;
+    } catch (error) {
+      console.error("WebSocket ticket error:", error);
+      setTimeout(() => {
+        if (this.token) {
+          this.connectWebSocket();
+        }
+      }, 3000);
+      return;
+    }
+
     const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
-    const wsUrl = `${protocol}//${window.location.host}/ws?token=${this.token}`;
+    const wsUrl = `${protocol}//${window.location.host}/ws?ticket=${encodeURIComponent(ticket)}`;
 
     this.ws = new WebSocket(wsUrl);
 
@@ -718,7 +1008,54 @@ class ChatApp {
     }
   }
 
-  async apiCall(endpoint, method, data = null) {
+  setTokens(authData) {
+    this.token = authData.token;
+    this.refreshToken = authData.refresh_token;
+    localStorage.setItem("token", this.token);
+    localStorage.setItem("refreshToken", this.refreshToken);
+  }
+
+  clearTokens() {
+    this.token = null;
+    this.refreshToken = null;
+    localStorage.removeItem("token");
+    localStorage.removeItem("refreshToken");
+  }
+
+  async refreshAccessToken() {
+    if (!this.refreshToken) {
+      return false;
+    }
+
+    // Share one in-flight refresh, refresh tokens are single-use
+    if (!this.refreshPromise) {
+      this.refreshPromise = (async () => {
+        try {
+          const response = await fetch("/api/auth/refresh", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ refresh_token: this.refreshToken }),
+          });
+          const result = await response.json();
+          if (result.success) {
+            this.setTokens(result.data);
+            return true;
+          }
+          this.clearTokens();
+          return false;
+        } catch (error) {
+          console.error("Token refresh error:", error);
+          return false;
+        } finally {
+          this.refreshPromise = null;
+        }
+      })();
+    }
+
+    return this.refreshPromise;
+  }
+
+  async apiCall(endpoint, method, data = null, retry = true) {
     const options = {
       method,
       headers: {
@@ -735,17 +1072,34 @@ class ChatApp {
     }
 
     const response = await fetch(endpoint, options);
+
+    // Access tokens are short-lived, refresh once and retry
+    if (response.status === 401 && retry && !endpoint.startsWith("/api/auth/")) {
+      if (await this.refreshAccessToken()) {
+        return this.apiCall(endpoint, method, data, false);
+      }
+    }
+
     return await response.json();
   }
 
   showAuthError(message) {
+    this.authNotice.style.display = "none";
     this.authError.textContent = message;
     this.authError.style.display = "block";
   }
 
+  showAuthNotice(message) {
+    this.authError.style.display = "none";
+    this.authNotice.textContent = message;
+    this.authNotice.style.display = "block";
+  }
+
   clearAuthError() {
     this.authError.textContent = "";
     this.authError.style.display = "none";
+    this.authNotice.textContent = "";
+    this.authNotice.style.display = "none";
   }
 
   scrollToBottom() {